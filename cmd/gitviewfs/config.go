@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ignoredMountOptions are generic mount(8) options that mount helpers are passed but don't apply to
+// gitviewfs.
+var ignoredMountOptions = map[string]bool{
+	"defaults": true, "rw": true, "ro": true, "auto": true, "noauto": true, "user": true,
+	"nouser": true, "users": true, "owner": true, "group": true, "dev": true, "nodev": true,
+	"suid": true, "nosuid": true, "exec": true, "noexec": true, "async": true, "sync": true,
+	"atime": true, "noatime": true, "relatime": true, "_netdev": true, "nofail": true,
+}
+
+// parseArgs parses the command line arguments after the command name, and returns the positional
+// arguments, like the mount point then the repository path. Flags may also follow the positional
+// arguments. If -o options do, as when gitviewfs is run by mount(8), the repository path comes
+// first, and gitviewfs runs in the background unless told otherwise.
+func parseArgs(arguments []string) []string {
+	flag.CommandLine.Parse(arguments)
+
+	var args []string
+	var trailingOptions bool
+	for rest := flag.Args(); len(rest) > 0; {
+		if strings.HasPrefix(rest[0], "-") {
+			before := len(mountOptions)
+			flag.CommandLine.Parse(rest)
+			trailingOptions = trailingOptions || len(mountOptions) > before
+			rest = flag.Args()
+			continue
+		}
+		args = append(args, rest[0])
+		rest = rest[1:]
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	// Warnings about mount options are logged as the command line asks, since the options may change
+	// the log level themselves.
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := applyMountOptions(mountOptions, explicit, logger); err != nil {
+		log.Fatal(err)
+	}
+	if *configPath != "" {
+		if err := applyConfig(*configPath, explicit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if trailingOptions {
+		if len(args) == 2 {
+			args[0], args[1] = args[1], args[0]
+		}
+		if !explicit["daemon"] {
+			*daemon = true
+		}
+	}
+	return args
+}
+
+// applyMountOptions sets flags from comma-separated -o options like "writable=refs/heads/*,debug".
+// Underscores in names are read as dashes, so allow_other sets -allow-other. Unknown options are
+// skipped with a warning, since fstab entries may be shared with other versions.
+func applyMountOptions(options []string, explicit map[string]bool, logger *logging.Logger) error {
+	for _, option := range options {
+		for _, keyValue := range strings.Split(option, ",") {
+			if keyValue == "" {
+				continue
+			}
+			key, value := keyValue, "true"
+			if i := strings.Index(keyValue, "="); i >= 0 {
+				key, value = keyValue[:i], keyValue[i+1:]
+			}
+			if ignoredMountOptions[key] || strings.HasPrefix(key, "x-") || key == "comment" {
+				continue
+			}
+
+			name := flagName(key)
+			if flag.Lookup(name) == nil {
+				logger.Warn("ignoring unknown mount option", "option", key)
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return errors.Wrapf(err, "invalid mount option %s", keyValue)
+			}
+			explicit[name] = true
+		}
+	}
+	return nil
+}
+
+// applyConfig sets flags from a config file, except those already set explicitly.
+func applyConfig(path string, explicit map[string]bool) error {
+	config, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range config {
+		name := flagName(entry.key)
+		if flag.Lookup(name) == nil {
+			return errors.Errorf("%s:%d: unknown option: %s", path, entry.line, entry.key)
+		}
+		if explicit[name] {
+			continue
+		}
+		for _, value := range entry.values {
+			if err := flag.Set(name, value); err != nil {
+				return errors.Wrapf(err, "%s:%d: invalid value for %s", path, entry.line, entry.key)
+			}
+		}
+	}
+	return nil
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+type configEntry struct {
+	line   int
+	key    string
+	values []string
+}
+
+// readConfig reads a config file. Config files are a subset of TOML: top-level keys whose values
+// are strings, booleans, numbers or arrays of those, which may span lines:
+//
+//	writable = [
+//		"refs/heads/scratch/*",
+//		"refs/heads/bots/*",
+//	]
+//	author-name = "Build Bot"
+//	debug = false
+//
+// Tables, inline tables, dotted keys, nested arrays and multi-line strings are rejected with errors
+// saying so.
+func readConfig(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open config file failed")
+	}
+	defer f.Close()
+
+	return parseConfig(f, path)
+}
+
+// parseConfig parses the contents of the config file called name, as described by readConfig.
+func parseConfig(r io.Reader, name string) ([]configEntry, error) {
+	var entries []configEntry
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, errors.Errorf(
+				"%s:%d: tables like %s aren't supported; set options at the top level", name, lineNum, line)
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, errors.Errorf("%s:%d: expected key = value", name, lineNum)
+		}
+		key := strings.TrimSpace(line[:i])
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			key = unquoted
+		} else if strings.Contains(key, ".") {
+			return nil, errors.Errorf("%s:%d: dotted keys like %s aren't supported", name, lineNum, key)
+		}
+
+		// Arrays may continue on the following lines.
+		entryLine := lineNum
+		text := strings.TrimSpace(line[i+1:])
+		values, rest, err := parseConfigValue(text)
+		for err == errUnterminatedArray && scanner.Scan() {
+			lineNum++
+			text += "\n" + scanner.Text()
+			values, rest, err = parseConfigValue(text)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", name, entryLine)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, errors.Errorf("%s:%d: unexpected text after value: %s", name, lineNum, rest)
+		}
+		entries = append(entries, configEntry{line: entryLine, key: key, values: values})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read config file failed")
+	}
+	return entries, nil
+}
+
+var errUnterminatedArray = errors.New("unterminated array")
+
+// parseConfigValue parses the value at the start of s, which is an array or a single value, and
+// returns the text after it. Arrays may contain newlines and comments.
+func parseConfigValue(s string) ([]string, string, error) {
+	if !strings.HasPrefix(s, "[") {
+		value, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, "", err
+		}
+		return []string{value}, rest, nil
+	}
+
+	values := []string{}
+	rest := skipConfigSpace(s[1:])
+	for !strings.HasPrefix(rest, "]") {
+		if rest == "" {
+			return nil, "", errUnterminatedArray
+		}
+		if strings.HasPrefix(rest, "[") {
+			return nil, "", errors.New("nested arrays aren't supported")
+		}
+		value, afterValue, err := parseConfigScalar(rest)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+
+		rest = skipConfigSpace(afterValue)
+		if strings.HasPrefix(rest, ",") {
+			rest = skipConfigSpace(rest[1:])
+		} else if rest == "" {
+			return nil, "", errUnterminatedArray
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, "", errors.New("expected , or ] in array")
+		}
+	}
+	return values, rest[1:], nil
+}
+
+// skipConfigSpace returns s without leading whitespace, newlines and comments.
+func skipConfigSpace(s string) string {
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		end := strings.Index(s, "\n")
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+}
+
+// parseConfigScalar parses the string, boolean or number at the start of s, and returns the text
+// after it.
+func parseConfigScalar(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"""`), strings.HasPrefix(s, "'''"):
+		return "", "", errors.New("multi-line strings aren't supported")
+
+	case strings.HasPrefix(s, "{"):
+		return "", "", errors.New("inline tables aren't supported")
+
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", errors.Wrapf(err, "invalid string %s", s[:i+1])
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return "", "", errors.New("unterminated string")
+
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+
+	default:
+		end := strings.IndexFunc(s, func(r rune) bool {
+			return unicode.IsSpace(r) || r == ',' || r == ']' || r == '#'
+		})
+		if end < 0 {
+			end = len(s)
+		}
+		if end == 0 {
+			return "", "", errors.New("expected value")
+		}
+		return s[:end], s[end:], nil
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []configEntry
+		wantErr string
+	}{
+		{
+			name:   "scalars",
+			config: "author-name = \"Build Bot\"\nallow-other = true\nshutdown-timeout = 5s # comment\n",
+			want: []configEntry{
+				{line: 1, key: "author-name", values: []string{"Build Bot"}},
+				{line: 2, key: "allow-other", values: []string{"true"}},
+				{line: 3, key: "shutdown-timeout", values: []string{"5s"}},
+			},
+		},
+		{
+			name:   "comments and blank lines",
+			config: "# header\n\n  debug = false\n",
+			want:   []configEntry{{line: 3, key: "debug", values: []string{"false"}}},
+		},
+		{
+			name:   "quoted key and literal string",
+			config: "\"author-email\" = 'bot@example.com'\n",
+			want:   []configEntry{{line: 1, key: "author-email", values: []string{"bot@example.com"}}},
+		},
+		{
+			name:   "escapes",
+			config: `author-name = "Build \"Bot\" é"`,
+			want:   []configEntry{{line: 1, key: "author-name", values: []string{`Build "Bot" é`}}},
+		},
+		{
+			name:   "array",
+			config: `writable = ["refs/heads/a/*", 'refs/heads/b/*']`,
+			want:   []configEntry{{line: 1, key: "writable", values: []string{"refs/heads/a/*", "refs/heads/b/*"}}},
+		},
+		{
+			name:   "empty array",
+			config: "writable = []",
+			want:   []configEntry{{line: 1, key: "writable", values: []string{}}},
+		},
+		{
+			name:   "multi-line array",
+			config: "writable = [\n  \"refs/heads/a/*\", # first\n  # between\n  \"refs/heads/b/*\",\n]\ndebug = true\n",
+			want: []configEntry{
+				{line: 1, key: "writable", values: []string{"refs/heads/a/*", "refs/heads/b/*"}},
+				{line: 6, key: "debug", values: []string{"true"}},
+			},
+		},
+		{
+			name:    "table",
+			config:  "debug = true\n[mount]\n",
+			wantErr: "test.toml:2: tables like [mount] aren't supported",
+		},
+		{
+			name:    "array of tables",
+			config:  "[[repos]]\n",
+			wantErr: "test.toml:1: tables like [[repos]] aren't supported",
+		},
+		{
+			name:    "inline table",
+			config:  "author = { name = \"a\" }\n",
+			wantErr: "test.toml:1: inline tables aren't supported",
+		},
+		{
+			name:    "dotted key",
+			config:  "author.name = \"a\"\n",
+			wantErr: "test.toml:1: dotted keys like author.name aren't supported",
+		},
+		{
+			name:    "nested array",
+			config:  "writable = [[\"a\"]]\n",
+			wantErr: "test.toml:1: nested arrays aren't supported",
+		},
+		{
+			name:    "multi-line string",
+			config:  "author-name = \"\"\"\nBuild Bot\"\"\"\n",
+			wantErr: "test.toml:1: multi-line strings aren't supported",
+		},
+		{
+			name:    "unterminated array",
+			config:  "writable = [\n\"a\",\n",
+			wantErr: "test.toml:1: unterminated array",
+		},
+		{
+			name:    "unterminated string",
+			config:  "author-name = \"Build Bot\n",
+			wantErr: "test.toml:1: unterminated string",
+		},
+		{
+			name:    "missing comma",
+			config:  "writable = [\"a\" \"b\"]\n",
+			wantErr: "test.toml:1: expected , or ] in array",
+		},
+		{
+			name:    "no value",
+			config:  "debug\n",
+			wantErr: "test.toml:1: expected key = value",
+		},
+		{
+			name:    "text after value",
+			config:  "debug = true false\n",
+			wantErr: "test.toml:1: unexpected text after value: false",
+		},
+		{
+			name:    "text after multi-line array",
+			config:  "writable = [\n\"a\"\n] x\n",
+			wantErr: "test.toml:3: unexpected text after value: x",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseConfig(strings.NewReader(test.config), "test.toml")
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyMountOptions(t *testing.T) {
+	// Skipped options are logged.
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name         string
+		options      []string
+		wantExplicit []string
+		wantErr      string
+	}{
+		{
+			name:         "flags",
+			options:      []string{"allow_other,author-name=Build Bot", "debug=false"},
+			wantExplicit: []string{"allow-other", "author-name", "debug"},
+		},
+		{
+			name:         "generic options are ignored",
+			options:      []string{"rw,nosuid,x-systemd.automount,comment=x,,allow_other"},
+			wantExplicit: []string{"allow-other"},
+		},
+		{
+			name:         "unknown options are skipped",
+			options:      []string{"no_such_option,allow_other,other=1"},
+			wantExplicit: []string{"allow-other"},
+		},
+		{
+			name:    "invalid value",
+			options: []string{"allow_other=maybe"},
+			wantErr: "invalid mount option allow_other=maybe",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer resetFlags(t)
+			explicit := map[string]bool{}
+			err := applyMountOptions(test.options, explicit, nil)
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]bool{}
+			for _, name := range test.wantExplicit {
+				want[name] = true
+			}
+			if !reflect.DeepEqual(explicit, want) {
+				t.Errorf("got explicit flags %v, want %v", explicit, want)
+			}
+		})
+	}
+
+	defer resetFlags(t)
+	if err := applyMountOptions([]string{"allow_other,author_name=Build Bot"}, map[string]bool{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !*allowOther || *authorName != "Build Bot" {
+		t.Errorf("got allow-other %v and author-name %q", *allowOther, *authorName)
+	}
+}
+
+// resetFlags sets the flags the tests set back to their defaults.
+func resetFlags(t *testing.T) {
+	flag.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+		if value, ok := f.Value.(*stringsFlag); ok {
+			*value = nil
+		} else if err := f.Value.Set(f.DefValue); err != nil {
+			t.Fatalf("reset -%s failed: %s", f.Name, err)
+		}
+	})
+}
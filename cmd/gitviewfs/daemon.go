@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv is set in the environment of the background process started by daemonize.
+const daemonEnv = "GITVIEWFS_DAEMON"
+
+// daemonReadyFD is the background process's end of a pipe that it reports readiness on.
+const daemonReadyFD = 3
+
+// daemonReady is what the background process writes once it has mounted the filesystem.
+const daemonReady = "ready"
+
+// isDaemon returns whether this is the background process started by daemonize.
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize starts gitviewfs again in a new session, with the same arguments, and exits once it
+// has mounted the filesystem. It's called before opening repositories, which the background
+// process does itself. If it fails, the exit status is 1; its errors are logged to this process's
+// stderr, which it shares.
+func daemonize() {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "find executable failed"))
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "create pipe failed"))
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{readyWriter} // Becomes daemonReadyFD.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(errors.Wrap(err, "start background process failed"))
+	}
+	readyWriter.Close()
+
+	// The pipe closes when the background process reports readiness or exits, whichever is first.
+	status, err := ioutil.ReadAll(readyReader)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "wait for background process failed"))
+	}
+	if string(status) != daemonReady {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// notifyReady tells the process that started this one, if any, that the filesystem is mounted.
+func notifyReady(logger *logging.Logger) {
+	if !isDaemon() {
+		return
+	}
+	ready := os.NewFile(daemonReadyFD, "ready")
+	defer ready.Close()
+	if _, err := ready.Write([]byte(daemonReady)); err != nil {
+		logger.Warn("notify parent process failed", "err", err)
+	}
+}
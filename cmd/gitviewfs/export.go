@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/josh-newman/gitviewfs/gitviewfs/archive"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitfstree"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// exportMain implements "gitviewfs export [-rev rev] [-format tar|tar.gz|zip] [-output file] [path]".
+// Like git archive, it archives the repository in the current directory, unless -git-dir or
+// $GIT_DIR is set.
+func exportMain(arguments []string) {
+	rev := flag.String("rev", "HEAD", "revision to archive")
+	format := flag.String("format", "tar", "archive format: tar, tar.gz or zip")
+	output := flag.String("output", "", "file to write the archive to, instead of standard output")
+	args := parseArgs(arguments)
+	if len(args) > 1 {
+		log.Fatal("Expected at most one argument: the path to archive")
+	}
+	archiveFormat, err := archive.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repo := openRepositories(".").repo
+	if repo == nil {
+		log.Fatal("export doesn't support -repos")
+	}
+	hash, err := gitfstree.ResolveCommit(repo, *rev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		log.Fatal(errors.Wrapf(err, "find commit %s failed", hash))
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		log.Fatal(errors.Wrapf(err, "find tree of commit %s failed", commit.Hash))
+	}
+
+	var entryPath []string
+	if len(args) == 1 {
+		if name := strings.Trim(path.Clean("/"+args[0]), "/"); name != "" {
+			entryPath = strings.Split(name, "/")
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "create archive failed"))
+		}
+		defer file.Close()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	err = archive.Write(buffered, gitfstree.NewTree(repo, tree, treeOptions(logger)), entryPath, archive.Options{
+		Format:  archiveFormat,
+		ModTime: commit.Committer.When,
+		Comment: commit.Hash.String(),
+		Commit:  commit,
+	})
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		if *output != "" {
+			os.Remove(*output)
+		}
+		log.Fatal(errors.Wrap(err, "write archive failed"))
+	}
+}
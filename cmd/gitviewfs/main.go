@@ -6,33 +6,113 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/josh-newman/gitviewfs/gitviewfs"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
 	"github.com/pkg/errors"
-	"gopkg.in/src-d/go-git.v4"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-var debug = flag.Bool("debug", false, "enable debug logging")
+var (
+	debug     = flag.Bool("debug", false, "enable debug logging, including FUSE requests")
+	logFormat = flag.String("log-format", "logfmt", "log format: logfmt or json")
+	logLevel  = flag.String("log-level", "warn", "minimum level of messages to log: debug, info, warn or error")
+	gitDir    = flag.String("git-dir", "", "path to the git directory (defaults to $GIT_DIR or discovery from the repository path)")
+	repos     = flag.String("repos", "", "directory of repositories, or file listing \"<name> <path>\" per line, to mount together")
+
+	writable    stringsFlag
+	authorName  = flag.String("author-name", "gitviewfs", "author name for commits to writable references")
+	authorEmail = flag.String("author-email", "gitviewfs@localhost", "author email for commits to writable references")
+	overlayDir  = flag.String("overlay", "", "directory to store changes to commit views in, without touching the repository")
+	searchIndex = flag.Bool("search-index", false, "narrow searches under search/ with the trigram index gitviewfs search keeps in the git directory")
+	filter      = flag.Bool("filter", false, "convert file contents in commit views as .gitattributes says: eol=crlf line endings, ident and export-subst")
+
+	daemon          = flag.Bool("daemon", false, "run in the background once mounted")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests when interrupted before detaching the mount")
+	metricsAddr     = flag.String("metrics-addr", "", "address, like localhost:9100, to serve Prometheus metrics on at /metrics")
+	allowOther      = flag.Bool("allow-other", false, "let users other than the one mounting access the filesystem")
+
+	configPath   = flag.String("config", "", "TOML file setting flags by name; flags on the command line take precedence")
+	mountOptions stringsFlag
+)
+
+func init() {
+	flag.Var(&mountOptions, "o", "comma-separated mount options like writable=refs/heads/*,allow_other, which set the flags of the same names (repeatable)")
+	flag.Var(&writable, "writable", "pattern of references, like refs/heads/scratch/*, that can be changed (repeatable); changes are committed on fsync, unmount or a write to .gitviewfs/sync")
+}
+
+// stringsFlag collects the values of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// subcommands run instead of mounting when named by the first argument. They're given the rest of
+// the arguments.
+var subcommands = map[string]func(args []string){
+	"unmount":      unmountMain,
+	"serve-http":   serveHTTPMain,
+	"serve-webdav": serveWebDAVMain,
+	"serve-9p":     serve9PMain,
+	"serve-nfs":    serveNFSMain,
+	"export":       exportMain,
+	"search":       searchMain,
+}
 
 func main() {
-	flag.Parse()
-	if flag.NArg() != 2 {
-		log.Fatalf("Expected two arguments: /mount/point /path/to/git/repository")
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			subcommand(os.Args[2:])
+			return
+		}
 	}
-	mountPath := flag.Arg(0)
-	repoPath := flag.Arg(1)
 
-	repo, err := git.PlainOpen(repoPath)
-	if err == git.ErrRepositoryNotExists {
-		log.Fatalf("No git repository found: %s", repoPath)
-	} else if err != nil {
-		log.Fatal(errors.Wrap(err, "open git repository failed"))
+	args := parseArgs(os.Args[1:])
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	repoPath := repoArgs(args, "/mount/point")
+	mountPath := args[0]
+	// The background process does all the setup, so nothing is done twice.
+	if *daemon && !isDaemon() {
+		daemonize()
+	}
+
+	opts := gitviewfs.Options{
+		Logger:     logger,
+		Tree:       treeOptions(logger),
+		OverlayDir: *overlayDir,
+	}
+	if *metricsAddr != "" {
+		opts.Metrics = gitviewfs.NewMetrics()
 	}
 
-	gfs, err := gitviewfs.New(repo)
+	repos := openRepositories(repoPath)
+
+	var gfs pathfs.FileSystem
+	if repos.multi != nil {
+		gfs, err = gitviewfs.NewMulti(repos.multi, opts)
+	} else {
+		gfs, err = gitviewfs.NewWithOptions(repos.repo, opts)
+	}
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "create gitviewfs failed"))
 	}
 	gfs.SetDebug(*debug)
+	if opts.Metrics != nil {
+		serveMetrics(*metricsAddr, opts.Metrics)
+	}
 
 	nfs := pathfs.NewPathNodeFs(gfs, &pathfs.PathNodeFsOptions{Debug: *debug})
 	connector := nodefs.NewFileSystemConnector(nfs.Root(), &nodefs.Options{Debug: *debug})
@@ -40,9 +120,10 @@ func main() {
 		connector.RawFS(),
 		mountPath,
 		&fuse.MountOptions{
-			FsName: "git:" + repoPath,
-			Name:   "gitviewfs",
-			Debug:  *debug,
+			FsName:     repos.source,
+			Name:       "gitviewfs",
+			Debug:      *debug,
+			AllowOther: *allowOther,
 		},
 	)
 
@@ -50,5 +131,53 @@ func main() {
 		log.Fatalf("serve failed: %s", err)
 	}
 
-	server.Serve()
+	// go-fuse only calls OnUnmount for submounts, so tell the filesystem it's unmounted here. This
+	// commits pending changes to writable references.
+	var unmountOnce sync.Once
+	onUnmount := func() {
+		unmountOnce.Do(gfs.OnUnmount)
+	}
+
+	served := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(served)
+	}()
+	if err := server.WaitMount(); err != nil {
+		log.Fatalf("mount failed: %s", err)
+	}
+	notifyReady(logger)
+
+	go handleSignals(server, mountPath, *shutdownTimeout, logger, func() {
+		onUnmount()
+		os.Exit(1)
+	})
+
+	<-served
+	onUnmount()
+}
+
+func newLogger() (*logging.Logger, error) {
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		return nil, err
+	}
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		return nil, err
+	}
+	return logging.New(os.Stderr, format, level), nil
+}
+
+// serveMetrics serves metrics over HTTP in the background.
+func serveMetrics(addr string, metrics *gitviewfs.Metrics) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "listen for metrics requests failed"))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		log.Fatal(errors.Wrap(http.Serve(listener, mux), "serve metrics failed"))
+	}()
 }
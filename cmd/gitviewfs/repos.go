@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitfstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitrepo"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"log"
+	"os"
+)
+
+// repositories are the repositories named on the command line: either one repository, or several
+// given with -repos.
+type repositories struct {
+	// source describes where the repositories are, like git:/path/to/repo/.git.
+	source string
+	repo   *git.Repository
+	// gitDir is repo's git directory.
+	gitDir string
+	multi  map[string]*git.Repository
+}
+
+// openRepositories opens the repositories in -repos, or else the one at repoPath, which may be
+// empty if the git directory is given by -git-dir or $GIT_DIR.
+func openRepositories(repoPath string) *repositories {
+	if *repos != "" {
+		return &repositories{source: "git:" + *repos, multi: openMultiRepos(*repos)}
+	}
+
+	repoOpts := gitrepo.OptionsFromEnv()
+	if *gitDir != "" {
+		repoOpts.GitDir = *gitDir
+	}
+	layout, err := gitrepo.Discover(repoPath, repoOpts)
+	if err == git.ErrRepositoryNotExists {
+		log.Fatalf("No git repository found: %s", repoPath)
+	} else if err != nil {
+		log.Fatal(errors.Wrap(err, "find git repository failed"))
+	}
+
+	repo, err := gitrepo.OpenLayout(layout)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "open git repository failed"))
+	}
+	return &repositories{source: "git:" + layout.GitDir, repo: repo, gitDir: layout.GitDir}
+}
+
+// openMultiRepos opens the repositories in reposPath, which is either a directory of repositories
+// or a file listing them.
+func openMultiRepos(reposPath string) map[string]*git.Repository {
+	info, err := os.Stat(reposPath)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "find repositories failed"))
+	}
+
+	var layouts map[string]*gitrepo.Layout
+	if info.IsDir() {
+		layouts, err = gitrepo.DiscoverDir(reposPath)
+	} else {
+		layouts, err = gitrepo.ReadList(reposPath)
+	}
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "find repositories failed"))
+	}
+	if len(layouts) == 0 {
+		log.Fatalf("No git repositories found: %s", reposPath)
+	}
+
+	multi, err := gitrepo.OpenAll(layouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return multi
+}
+
+// tree returns the tree showing the repositories.
+func (r *repositories) tree(opts gitfstree.Options) fstree.Node {
+	var tree fstree.Node
+	var err error
+	if r.multi != nil {
+		tree, err = gitfstree.NewMulti(r.multi, opts)
+	} else {
+		tree, err = gitfstree.NewWithOptions(r.repo, opts)
+	}
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "create tree failed"))
+	}
+	return tree
+}
+
+// treeOptions returns the tree options set by flags.
+func treeOptions(logger *logging.Logger) gitfstree.Options {
+	return gitfstree.Options{
+		Writable:    writable,
+		Author:      object.Signature{Name: *authorName, Email: *authorEmail},
+		Logger:      logger,
+		Filter:      *filter,
+		SearchIndex: *searchIndex,
+	}
+}
+
+// repoArgs checks the positional arguments of a command taking argNames followed by a repository
+// path, which is omitted with -repos and optional with -git-dir or $GIT_DIR. It returns the
+// repository path, or "" if there's none.
+func repoArgs(args []string, argNames ...string) string {
+	usage := "Expected arguments: "
+	for _, name := range argNames {
+		usage += name + " "
+	}
+
+	switch {
+	case *repos != "":
+		if len(args) != len(argNames) {
+			log.Fatalf("%swith -repos", usage)
+		}
+		return ""
+	case len(args) == len(argNames)+1:
+		return args[len(argNames)]
+	case len(args) == len(argNames) && (*gitDir != "" || os.Getenv("GIT_DIR") != ""):
+		return ""
+	default:
+		log.Fatalf("%s/path/to/git/repository", usage)
+		return ""
+	}
+}
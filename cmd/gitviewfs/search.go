@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/josh-newman/gitviewfs/gitviewfs/trigram"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// searchMain implements "gitviewfs search [-ref pattern] [-regexp] [-ignore-case] [-index file]
+// [-no-update] query". It searches the references of the repository in the current directory, unless
+// -git-dir or $GIT_DIR is set, and prints the matching lines as ref:path:line:text. The trigram index
+// is brought up to date first, which only reads the files it hasn't seen.
+func searchMain(arguments []string) {
+	var refPatterns stringsFlag
+	flag.Var(&refPatterns, "ref", "pattern of references to search, like refs/heads/* (repeatable; defaults to every branch and tag)")
+	useRegexp := flag.Bool("regexp", false, "treat the query as a regular expression rather than literal text")
+	ignoreCase := flag.Bool("ignore-case", false, "ignore case when matching")
+	indexPath := flag.String("index", "", "trigram index file (defaults to gitviewfs/trigrams in the git directory)")
+	noUpdate := flag.Bool("no-update", false, "search without adding new files to the index; files it doesn't have are read")
+	args := parseArgs(arguments)
+	if len(args) != 1 {
+		log.Fatal("Expected one argument: the query")
+	}
+	for _, pattern := range refPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatal(errors.Wrapf(err, "invalid reference pattern %q", pattern))
+		}
+	}
+	q, err := trigram.Compile(args[0], trigram.QueryOptions{Regexp: *useRegexp, IgnoreCase: *ignoreCase})
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "invalid query"))
+	}
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repos := openRepositories(".")
+	if repos.repo == nil {
+		log.Fatal("search doesn't support -repos")
+	}
+	repo := repos.repo
+	if *indexPath == "" {
+		*indexPath = trigram.DefaultPath(repos.gitDir)
+	}
+	index, err := trigram.Open(*indexPath)
+	if errors.Cause(err) == trigram.ErrCorrupt && !*noUpdate {
+		logger.Warn("rebuilding corrupt trigram index", "path", *indexPath, "err", err)
+		index, err = trigram.Reset(*indexPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	refs, err := searchedRefs(repo, refPatterns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*noUpdate {
+		trees := make([]*object.Tree, len(refs))
+		for i, ref := range refs {
+			trees[i] = ref.tree
+		}
+		added, err := index.Update(repo, trees)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "update trigram index failed"))
+		}
+		logger.Info("updated trigram index", "added", added, "blobs", index.Len())
+	}
+
+	matched, err := search(repo, index, refs, q, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !matched {
+		os.Exit(1)
+	}
+}
+
+type searchedRef struct {
+	name plumbing.ReferenceName
+	tree *object.Tree
+}
+
+// searchedRefs returns the references matching patterns, or every branch and tag if there are no
+// patterns, in name order. References that don't lead to commits are skipped.
+func searchedRefs(repo *git.Repository, patterns []string) ([]searchedRef, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, errors.Wrap(err, "list references failed")
+	}
+	var refs []searchedRef
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !searchesRef(ref.Name(), patterns) {
+			return nil
+		}
+		commit, err := repo.CommitObject(ref.Hash())
+		if err == plumbing.ErrObjectNotFound {
+			tag, tagErr := repo.TagObject(ref.Hash())
+			if tagErr != nil {
+				return nil
+			}
+			if commit, err = tag.Commit(); err != nil {
+				return nil
+			}
+		} else if err != nil {
+			return errors.Wrapf(err, "find commit of %s failed", ref.Name())
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return errors.Wrapf(err, "find tree of commit %s failed", commit.Hash)
+		}
+		refs = append(refs, searchedRef{name: ref.Name(), tree: tree})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].name < refs[j].name })
+	return refs, nil
+}
+
+func searchesRef(name plumbing.ReferenceName, patterns []string) bool {
+	if len(patterns) == 0 {
+		return name.IsBranch() || name.IsTag()
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, string(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type searchedFile struct {
+	ref  plumbing.ReferenceName
+	path string
+	hash plumbing.Hash
+}
+
+// search writes the lines of refs' files that q matches to w, and reports whether there were any.
+// Files shared by several references are only read once.
+func search(repo *git.Repository, index *trigram.Index, refs []searchedRef, q *trigram.Query, w io.Writer) (bool, error) {
+	candidate := index.Candidates(q)
+	var files []searchedFile
+	var blobs []plumbing.Hash
+	seen := map[plumbing.Hash]bool{}
+	for _, ref := range refs {
+		walker := object.NewTreeWalker(ref.tree, true, nil)
+		for {
+			name, entry, err := walker.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				walker.Close()
+				return false, errors.Wrapf(err, "walk tree of %s failed", ref.name)
+			}
+			if entry.Mode != filemode.Regular && entry.Mode != filemode.Executable || !candidate(entry.Hash) {
+				continue
+			}
+			files = append(files, searchedFile{ref: ref.name, path: name, hash: entry.Hash})
+			if !seen[entry.Hash] {
+				seen[entry.Hash] = true
+				blobs = append(blobs, entry.Hash)
+			}
+		}
+		walker.Close()
+	}
+
+	matches, err := trigram.Search(repo, blobs, q)
+	if err != nil {
+		return false, err
+	}
+	buffered := bufio.NewWriter(w)
+	for _, file := range files {
+		for _, line := range matches[file.hash] {
+			text := strings.TrimSuffix(string(line.Text), "\r")
+			fmt.Fprintf(buffered, "%s:%s:%d:%s\n", file.ref.Short(), file.path, line.Number, text)
+		}
+	}
+	return len(matches) > 0, errors.Wrap(buffered.Flush(), "write results failed")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/httpfs"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/josh-newman/gitviewfs/gitviewfs/nfs"
+	"github.com/josh-newman/gitviewfs/gitviewfs/ninep"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveHTTPMain implements "gitviewfs serve-http [-addr host:port] /path/to/git/repository".
+func serveHTTPMain(arguments []string) {
+	serveHandler(arguments, "HTTP", func(tree fstree.Node, logger *logging.Logger) http.Handler {
+		return httpfs.NewHandler(tree, logger)
+	})
+}
+
+// serveWebDAVMain implements "gitviewfs serve-webdav [-addr host:port] /path/to/git/repository".
+func serveWebDAVMain(arguments []string) {
+	serveHandler(arguments, "WebDAV", httpfs.NewWebDAVHandler)
+}
+
+// serve9PMain implements "gitviewfs serve-9p [-addr host:port|unix:/path] /path/to/git/repository".
+func serve9PMain(arguments []string) {
+	addr := flag.String("addr", "localhost:5640", "address to serve 9P on, or unix:/path/to/socket")
+	tree, logger := serveArgs(arguments)
+
+	network, address := "tcp", *addr
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "listen failed"))
+	}
+	logger.Info("serving 9P", "addr", *addr)
+	log.Fatal(errors.Wrap(ninep.NewServer(tree, logger).Serve(listener), "serve 9P failed"))
+}
+
+// serveNFSMain implements "gitviewfs serve-nfs [-addr host:port] /path/to/git/repository".
+func serveNFSMain(arguments []string) {
+	addr := flag.String("addr", "localhost:2049", "address to serve NFS and MOUNT on")
+	tree, logger := serveArgs(arguments)
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "listen failed"))
+	}
+	logger.Info("serving NFS", "addr", *addr)
+	log.Fatal(errors.Wrap(nfs.NewServer(tree, logger).Serve(listener), "serve NFS failed"))
+}
+
+// serveHandler serves the repositories named by arguments with the HTTP handler from newHandler.
+func serveHandler(arguments []string, protocol string, newHandler func(fstree.Node, *logging.Logger) http.Handler) {
+	addr := flag.String("addr", "localhost:8080", "address to serve "+protocol+" on")
+	tree, logger := serveArgs(arguments)
+
+	logger.Info("serving "+protocol, "addr", *addr)
+	err := http.ListenAndServe(*addr, newHandler(tree, logger))
+	log.Fatal(errors.Wrapf(err, "serve %s failed", protocol))
+}
+
+// serveArgs parses the arguments of a serve command, after it defines its own flags, and returns
+// the tree to serve.
+func serveArgs(arguments []string) (fstree.Node, *logging.Logger) {
+	args := parseArgs(arguments)
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return openRepositories(repoArgs(args)).tree(treeOptions(logger)), logger
+}
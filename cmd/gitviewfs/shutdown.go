@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handleSignals unmounts the filesystem when the process is interrupted or terminated, so killing
+// gitviewfs doesn't leave a dead mount behind. Unmounting waits for in-flight requests. If that
+// takes longer than timeout, or the mount is busy, the mount is detached lazily and done is called
+// to exit. A second signal detaches without waiting.
+func handleSignals(server *fuse.Server, mountPath string, timeout time.Duration, logger *logging.Logger, done func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	logger.Info("unmounting", "signal", sig, "path", mountPath)
+
+	unmounted := make(chan error, 1)
+	go func() {
+		unmounted <- server.Unmount()
+	}()
+
+	select {
+	case err := <-unmounted:
+		if err == nil {
+			// Serve returns now, and main finishes shutting down.
+			return
+		}
+		logger.Warn("unmount failed", "path", mountPath, "err", err)
+	case <-time.After(timeout):
+		logger.Warn("unmount timed out", "path", mountPath, "timeout", timeout)
+	case sig := <-signals:
+		logger.Warn("received signal again", "signal", sig)
+	}
+
+	logger.Info("detaching; the mount is removed once no longer busy", "path", mountPath)
+	if err := unmount(mountPath, true); err != nil {
+		logger.Error("detach failed", "path", mountPath, "err", err)
+	}
+	done()
+}
+
+// unmount unmounts a FUSE filesystem. A lazy unmount detaches the mount immediately, even if it's
+// busy, and cleans up once it's no longer used.
+func unmount(mountPath string, lazy bool) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		args := []string{"-u"}
+		if lazy {
+			args = append(args, "-z")
+		}
+		cmd = exec.Command("fusermount", append(args, mountPath)...)
+		if _, err := exec.LookPath("fusermount"); err != nil {
+			// Without fusermount, root can still use umount.
+			args = nil
+			if lazy {
+				args = append(args, "-l")
+			}
+			cmd = exec.Command("umount", append(args, mountPath)...)
+		}
+	default:
+		var args []string
+		if lazy {
+			args = append(args, "-f")
+		}
+		cmd = exec.Command("umount", append(args, mountPath)...)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "unmount %s failed: %s", mountPath, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unmountMain implements "gitviewfs unmount [-lazy] /mount/point".
+func unmountMain(args []string) {
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	lazy := flags.Bool("lazy", false, "detach the mount even if it's busy")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("Expected one argument: unmount /mount/point")
+	}
+
+	if err := unmount(flags.Arg(0), *lazy); err != nil {
+		log.Fatal(err)
+	}
+}
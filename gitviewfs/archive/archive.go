@@ -0,0 +1,354 @@
+// Package archive writes tar and zip archives of trees, like git archive.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitattributes"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format is an archive format.
+type Format string
+
+const (
+	Tar   Format = "tar"
+	TarGz Format = "tar.gz"
+	Zip   Format = "zip"
+)
+
+// ParseFormat parses a format name: tar, tar.gz (or tgz) or zip.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "tar":
+		return Tar, nil
+	case "tar.gz", "tgz":
+		return TarGz, nil
+	case "zip":
+		return Zip, nil
+	default:
+		return "", errors.Errorf("unknown archive format: %q", s)
+	}
+}
+
+// Options configures an archive.
+type Options struct {
+	Format Format
+	// ModTime is the modification time of every entry, usually the commit's time.
+	ModTime time.Time
+	// Comment is stored in the archive, like the commit hash git archive stores.
+	Comment string
+	// Commit, if set, fills in the $Format:...$ placeholders of files with the export-subst
+	// attribute, as git archive does.
+	Commit *object.Commit
+}
+
+// Write writes an archive of the file or directory at entryPath in root to w, or all of root if
+// entryPath is empty. Entries are named by their path from root and written in name order, so the
+// same tree always makes the same archive. Paths with the export-ignore attribute in .gitattributes
+// files of the tree are left out, and files with export-subst are expanded for opts.Commit.
+func Write(w io.Writer, root fstree.DirNode, entryPath []string, opts Options) error {
+	aw, err := newWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeRoot(aw, root, entryPath, opts.Commit); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// writeRoot finds the entry at entryPath, reading the attributes files on the way, and writes it
+// along with its parent directories.
+func writeRoot(aw writer, root fstree.DirNode, entryPath []string, commit *object.Commit) error {
+	var attrs gitattributes.Stack
+	dir := root
+	for i := 0; ; i++ {
+		children, err := dirChildren(dir, entryPath[:i])
+		if err != nil {
+			return err
+		}
+		if attrs, err = pushAttributes(attrs, entryPath[:i], children); err != nil {
+			return err
+		}
+		if i == len(entryPath) {
+			return writeDir(aw, entryPath, children, attrs, commit)
+		}
+
+		child, ok := children[entryPath[i]]
+		if !ok {
+			return errors.Errorf("%s not found", path.Join(entryPath[:i+1]...))
+		}
+		if i == len(entryPath)-1 {
+			return writeEntry(aw, entryPath, child, attrs, commit)
+		}
+		childDir, ok := child.(fstree.DirNode)
+		if !ok {
+			return errors.Errorf("%s isn't a directory", path.Join(entryPath[:i+1]...))
+		}
+		if attrs.Get(entryPath[:i+1], true, "export-ignore").IsSet() {
+			return nil
+		}
+		if err := aw.dir(path.Join(entryPath[:i+1]...)); err != nil {
+			return err
+		}
+		dir = childDir
+	}
+}
+
+func dirChildren(dir fstree.DirNode, dirPath []string) (map[string]fstree.Node, error) {
+	children, ferr := dir.Children()
+	if ferr != nil {
+		return nil, errors.Wrapf(ferr, "list %s failed", "/"+path.Join(dirPath...))
+	}
+	return children, nil
+}
+
+func pushAttributes(attrs gitattributes.Stack, dirPath []string, children map[string]fstree.Node) (gitattributes.Stack, error) {
+	f, err := gitattributes.Read(dirPath, children)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		attrs = append(attrs[:len(attrs):len(attrs)], f)
+	}
+	return attrs, nil
+}
+
+// writeDir writes the entries of the directory at dirPath.
+func writeDir(aw writer, dirPath []string, children map[string]fstree.Node, attrs gitattributes.Stack, commit *object.Commit) error {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := append(dirPath[:len(dirPath):len(dirPath)], name)
+		if err := writeEntry(aw, childPath, children[name], attrs, commit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the entry for node at entryPath, and the entries below it, unless it's ignored.
+// commit, if set, expands export-subst placeholders.
+func writeEntry(aw writer, entryPath []string, node fstree.Node, attrs gitattributes.Stack, commit *object.Commit) error {
+	name := path.Join(entryPath...)
+	switch n := node.(type) {
+	case fstree.DirNode:
+		if attrs.Get(entryPath, true, "export-ignore").IsSet() {
+			return nil
+		}
+		if err := aw.dir(name); err != nil {
+			return err
+		}
+		children, err := dirChildren(n, entryPath)
+		if err != nil {
+			return err
+		}
+		childAttrs, err := pushAttributes(attrs, entryPath, children)
+		if err != nil {
+			return err
+		}
+		return writeDir(aw, entryPath, children, childAttrs, commit)
+
+	case fstree.FileNode:
+		if attrs.Get(entryPath, false, "export-ignore").IsSet() {
+			return nil
+		}
+		var subst *object.Commit
+		if attrs.Get(entryPath, false, "export-subst").IsSet() {
+			subst = commit
+		}
+		return errors.Wrapf(writeFile(aw, name, n.File(), subst), "archive %s failed", name)
+	}
+	return nil
+}
+
+// writeFile writes file, expanding its export-subst placeholders for commit if it's set.
+func writeFile(aw writer, name string, file *object.File, commit *object.Commit) error {
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if file.Mode == filemode.Symlink {
+		target, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		return aw.symlink(name, string(target))
+	}
+	executable := file.Mode == filemode.Executable
+	if commit == nil {
+		return aw.file(name, executable, file.Size, reader)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	data = gitattributes.Filter{ExportSubst: true}.Apply(data, file.Hash, commit)
+	return aw.file(name, executable, int64(len(data)), bytes.NewReader(data))
+}
+
+// writer writes entries of an archive. Directory names don't have trailing slashes.
+type writer interface {
+	dir(name string) error
+	file(name string, executable bool, size int64, contents io.Reader) error
+	symlink(name string, target string) error
+	Close() error
+}
+
+func newWriter(w io.Writer, opts Options) (writer, error) {
+	switch opts.Format {
+	case Tar:
+		return newTarWriter(w, nil, opts)
+	case TarGz:
+		gz := gzip.NewWriter(w)
+		return newTarWriter(gz, gz, opts)
+	case Zip:
+		return newZipWriter(w, opts)
+	default:
+		return nil, errors.Errorf("unknown archive format: %q", opts.Format)
+	}
+}
+
+// Modes of entries, as git archive writes them with its default umask of 002.
+const (
+	dirMode        = 0775
+	fileMode       = 0664
+	executableMode = 0775
+	symlinkMode    = 0777
+)
+
+type tarWriter struct {
+	tw *tar.Writer
+	// gz is the compressor tw writes to, if any.
+	gz      *gzip.Writer
+	modTime time.Time
+}
+
+func newTarWriter(w io.Writer, gz *gzip.Writer, opts Options) (*tarWriter, error) {
+	t := &tarWriter{tw: tar.NewWriter(w), gz: gz, modTime: opts.ModTime}
+	if opts.Comment != "" {
+		err := t.tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{"comment": opts.Comment},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "write tar header failed")
+		}
+	}
+	return t, nil
+}
+
+func (t *tarWriter) header(typeflag byte, name string, mode int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     mode,
+		ModTime:  t.modTime,
+		Uname:    "root",
+		Gname:    "root",
+	}
+}
+
+func (t *tarWriter) dir(name string) error {
+	return errors.Wrap(t.tw.WriteHeader(t.header(tar.TypeDir, name+"/", dirMode)), "write tar header failed")
+}
+
+func (t *tarWriter) file(name string, executable bool, size int64, contents io.Reader) error {
+	header := t.header(tar.TypeReg, name, fileMode)
+	if executable {
+		header.Mode = executableMode
+	}
+	header.Size = size
+	if err := t.tw.WriteHeader(header); err != nil {
+		return errors.Wrap(err, "write tar header failed")
+	}
+	_, err := io.Copy(t.tw, contents)
+	return errors.Wrap(err, "write tar entry failed")
+}
+
+func (t *tarWriter) symlink(name string, target string) error {
+	header := t.header(tar.TypeSymlink, name, symlinkMode)
+	header.Linkname = target
+	return errors.Wrap(t.tw.WriteHeader(header), "write tar header failed")
+}
+
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return errors.Wrap(err, "finish tar failed")
+	}
+	if t.gz != nil {
+		return errors.Wrap(t.gz.Close(), "finish gzip failed")
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw      *zip.Writer
+	modTime time.Time
+}
+
+func newZipWriter(w io.Writer, opts Options) (*zipWriter, error) {
+	z := &zipWriter{zw: zip.NewWriter(w), modTime: opts.ModTime}
+	if err := z.zw.SetComment(opts.Comment); err != nil {
+		return nil, errors.Wrap(err, "set zip comment failed")
+	}
+	return z, nil
+}
+
+func (z *zipWriter) create(name string, method uint16, mode os.FileMode) (io.Writer, error) {
+	header := &zip.FileHeader{Name: name, Method: method, Modified: z.modTime}
+	header.SetMode(mode)
+	w, err := z.zw.CreateHeader(header)
+	return w, errors.Wrap(err, "write zip header failed")
+}
+
+func (z *zipWriter) dir(name string) error {
+	_, err := z.create(name+"/", zip.Store, os.ModeDir|dirMode)
+	return err
+}
+
+func (z *zipWriter) file(name string, executable bool, size int64, contents io.Reader) error {
+	mode := os.FileMode(fileMode)
+	if executable {
+		mode = executableMode
+	}
+	w, err := z.create(name, zip.Deflate, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, contents)
+	return errors.Wrap(err, "write zip entry failed")
+}
+
+// symlink writes a symlink, which zip stores as a file containing its target.
+func (z *zipWriter) symlink(name string, target string) error {
+	w, err := z.create(name, zip.Store, os.ModeSymlink|symlinkMode)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return errors.Wrap(err, "write zip entry failed")
+}
+
+func (z *zipWriter) Close() error {
+	return errors.Wrap(z.zw.Close(), "finish zip failed")
+}
@@ -0,0 +1,213 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree/fstreetest"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+
+var testCommit = &object.Commit{
+	Hash:      plumbing.NewHash("0123456789abcdef0123456789abcdef01234567"),
+	Author:    object.Signature{Name: "A U Thor", Email: "author@example.com", When: testTime},
+	Committer: object.Signature{Name: "C O Mitter", Email: "committer@example.com", When: testTime},
+	Message:   "Subject\n\nBody\n",
+}
+
+func newTestTree() fstreetest.Dir {
+	return fstreetest.Dir{
+		".gitattributes": fstreetest.NewFile(".gitattributes", filemode.Regular, "*.tmp export-ignore\nignored/ export-ignore\nversion.txt export-subst\n"),
+		"README":         fstreetest.NewFile("README", filemode.Regular, "readme $Format:%H$\n"),
+		"version.txt":    fstreetest.NewFile("version.txt", filemode.Regular, "$Format:%h by %an$\n"),
+		"run.sh":         fstreetest.NewFile("run.sh", filemode.Executable, "#!/bin/sh\n"),
+		"link":           fstreetest.NewFile("link", filemode.Symlink, "README"),
+		"scratch.tmp":    fstreetest.NewFile("scratch.tmp", filemode.Regular, "scratch\n"),
+		"ignored": fstreetest.Dir{
+			"file": fstreetest.NewFile("file", filemode.Regular, "ignored\n"),
+		},
+		"src": fstreetest.Dir{
+			".gitattributes": fstreetest.NewFile(".gitattributes", filemode.Regular, "*.tmp -export-ignore\nsecret export-ignore\n"),
+			"main.go":        fstreetest.NewFile("main.go", filemode.Regular, "package main\n"),
+			"kept.tmp":       fstreetest.NewFile("kept.tmp", filemode.Regular, "kept\n"),
+			"secret":         fstreetest.NewFile("secret", filemode.Regular, "secret\n"),
+			"version.txt":    fstreetest.NewFile("version.txt", filemode.Regular, "$Format:%H$\n"),
+		},
+	}
+}
+
+// entry is an archive entry, as read back in tests.
+type entry struct {
+	name     string
+	mode     int64
+	contents string
+}
+
+func readTar(t *testing.T, r io.Reader) []entry {
+	tr := tar.NewReader(r)
+	var entries []entry
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			if comment := header.PAXRecords["comment"]; comment != testCommit.Hash.String() {
+				t.Errorf("got comment %q", comment)
+			}
+			continue
+		}
+		if !header.ModTime.Equal(testTime) {
+			t.Errorf("%s: got time %v", header.Name, header.ModTime)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			contents = []byte(header.Linkname)
+		}
+		entries = append(entries, entry{name: header.Name, mode: header.Mode, contents: string(contents)})
+	}
+}
+
+func readZip(t *testing.T, data []byte) []entry {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.Comment != testCommit.Hash.String() {
+		t.Errorf("got comment %q", zr.Comment)
+	}
+	var entries []entry
+	for _, file := range zr.File {
+		if !file.Modified.Equal(testTime) {
+			t.Errorf("%s: got time %v", file.Name, file.Modified)
+		}
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry{name: file.Name, mode: int64(file.Mode().Perm()), contents: string(contents)})
+	}
+	return entries
+}
+
+func readArchive(t *testing.T, format Format, data []byte) []entry {
+	switch format {
+	case Tar:
+		return readTar(t, bytes.NewReader(data))
+	case TarGz:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readTar(t, gz)
+	default:
+		return readZip(t, data)
+	}
+}
+
+func writeArchive(t *testing.T, format Format, entryPath []string) []byte {
+	var buf bytes.Buffer
+	opts := Options{Format: format, ModTime: testTime, Comment: testCommit.Hash.String(), Commit: testCommit}
+	if err := Write(&buf, newTestTree(), entryPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var formats = []Format{Tar, TarGz, Zip}
+
+func TestWrite(t *testing.T) {
+	want := []entry{
+		{name: ".gitattributes", mode: fileMode, contents: "*.tmp export-ignore\nignored/ export-ignore\nversion.txt export-subst\n"},
+		{name: "README", mode: fileMode, contents: "readme $Format:%H$\n"},
+		{name: "link", mode: symlinkMode, contents: "README"},
+		{name: "run.sh", mode: executableMode, contents: "#!/bin/sh\n"},
+		{name: "src/", mode: dirMode},
+		{name: "src/.gitattributes", mode: fileMode, contents: "*.tmp -export-ignore\nsecret export-ignore\n"},
+		{name: "src/kept.tmp", mode: fileMode, contents: "kept\n"},
+		{name: "src/main.go", mode: fileMode, contents: "package main\n"},
+		{name: "src/version.txt", mode: fileMode, contents: testCommit.Hash.String() + "\n"},
+		{name: "version.txt", mode: fileMode, contents: "0123456 by A U Thor\n"},
+	}
+	for _, format := range formats {
+		t.Run(string(format), func(t *testing.T) {
+			got := readArchive(t, format, writeArchive(t, format, nil))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteEntryPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		entryPath string
+		want      []string
+	}{
+		{name: "directory", entryPath: "src", want: []string{"src/", "src/.gitattributes", "src/kept.tmp", "src/main.go", "src/version.txt"}},
+		{name: "file", entryPath: "src/main.go", want: []string{"src/", "src/main.go"}},
+		{name: "file ignored below", entryPath: "src/secret", want: []string{"src/"}},
+		{name: "ignored directory", entryPath: "ignored/file"},
+		{name: "ignored file", entryPath: "scratch.tmp"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, entry := range readArchive(t, Tar, writeArchive(t, Tar, strings.Split(test.entryPath, "/"))) {
+				got = append(got, entry.name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	for _, format := range formats {
+		t.Run(string(format), func(t *testing.T) {
+			// Each run lists a new tree, whose maps iterate in a different order.
+			first := writeArchive(t, format, nil)
+			for i := 0; i < 10; i++ {
+				if again := writeArchive(t, format, nil); !bytes.Equal(again, first) {
+					t.Fatalf("run %d differs from the first", i+2)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteNotFound(t *testing.T) {
+	tests := []string{"missing", "README/file", "src/missing"}
+	for _, entryPath := range tests {
+		t.Run(entryPath, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, newTestTree(), strings.Split(entryPath, "/"), Options{Format: Tar}); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package gitviewfs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitfstree"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the version reported in .gitviewfs/version. Release builds set it with
+// -ldflags "-X github.com/josh-newman/gitviewfs/gitviewfs.Version=...".
+var Version = "dev"
+
+// controlDirName is the directory at the mount root for inspecting and controlling a running
+// filesystem.
+const controlDirName = ".gitviewfs"
+
+// controlRootNode is the mount root: the tree, plus the control directory.
+type controlRootNode struct {
+	// tree is the tree being served, which may be wrapped by an overlay.
+	tree fstree.DirNode
+	// base is the unwrapped tree, which handles syncing and refreshing.
+	base    fstree.Node
+	control fstree.Node
+}
+
+func (n *controlRootNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	children, ferr := n.tree.Children()
+	if ferr != nil {
+		return nil, ferr
+	}
+	children[controlDirName] = n.control
+	return children, nil
+}
+
+// Lookup looks children of the tree up without listing it.
+func (n *controlRootNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	if name == controlDirName {
+		return n.control, nil
+	}
+	return fstree.Child(n.tree, name)
+}
+
+func (n *controlRootNode) Sync() *fserror.Error {
+	if syncer, ok := n.base.(fstree.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (n *controlRootNode) Refresh() *fserror.Error {
+	if refresher, ok := n.base.(fstree.Refresher); ok {
+		return refresher.Refresh()
+	}
+	return nil
+}
+
+// newControlDir returns the control directory's tree. Writing anything to refresh reloads
+// references, and writing to cache/drop empties the tree cache. debug holds whether debug logging
+// is on, and can be set by writing a boolean like 1 or false. stats, config and version are
+// read-only.
+func (f *gitviewfs) newControlDir(root *controlRootNode, opts Options) fstree.Node {
+	return &controlDirNode{children: map[string]fstree.Node{
+		"refresh": &writableControlFileNode{
+			controlFileNode: controlFileNode{name: "refresh"},
+			write: func(string) *fserror.Error {
+				return root.Refresh()
+			},
+		},
+		"cache": &controlDirNode{children: map[string]fstree.Node{
+			"drop": &writableControlFileNode{
+				controlFileNode: controlFileNode{name: "drop"},
+				write: func(string) *fserror.Error {
+					opts.Tree.Cache.Drop()
+					return nil
+				},
+			},
+		}},
+		"debug": &writableControlFileNode{
+			controlFileNode: controlFileNode{name: "debug", read: func() string {
+				return strconv.FormatBool(f.isDebug()) + "\n"
+			}},
+			write: func(value string) *fserror.Error {
+				debug, err := strconv.ParseBool(strings.TrimSpace(value))
+				if err != nil {
+					return fserror.Expected(fuse.EINVAL)
+				}
+				f.SetDebug(debug)
+				return nil
+			},
+		},
+		"stats": &controlFileNode{name: "stats", read: func() string {
+			return f.stats(opts)
+		}},
+		"config": &controlFileNode{name: "config", read: func() string {
+			return f.config(opts)
+		}},
+		"version": &controlFileNode{name: "version", read: func() string {
+			return "gitviewfs " + Version + "\n"
+		}},
+	}}
+}
+
+func (f *gitviewfs) stats(opts Options) string {
+	var buf bytes.Buffer
+	cacheStats := opts.Tree.Cache.Stats()
+	fmt.Fprintf(&buf, "uptime %s\n", time.Since(f.started).Truncate(time.Second))
+	fmt.Fprintf(&buf, "cache.size %d\n", cacheStats.Size)
+	fmt.Fprintf(&buf, "cache.entries %d\n", cacheStats.Entries)
+	fmt.Fprintf(&buf, "cache.hits %d\n", cacheStats.Hits)
+	fmt.Fprintf(&buf, "cache.misses %d\n", cacheStats.Misses)
+	return buf.String()
+}
+
+func (f *gitviewfs) config(opts Options) string {
+	var buf bytes.Buffer
+	for _, pattern := range opts.Tree.Writable {
+		fmt.Fprintf(&buf, "writable %s\n", pattern)
+	}
+	fmt.Fprintf(&buf, "author %s <%s>\n", opts.Tree.Author.Name, opts.Tree.Author.Email)
+	if opts.OverlayDir != "" {
+		fmt.Fprintf(&buf, "overlay %s\n", opts.OverlayDir)
+	}
+	fmt.Fprintf(&buf, "cache.size %d\n", opts.Tree.Cache.Stats().Size)
+	fmt.Fprintf(&buf, "debug %t\n", f.isDebug())
+	return buf.String()
+}
+
+// controlDirNode is a directory in the control tree.
+type controlDirNode struct {
+	children map[string]fstree.Node
+}
+
+func (n *controlDirNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	children := make(map[string]fstree.Node, len(n.children))
+	for name, child := range n.children {
+		children[name] = child
+	}
+	return children, nil
+}
+
+// controlFileNode is a read-only file whose contents are generated each time it's looked up.
+type controlFileNode struct {
+	name string
+	// read returns the file's contents. If it's nil, the file is empty.
+	read func() string
+}
+
+func (n *controlFileNode) File() *object.File {
+	var contents string
+	if n.read != nil {
+		contents = n.read()
+	}
+	return gitfstree.NewMemoryFile(n.name, filemode.Regular, []byte(contents))
+}
+
+// writableControlFileNode is a control file that runs a command when written to. Each write is one
+// command, given the written data.
+type writableControlFileNode struct {
+	controlFileNode
+	write func(value string) *fserror.Error
+}
+
+var _ fstree.WritableFileNode = (*writableControlFileNode)(nil)
+
+func (n *writableControlFileNode) WriteAt(data []byte, off int64) (int, *fserror.Error) {
+	if ferr := n.write(string(data)); ferr != nil {
+		return 0, ferr
+	}
+	return len(data), nil
+}
+
+func (n *writableControlFileNode) Truncate(size int64) *fserror.Error {
+	// Shells truncate files before writing to them; there's nothing to do.
+	return nil
+}
+
+func (n *writableControlFileNode) SetMode(mode filemode.FileMode) *fserror.Error {
+	return fserror.Expected(fuse.EPERM)
+}
@@ -3,64 +3,94 @@ package gitviewfs
 import (
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
 	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"io"
-	"io/ioutil"
-	"log"
+	"sync"
+	"time"
 )
 
 type file struct {
-	node   fstree.FileNode
-	logger *log.Logger
+	node    fstree.FileNode
+	logger  *logging.Logger
+	metrics *Metrics
 	nodefs.File
+
+	mu sync.Mutex
+	// reader reads readerFile, the node's contents when it was last read. It's kept between reads so
+	// sequential reads don't start over from the beginning of the file.
+	reader     *fstree.FileReader
+	readerFile *object.File
 }
 
-func newFile(node fstree.FileNode, logger *log.Logger) nodefs.File {
-	return nodefs.NewReadOnlyFile(&file{
-		node:   node,
-		logger: logger,
-		File:   nodefs.NewDefaultFile(),
-	})
+func newFile(node fstree.FileNode, logger *logging.Logger, metrics *Metrics) nodefs.File {
+	f := &file{
+		node:    node,
+		logger:  logger,
+		metrics: metrics,
+		File:    nodefs.NewDefaultFile(),
+	}
+	if writableNode, ok := node.(fstree.WritableFileNode); ok {
+		return &writableFile{file: f, node: writableNode}
+	}
+	return nodefs.NewReadOnlyFile(f)
 }
 
 func (f *file) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	reader, err := f.node.File().Reader()
-	if err != nil {
-		f.logger.Printf("error creating file reader: %s", err)
-		return nil, fuse.EIO
-	}
-	defer reader.Close()
+	defer f.metrics.observe("Read", time.Now())
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	// Seek to requested offset by reading and discarding.
-	// TODO(josh-newman): Seek more efficiently? Avoid O(n^2) reading across multiple requests.
-	for off > 0 {
-		nDiscarded, err := io.CopyN(ioutil.Discard, reader, off)
-		off -= nDiscarded
-		if err == io.EOF {
-			off = 0
-		} else if err != nil {
-			f.logger.Printf("error seeking in file: %s", err)
-			return nil, fuse.EIO
+	// Writable files change, so the reader is replaced when the contents are.
+	if contents := f.node.File(); contents != f.readerFile {
+		if f.reader != nil {
+			f.reader.Close()
 		}
+		f.reader = fstree.NewFileReader(contents)
+		f.readerFile = contents
+	}
+	if _, err := f.reader.Seek(off, io.SeekStart); err != nil {
+		return nil, f.status("Read", fserror.Unexpected(errors.Wrap(err, "seek in file failed")))
 	}
+	// Short reads mean the end of the file, so read as much as is asked for.
+	nRead, err := io.ReadFull(f.reader, dest)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, f.status("Read", fserror.Unexpected(errors.Wrap(err, "read file failed")))
+	}
+
+	f.metrics.addBytesRead(nRead)
+	return fuse.ReadResultData(dest[:nRead]), fuse.OK
+}
 
-	nRead, err := reader.Read(dest)
-	dest = dest[:nRead]
-	if err != nil {
-		f.logger.Printf("error reading file: %s", err)
-		return nil, fuse.EIO
+func (f *file) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+		f.readerFile = nil
 	}
+}
 
-	return fuse.ReadResultData(dest), fuse.OK
+// status reports ferr, returned by op, and returns the status to fail the request with.
+func (f *file) status(op string, ferr *fserror.Error) fuse.Status {
+	reportError(f.logger, f.metrics, ferr, "op", op)
+	return ferr.Status
 }
 
 func (f *file) GetAttr(out *fuse.Attr) fuse.Status {
 	if mode := computeFuseFileMode(f.node.File().Mode); mode != 0 {
 		out.Mode = mode
 	} else {
-		f.logger.Printf("skipping file child: %v", f.node)
+		f.logger.Info("skipping file", "mode", f.node.File().Mode, "hash", f.node.File().Hash)
 		return fuse.ENOENT
 	}
+	if _, ok := f.node.(fstree.WritableFileNode); ok && out.IsRegular() {
+		out.Mode |= 0200
+	}
 	out.Size = uint64(f.node.File().Size)
 	return fuse.OK
 }
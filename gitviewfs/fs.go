@@ -7,31 +7,106 @@ import (
 	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
 	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
 	"github.com/josh-newman/gitviewfs/gitviewfs/gitfstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/josh-newman/gitviewfs/gitviewfs/overlay"
+	"github.com/pkg/errors"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"io/ioutil"
-	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 type gitviewfs struct {
 	pathfs.FileSystem
-	fstree fstree.Node
-	logger *log.Logger
+	fstree  fstree.Node
+	logger  *logging.Logger
+	metrics *Metrics
+	started time.Time
+	// level is the logger's level when debug logging is off.
+	level logging.Level
+}
+
+// Options configures a gitviewfs.
+type Options struct {
+	Tree gitfstree.Options
+	// OverlayDir, if set, makes commit views accept changes, which are stored in this directory
+	// instead of the repository. See package overlay.
+	OverlayDir string
+	// Metrics, if set, records requests to the filesystem.
+	Metrics *Metrics
+	// Logger is used by the filesystem and, unless Tree.Logger is set, its tree. If it's nil, warnings
+	// and errors are logged to stderr.
+	Logger *logging.Logger
 }
 
 func New(repo *git.Repository) (pathfs.FileSystem, error) {
-	tree, err := gitfstree.New(repo)
+	return NewWithOptions(repo, Options{})
+}
+
+func NewWithOptions(repo *git.Repository, opts Options) (pathfs.FileSystem, error) {
+	opts = withDefaults(opts)
+	tree, err := gitfstree.NewWithOptions(repo, opts.Tree)
+	if err != nil {
+		return nil, err
+	}
+	return newFS(tree, opts)
+}
+
+// NewMulti returns a filesystem showing several repositories, each in a directory named by its key
+// in repos.
+func NewMulti(repos map[string]*git.Repository, opts Options) (pathfs.FileSystem, error) {
+	opts = withDefaults(opts)
+	tree, err := gitfstree.NewMulti(repos, opts.Tree)
 	if err != nil {
 		return nil, err
 	}
+	return newFS(tree, opts)
+}
 
-	return &gitviewfs{
+// withDefaults fills in options the filesystem needs to refer to later.
+func withDefaults(opts Options) Options {
+	if opts.Tree.Cache == nil {
+		opts.Tree.Cache = gitfstree.NewCache(gitfstree.DefaultCacheSize)
+	}
+	if opts.Logger == nil {
+		opts.Logger = logging.New(os.Stderr, logging.Logfmt, logging.Warn)
+	}
+	if opts.Tree.Logger == nil {
+		opts.Tree.Logger = opts.Logger
+	}
+	return opts
+}
+
+func newFS(tree fstree.Node, opts Options) (*gitviewfs, error) {
+	root := &controlRootNode{base: tree}
+	if opts.OverlayDir != "" {
+		var err error
+		tree, err = overlay.New(tree, opts.OverlayDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dirNode, ok := tree.(fstree.DirNode)
+	if !ok {
+		return nil, errors.Errorf("tree root is not a directory: %v", tree)
+	}
+	root.tree = dirNode
+
+	f := &gitviewfs{
 		FileSystem: pathfs.NewDefaultFileSystem(),
-		fstree:     tree,
-		logger:     log.New(ioutil.Discard, "gitviewfs", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile|log.LUTC),
-	}, nil
+		fstree:     root,
+		logger:     opts.Logger,
+		metrics:    opts.Metrics,
+		started:    time.Now(),
+		level:      opts.Logger.Level(),
+	}
+	if opts.Metrics != nil {
+		opts.Metrics.cache = opts.Tree.Cache
+	}
+	root.control = f.newControlDir(root, opts)
+	return f, nil
 }
 
 func (f *gitviewfs) String() string {
@@ -39,47 +114,72 @@ func (f *gitviewfs) String() string {
 	return "gitviewfs"
 }
 
+// SetDebug lowers the logger's level to debug, or restores its original level.
 func (f *gitviewfs) SetDebug(debug bool) {
 	if debug {
-		f.logger.SetOutput(os.Stderr)
+		f.logger.SetLevel(logging.Debug)
 	} else {
-		f.logger.SetOutput(ioutil.Discard)
+		f.logger.SetLevel(f.level)
+	}
+}
+
+// status reports ferr, returned by op on name, and returns the status to fail the request with.
+func (f *gitviewfs) status(op string, name string, ferr *fserror.Error) fuse.Status {
+	reportError(f.logger, f.metrics, ferr, "op", op, "path", name)
+	return ferr.Status
+}
+
+// reportError logs an error returned by an operation, and counts it if it's unexpected. Expected
+// errors, like looking up files that don't exist, are common, so they're only logged for debugging.
+func reportError(logger *logging.Logger, metrics *Metrics, ferr *fserror.Error, keyvals ...interface{}) {
+	keyvals = append(keyvals, "status", ferr.Status, "kind", ferr.Kind)
+	if ferr.UnexpectedErr == nil {
+		logger.Debug("request failed", keyvals...)
+		return
 	}
+	logger.Error("unexpected error", append(keyvals, "err", ferr.UnexpectedErr)...)
+	metrics.addUnexpectedError()
+}
+
+func (f *gitviewfs) isDebug() bool {
+	return f.logger.Enabled(logging.Debug)
 }
 
 func (f *gitviewfs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	defer f.metrics.observe("GetAttr", time.Now())
 	node, ferr := f.findNode(name)
 	if ferr != nil {
-		if ferr.UnexpectedErr != nil {
-			f.logger.Printf("unexpected error: %s", ferr.UnexpectedErr)
-		}
-		return nil, ferr.Status
+		return nil, f.status("GetAttr", name, ferr)
 	}
 
 	var attr fuse.Attr
 	switch n := node.(type) {
 	case fstree.DirNode:
 		attr.Mode = fuse.S_IFDIR | 0555
+		if _, ok := n.(fstree.WritableDirNode); ok {
+			attr.Mode |= 0200
+		}
 	case fstree.FileNode:
-		file := newFile(n, f.logger)
+		file := newFile(n, f.logger, f.metrics)
 		if status := file.GetAttr(&attr); status != fuse.OK {
 			return nil, status
 		}
 	default:
-		f.logger.Printf("skipping node: %v", node)
+		f.logger.Info("skipping node", "op", "GetAttr", "path", name, "node", node)
 		return nil, fuse.ENOENT
 	}
 
 	return &attr, fuse.OK
 }
 
+// OpenDir lists the directory in name order. go-fuse reads the listing at offsets that are indexes
+// into it, and lists the directory again when it's read from the start, so the order must be the
+// same every time for reads continuing at an offset, or after rewinddir, to see each entry once.
 func (f *gitviewfs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	defer f.metrics.observe("OpenDir", time.Now())
 	node, ferr := f.findNode(name)
 	if ferr != nil {
-		if ferr.UnexpectedErr != nil {
-			f.logger.Printf("unexpected error: %s", ferr.UnexpectedErr)
-		}
-		return nil, ferr.Status
+		return nil, f.status("OpenDir", name, ferr)
 	}
 
 	dirNode, ok := node.(fstree.DirNode)
@@ -87,28 +187,29 @@ func (f *gitviewfs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry
 		return nil, fuse.ENOTDIR
 	}
 
-	children, ferr := dirNode.Children()
-	if ferr != nil {
-		if ferr.UnexpectedErr != nil {
-			f.logger.Printf("unexpected error: %s", ferr.UnexpectedErr)
-		}
-		return nil, ferr.Status
-	}
-
 	var entries []fuse.DirEntry
-	for name, child := range children {
-		entry := fuse.DirEntry{Name: name}
-		switch n := child.(type) {
+	children := fstree.ReadDir(dirNode, "")
+	for {
+		child, ok, ferr := children.Next()
+		if ferr != nil {
+			return nil, f.status("OpenDir", name, ferr)
+		}
+		if !ok {
+			break
+		}
+		entry := fuse.DirEntry{Name: child.Name}
+		switch n := child.Node.(type) {
 		case fstree.DirNode:
 			entry.Mode = fuse.S_IFDIR | 0555
 		case fstree.FileNode:
 			if mode := computeFuseFileMode(n.File().Mode); mode != 0 {
 				entry.Mode = mode
 			} else {
-				f.logger.Printf("skipping file child: %v", node)
+				f.logger.Info("skipping file", "op", "OpenDir", "path", name, "child", entry.Name,
+					"mode", n.File().Mode)
 			}
 		default:
-			f.logger.Printf("skipping child: %v", node)
+			f.logger.Info("skipping node", "op", "OpenDir", "path", name, "child", entry.Name)
 		}
 		entries = append(entries, entry)
 	}
@@ -117,12 +218,10 @@ func (f *gitviewfs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry
 }
 
 func (f *gitviewfs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	defer f.metrics.observe("Open", time.Now())
 	node, ferr := f.findNode(name)
 	if ferr != nil {
-		if ferr.UnexpectedErr != nil {
-			f.logger.Printf("unexpected error: %s", ferr.UnexpectedErr)
-		}
-		return nil, ferr.Status
+		return nil, f.status("Open", name, ferr)
 	}
 
 	fileNode, ok := node.(fstree.FileNode)
@@ -130,40 +229,32 @@ func (f *gitviewfs) Open(name string, flags uint32, context *fuse.Context) (node
 		return nil, fuse.EINVAL
 	}
 
-	return newFile(fileNode, f.logger), fuse.OK
+	return newFile(fileNode, f.logger, f.metrics), fuse.OK
 }
 
 func (f *gitviewfs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	defer f.metrics.observe("Readlink", time.Now())
 	node, ferr := f.findNode(name)
 	if ferr != nil {
-		if ferr.UnexpectedErr != nil {
-			f.logger.Printf("unexpected error: %s", ferr.UnexpectedErr)
-		}
-		return "", ferr.Status
+		return "", f.status("Readlink", name, ferr)
 	}
 
 	fileNode, ok := node.(fstree.FileNode)
 	if !ok {
-		f.logger.Printf("expected file node at: %s", name)
+		f.logger.Debug("not a file", "op", "Readlink", "path", name)
 		return "", fuse.EINVAL
 	}
 
 	if fileNode.File().Mode != filemode.Symlink {
-		f.logger.Printf("expected symlink at: %s", name)
+		f.logger.Debug("not a symlink", "op", "Readlink", "path", name)
 		return "", fuse.EINVAL
 	}
 
-	reader, err := fileNode.File().Reader()
-	if err != nil {
-		f.logger.Printf("error creating file reader: %s", err)
-		return "", fuse.EIO
-	}
+	reader := fstree.NewFileReader(fileNode.File())
 	defer reader.Close()
-
 	bytes, err := ioutil.ReadAll(reader)
 	if err != nil {
-		f.logger.Printf("error reading file: %s", err)
-		return "", fuse.EIO
+		return "", f.status("Readlink", name, fserror.Unexpected(errors.Wrap(err, "read symlink failed")))
 	}
 
 	return string(bytes), fuse.OK
@@ -191,16 +282,11 @@ func (f *gitviewfs) findNode(name string) (fstree.Node, *fserror.Error) {
 	}
 	for _, part := range strings.Split(name, "/") {
 		if dirNode, ok := node.(fstree.DirNode); ok {
-			children, ferr := dirNode.Children()
+			child, ferr := fstree.Child(dirNode, part)
 			if ferr != nil {
 				return nil, ferr
 			}
-
-			if child, ok := children[part]; !ok {
-				return nil, fserror.Expected(fuse.ENOENT)
-			} else {
-				node = child
-			}
+			node = child
 		} else {
 			return nil, fserror.Expected(fuse.ENOENT)
 		}
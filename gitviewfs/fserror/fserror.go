@@ -1,27 +1,147 @@
 package fserror
 
 import (
+	"compress/zlib"
 	"fmt"
 	"github.com/hanwen/go-fuse/fuse"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"syscall"
 )
 
+// Kind classifies errors, for logging and matching with errors.Is.
+type Kind int
+
+const (
+	// Other is an expected error without a more specific kind, like EEXIST.
+	Other Kind = iota
+	NotFound
+	NotDir
+	Permission
+	Unsupported
+	// CorruptObject is an unexpected error reading a repository object that can't be decoded.
+	CorruptObject
+	// MissingObject is an unexpected error finding a repository object that's referenced but not
+	// stored, as in shallow or partial clones.
+	MissingObject
+	// Internal is any other unexpected error.
+	Internal
+)
+
+var kindNames = map[Kind]string{
+	Other:         "other",
+	NotFound:      "not found",
+	NotDir:        "not a directory",
+	Permission:    "permission denied",
+	Unsupported:   "unsupported",
+	CorruptObject: "corrupt object",
+	MissingObject: "missing object",
+	Internal:      "internal",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
 // Error represents either a normal or an unexpected FUSE error.
 type Error struct {
 	Status fuse.Status
+	Kind   Kind
 	// UnexpectedErr should be nil for normal errors (like file not found, etc.).
 	UnexpectedErr error
 }
 
 var _ error = (*Error)(nil)
 
+// Errors of each expected kind, for matching with errors.Is.
+var (
+	ErrNotFound    = Expected(fuse.ENOENT)
+	ErrNotDir      = Expected(fuse.ENOTDIR)
+	ErrPermission  = Expected(fuse.EACCES)
+	ErrUnsupported = Expected(fuse.Status(syscall.EOPNOTSUPP))
+)
+
 func (e *Error) Error() string {
-	return fmt.Sprintf("fuse error: %s: %s", e.Status, e.UnexpectedErr)
+	if e.UnexpectedErr == nil {
+		return fmt.Sprintf("fuse error: %s (%s)", e.Kind, e.Status)
+	}
+	return fmt.Sprintf("fuse error: %s (%s): %s", e.Kind, e.Status, e.UnexpectedErr)
+}
+
+func (e *Error) Unwrap() error {
+	return e.UnexpectedErr
+}
+
+// Is reports whether target is an *Error of the same kind, or the errno e's status is.
+func (e *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case *Error:
+		return t.Kind == e.Kind
+	case syscall.Errno:
+		return fuse.Status(t) == e.Status
+	default:
+		return false
+	}
 }
 
 func Expected(status fuse.Status) *Error {
-	return &Error{status, nil}
+	return &Error{Status: status, Kind: statusKind(status)}
 }
 
+// Unexpected returns an error for err, which is reported. Missing objects fail with ENODATA, and
+// other errors with EIO.
 func Unexpected(err error) *Error {
-	return &Error{fuse.EIO, err}
+	kind := unexpectedKind(err)
+	status := fuse.EIO
+	if kind == MissingObject {
+		status = fuse.Status(syscall.ENODATA)
+	}
+	return &Error{Status: status, Kind: kind, UnexpectedErr: err}
+}
+
+func statusKind(status fuse.Status) Kind {
+	switch status {
+	case fuse.ENOENT:
+		return NotFound
+	case fuse.ENOTDIR:
+		return NotDir
+	case fuse.EACCES, fuse.EPERM, fuse.EROFS:
+		return Permission
+	case fuse.ENOSYS, fuse.Status(syscall.EOPNOTSUPP):
+		return Unsupported
+	default:
+		return Other
+	}
+}
+
+// unexpectedKind classifies err by its innermost cause.
+func unexpectedKind(err error) Kind {
+	switch cause(err) {
+	case plumbing.ErrObjectNotFound:
+		return MissingObject
+	case zlib.ErrChecksum, zlib.ErrDictionary, zlib.ErrHeader, io.ErrUnexpectedEOF,
+		plumbing.ErrInvalidType, object.ErrUnsupportedObject:
+		return CorruptObject
+	default:
+		return Internal
+	}
+}
+
+// cause unwraps err through both github.com/pkg/errors wrappers and Unwrap methods.
+func cause(err error) error {
+	for err != nil {
+		switch wrapper := err.(type) {
+		case interface{ Cause() error }:
+			err = wrapper.Cause()
+		case interface{ Unwrap() error }:
+			err = wrapper.Unwrap()
+		default:
+			return err
+		}
+	}
+	return nil
 }
@@ -2,7 +2,10 @@ package fstree
 
 import (
 	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"sort"
 )
 
 type Node interface{}
@@ -12,7 +15,150 @@ type DirNode interface {
 	Children() (map[string]Node, *fserror.Error)
 }
 
+// LookupDirNode is a directory whose children can be looked up by name without listing them all,
+// like a large tree, or searches named by their query, which aren't listed at all.
+type LookupDirNode interface {
+	DirNode
+	// Lookup returns the child called name, or fserror.ErrNotFound.
+	Lookup(name string) (Node, *fserror.Error)
+}
+
+// Child returns the child of dir called name, or fserror.ErrNotFound.
+func Child(dir DirNode, name string) (Node, *fserror.Error) {
+	if lookupDir, ok := dir.(LookupDirNode); ok {
+		return lookupDir.Lookup(name)
+	}
+	children, ferr := dir.Children()
+	if ferr != nil {
+		return nil, ferr
+	}
+	child, ok := children[name]
+	if !ok {
+		return nil, fserror.ErrNotFound
+	}
+	return child, nil
+}
+
+// DirEntry is a child of a directory, as listed by ReadDir.
+type DirEntry struct {
+	Name string
+	Node Node
+}
+
+// DirIterator lists a directory's children in name order.
+type DirIterator interface {
+	// Next returns the next child. ok is false once every child has been returned.
+	Next() (entry DirEntry, ok bool, ferr *fserror.Error)
+}
+
+// ReadDirNode is a directory that lists its children one at a time, so that reading part of a large
+// directory doesn't make a node for each of its children.
+type ReadDirNode interface {
+	DirNode
+	// ReadDir returns the children whose names sort after after, in name order. after is "" to list
+	// every child.
+	ReadDir(after string) DirIterator
+}
+
+// ReadDir lists the children of dir whose names sort after after, in name order. Directories that
+// aren't ReadDirNodes are listed with Children.
+func ReadDir(dir DirNode, after string) DirIterator {
+	if readDir, ok := dir.(ReadDirNode); ok {
+		return readDir.ReadDir(after)
+	}
+	return &childrenIterator{dir: dir, after: after}
+}
+
+// childrenIterator lists the children of a directory that can only list them all at once.
+type childrenIterator struct {
+	dir   DirNode
+	after string
+
+	loaded   bool
+	children map[string]Node
+	// names holds the names of the children not returned yet, in order.
+	names []string
+}
+
+func (it *childrenIterator) Next() (DirEntry, bool, *fserror.Error) {
+	if !it.loaded {
+		children, ferr := it.dir.Children()
+		if ferr != nil {
+			return DirEntry{}, false, ferr
+		}
+		for name := range children {
+			if name > it.after {
+				it.names = append(it.names, name)
+			}
+		}
+		sort.Strings(it.names)
+		it.children = children
+		it.loaded = true
+	}
+	if len(it.names) == 0 {
+		return DirEntry{}, false, nil
+	}
+	name := it.names[0]
+	it.names = it.names[1:]
+	return DirEntry{Name: name, Node: it.children[name]}, true, nil
+}
+
 type FileNode interface {
 	Node
 	File() *object.File
 }
+
+// NewBlobFile returns a file whose contents are read from blob, which needn't be stored in the
+// repository. blob's type must be plumbing.BlobObject.
+func NewBlobFile(name string, mode filemode.FileMode, blob plumbing.EncodedObject) *object.File {
+	b := &object.Blob{}
+	// Decoding a blob only records the object, so its only error is for other types.
+	b.Decode(blob)
+	return object.NewFile(name, mode, b)
+}
+
+// CommitDirNode is a directory showing a commit's tree.
+type CommitDirNode interface {
+	DirNode
+	Commit() *object.Commit
+}
+
+// TreeDirNode is a directory showing a tree from the repository.
+type TreeDirNode interface {
+	DirNode
+	Tree() *object.Tree
+}
+
+// WritableDirNode is a directory whose children can be added, removed and renamed.
+type WritableDirNode interface {
+	DirNode
+	// CreateFile adds an empty file. mode is filemode.Regular or filemode.Executable.
+	CreateFile(name string, mode filemode.FileMode) (WritableFileNode, *fserror.Error)
+	CreateSymlink(name string, target string) *fserror.Error
+	Mkdir(name string) *fserror.Error
+	// Remove removes a file or an empty directory.
+	Remove(name string) *fserror.Error
+	// Rename moves a child to newDir, which must be part of the same writable tree.
+	Rename(oldName string, newDir WritableDirNode, newName string) *fserror.Error
+}
+
+// WritableFileNode is a file whose contents and mode can be changed.
+type WritableFileNode interface {
+	FileNode
+	WriteAt(data []byte, off int64) (int, *fserror.Error)
+	Truncate(size int64) *fserror.Error
+	// SetMode changes the file's mode to filemode.Regular or filemode.Executable.
+	SetMode(mode filemode.FileMode) *fserror.Error
+}
+
+// Syncer is a node with pending changes that can be saved.
+type Syncer interface {
+	Node
+	Sync() *fserror.Error
+}
+
+// Refresher is a node whose contents are a snapshot that can be reloaded.
+type Refresher interface {
+	Node
+	Refresh() *fserror.Error
+}
@@ -0,0 +1,38 @@
+package fstree_test
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree/fstreetest"
+	"reflect"
+	"testing"
+)
+
+func TestReadDirResume(t *testing.T) {
+	dir := fstreetest.Dir{"b": fstreetest.Dir{}, "a.txt": fstreetest.Dir{}, "a": fstreetest.Dir{}, "a0": fstreetest.Dir{}, "-": fstreetest.Dir{}}
+	names := []string{"-", "a", "a.txt", "a0", "b"}
+	readNames := func(after string) []string {
+		got := []string{}
+		children := fstree.ReadDir(dir, after)
+		for {
+			entry, ok, ferr := children.Next()
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			if !ok {
+				return got
+			}
+			got = append(got, entry.Name)
+		}
+	}
+
+	if got := readNames(""); !reflect.DeepEqual(got, names) {
+		t.Fatalf("got %q, want %q", got, names)
+	}
+	for i, name := range names {
+		for _, after := range []string{name, name + "\x00"} {
+			if got := readNames(after); !reflect.DeepEqual(got, names[i+1:]) {
+				t.Errorf("after %q: got %q, want %q", after, got, names[i+1:])
+			}
+		}
+	}
+}
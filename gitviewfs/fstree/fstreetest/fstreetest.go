@@ -0,0 +1,36 @@
+// Package fstreetest provides trees for testing code that serves or reads fstrees.
+package fstreetest
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Dir is a directory with fixed children. It can only list them all at once, so it also tests the
+// fallbacks for directories without fstree.LookupDirNode or fstree.ReadDirNode.
+type Dir map[string]fstree.Node
+
+func (d Dir) Children() (map[string]fstree.Node, *fserror.Error) {
+	return d, nil
+}
+
+// File is a file with fixed contents.
+type File struct {
+	file *object.File
+}
+
+func (f *File) File() *object.File {
+	return f.file
+}
+
+// NewFile returns a file called name with contents, which are a symlink's target for
+// filemode.Symlink.
+func NewFile(name string, mode filemode.FileMode, contents string) *File {
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.BlobObject)
+	obj.Write([]byte(contents))
+	return &File{fstree.NewBlobFile(name, mode, obj)}
+}
@@ -0,0 +1,36 @@
+package fstree
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+)
+
+// FileID returns a number identifying the node at path, derived from object hashes, for protocols
+// that need inode numbers. A file's mixes its blob hash with its mode, so identical files share one
+// but a script and a symlink to the same text don't. A directory's mixes its tree or commit hash
+// with its path, since directories can't be hard links, and other directories' are hashes of their
+// paths. Each kind of node is hashed with a different prefix so they can't collide.
+func FileID(node Node, path []string) uint64 {
+	h := fnv.New64a()
+	var mode [4]byte
+	switch n := node.(type) {
+	case FileNode:
+		file := n.File()
+		binary.BigEndian.PutUint32(mode[:], uint32(file.Mode))
+		h.Write([]byte{'f'})
+		h.Write(mode[:])
+		h.Write(file.Hash[:])
+		return h.Sum64()
+	case CommitDirNode:
+		h.Write([]byte{'c'})
+		h.Write(n.Commit().Hash[:])
+	case TreeDirNode:
+		h.Write([]byte{'t'})
+		h.Write(n.Tree().Hash[:])
+	default:
+		h.Write([]byte{'d'})
+	}
+	h.Write([]byte(strings.Join(path, "/")))
+	return h.Sum64()
+}
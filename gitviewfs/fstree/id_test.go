@@ -0,0 +1,71 @@
+package fstree_test
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree/fstreetest"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"testing"
+)
+
+func TestFileID(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       fstree.Node
+		aPath      []string
+		bPath      []string
+		wantShared bool
+	}{
+		{
+			name:       "identical files",
+			a:          fstreetest.NewFile("a", filemode.Regular, "text"),
+			b:          fstreetest.NewFile("b", filemode.Regular, "text"),
+			aPath:      []string{"x", "a"},
+			bPath:      []string{"y", "b"},
+			wantShared: true,
+		},
+		{
+			name:  "different contents",
+			a:     fstreetest.NewFile("a", filemode.Regular, "text"),
+			b:     fstreetest.NewFile("a", filemode.Regular, "other"),
+			aPath: []string{"a"},
+			bPath: []string{"a"},
+		},
+		{
+			name:  "regular and executable",
+			a:     fstreetest.NewFile("a", filemode.Regular, "text"),
+			b:     fstreetest.NewFile("a", filemode.Executable, "text"),
+			aPath: []string{"a"},
+			bPath: []string{"a"},
+		},
+		{
+			name:  "file and symlink",
+			a:     fstreetest.NewFile("a", filemode.Regular, "target"),
+			b:     fstreetest.NewFile("a", filemode.Symlink, "target"),
+			aPath: []string{"a"},
+			bPath: []string{"a"},
+		},
+		{
+			name:  "directories at different paths",
+			a:     fstreetest.Dir{},
+			b:     fstreetest.Dir{},
+			aPath: []string{"a"},
+			bPath: []string{"b"},
+		},
+		{
+			name:       "directory at the same path",
+			a:          fstreetest.Dir{},
+			b:          fstreetest.Dir{},
+			aPath:      []string{"a", "b"},
+			bPath:      []string{"a", "b"},
+			wantShared: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := fstree.FileID(test.a, test.aPath), fstree.FileID(test.b, test.bPath)
+			if shared := a == b; shared != test.wantShared {
+				t.Errorf("got IDs %#x and %#x, want shared %v", a, b, test.wantShared)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package fstree
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"io/ioutil"
+)
+
+// FileReader reads a file's contents, seeking by reopening and skipping forward when needed. Blobs
+// are usually compressed, so they can't be read from an offset directly. Seeking is free until the
+// next read, so finding the size by seeking to the end doesn't read the file.
+type FileReader struct {
+	file   *object.File
+	offset int64
+	// reader is the open contents, if any, positioned at readerOffset.
+	reader       io.ReadCloser
+	readerOffset int64
+}
+
+var _ io.ReadSeeker = (*FileReader)(nil)
+
+func NewFileReader(file *object.File) *FileReader {
+	return &FileReader{file: file}
+}
+
+func (b *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.file.Size
+	default:
+		return 0, errors.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Errorf("negative offset: %d", offset)
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *FileReader) Read(p []byte) (int, error) {
+	if b.reader != nil && b.readerOffset > b.offset {
+		b.reader.Close()
+		b.reader = nil
+	}
+	if b.reader == nil {
+		reader, err := b.file.Reader()
+		if err != nil {
+			return 0, errors.Wrapf(err, "open file %s failed", b.file.Hash)
+		}
+		b.reader = reader
+		b.readerOffset = 0
+	}
+	if b.readerOffset < b.offset {
+		skipped, err := io.CopyN(ioutil.Discard, b.reader, b.offset-b.readerOffset)
+		b.readerOffset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := b.reader.Read(p)
+	b.offset += int64(n)
+	b.readerOffset += int64(n)
+	return n, err
+}
+
+func (b *FileReader) Close() error {
+	if b.reader == nil {
+		return nil
+	}
+	err := b.reader.Close()
+	b.reader = nil
+	return err
+}
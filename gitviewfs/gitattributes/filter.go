@@ -0,0 +1,195 @@
+package gitattributes
+
+import (
+	"bytes"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter is the conversion attributes ask for when a file is checked out or archived. The zero
+// Filter leaves contents alone.
+type Filter struct {
+	// CRLF converts LF line endings to CRLF, for text files with eol=crlf. Other text files keep
+	// the LF endings they're stored with.
+	CRLF bool
+	// AutoText, with CRLF, only converts files that look like text, for text=auto.
+	AutoText bool
+	// Ident expands $Id$ to the file's blob hash.
+	Ident bool
+	// ExportSubst expands $Format:...$ placeholders with the commit's details.
+	ExportSubst bool
+}
+
+// Filter returns the filter for the file at filePath, given as path parts from the root.
+func (s Stack) Filter(filePath []string) Filter {
+	var f Filter
+	text, eol := s.Get(filePath, false, "text"), s.Get(filePath, false, "eol")
+	if eol.String() == "crlf" && !text.IsUnset() {
+		f.CRLF = true
+		f.AutoText = text.String() == "auto"
+	}
+	f.Ident = s.Get(filePath, false, "ident").IsSet()
+	f.ExportSubst = s.Get(filePath, false, "export-subst").IsSet()
+	return f
+}
+
+// Apply converts data, the contents of the blob hash, in the order git does: export-subst, then
+// ident, then line endings. commit is only needed for ExportSubst.
+func (f Filter) Apply(data []byte, hash plumbing.Hash, commit *object.Commit) []byte {
+	if f.ExportSubst && commit != nil {
+		data = formatPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+			format := match[len("$Format:") : len(match)-1]
+			return []byte(FormatCommit(string(format), commit))
+		})
+	}
+	if f.Ident {
+		data = identPattern.ReplaceAllLiteral(data, []byte("$Id: "+hash.String()+" $"))
+	}
+	if f.CRLF && !(f.AutoText && !isAutoText(data)) {
+		data = toCRLF(data)
+	}
+	return data
+}
+
+var (
+	formatPattern = regexp.MustCompile(`\$Format:[^$]*\$`)
+	// identPattern matches $Id$ and previously expanded $Id: ... $ on one line.
+	identPattern = regexp.MustCompile(`\$Id(:[^$\n]*)?\$`)
+)
+
+// binaryCheckSize is how much of a file git checks for NUL bytes to decide if it's binary.
+const binaryCheckSize = 8000
+
+// isAutoText reports whether text=auto converts data: it must look like text, and have no CR
+// characters, which converting wouldn't preserve.
+func isAutoText(data []byte) bool {
+	head := data
+	if len(head) > binaryCheckSize {
+		head = head[:binaryCheckSize]
+	}
+	return bytes.IndexByte(head, 0) < 0 && bytes.IndexByte(data, '\r') < 0
+}
+
+// toCRLF converts LFs not already preceded by CRs to CRLFs.
+func toCRLF(data []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data) + bytes.Count(data, []byte("\n")))
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(b)
+	}
+	return out.Bytes()
+}
+
+// FormatCommit expands the placeholders of a git log --pretty=format string, like %H and %an,
+// for commit. Placeholders it doesn't know are left as they are.
+func FormatCommit(format string, commit *object.Commit) string {
+	var out bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			out.WriteByte(format[i])
+			continue
+		}
+		expansion, n := formatPlaceholder(format[i+1:], commit)
+		if n == 0 {
+			out.WriteByte('%')
+			continue
+		}
+		out.WriteString(expansion)
+		i += n
+	}
+	return out.String()
+}
+
+// abbrevLength is the length of abbreviated hashes.
+const abbrevLength = 7
+
+// formatPlaceholder expands the placeholder at the start of s, after its %, and returns its length,
+// or 0 if it isn't known.
+func formatPlaceholder(s string, commit *object.Commit) (string, int) {
+	switch s[0] {
+	case '%':
+		return "%", 1
+	case 'n':
+		return "\n", 1
+	case 'H':
+		return commit.Hash.String(), 1
+	case 'h':
+		return commit.Hash.String()[:abbrevLength], 1
+	case 'T':
+		return commit.TreeHash.String(), 1
+	case 't':
+		return commit.TreeHash.String()[:abbrevLength], 1
+	case 'P', 'p':
+		parents := make([]string, len(commit.ParentHashes))
+		for i, hash := range commit.ParentHashes {
+			parents[i] = hash.String()
+			if s[0] == 'p' {
+				parents[i] = parents[i][:abbrevLength]
+			}
+		}
+		return strings.Join(parents, " "), 1
+	case 's':
+		subject, _ := splitMessage(commit.Message)
+		return subject, 1
+	case 'b':
+		_, body := splitMessage(commit.Message)
+		return body, 1
+	case 'B':
+		return commit.Message, 1
+	case 'a', 'c':
+		if len(s) < 2 {
+			return "", 0
+		}
+		signature := commit.Author
+		if s[0] == 'c' {
+			signature = commit.Committer
+		}
+		if expansion, ok := formatSignature(s[1], signature); ok {
+			return expansion, 2
+		}
+	}
+	return "", 0
+}
+
+// formatSignature expands the part of an author or committer placeholder after its a or c.
+func formatSignature(c byte, signature object.Signature) (string, bool) {
+	when := signature.When
+	switch c {
+	case 'n':
+		return signature.Name, true
+	case 'e':
+		return signature.Email, true
+	case 'd':
+		return when.Format("Mon Jan 2 15:04:05 2006 -0700"), true
+	case 'D':
+		return when.Format("Mon, 2 Jan 2006 15:04:05 -0700"), true
+	case 'i':
+		return when.Format("2006-01-02 15:04:05 -0700"), true
+	case 'I':
+		return when.Format("2006-01-02T15:04:05-07:00"), true
+	case 't':
+		return strconv.FormatInt(when.Unix(), 10), true
+	}
+	return "", false
+}
+
+// splitMessage splits a commit message into its subject, the first paragraph joined into one line,
+// and its body, the rest.
+func splitMessage(message string) (string, string) {
+	message = strings.TrimLeft(message, "\n")
+	subject, body := message, ""
+	if i := strings.Index(message, "\n\n"); i >= 0 {
+		subject, body = message[:i], strings.TrimLeft(message[i:], "\n")
+	}
+	lines := strings.Split(subject, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.Join(lines, " "), body
+}
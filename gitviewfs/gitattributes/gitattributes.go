@@ -0,0 +1,285 @@
+// Package gitattributes reads .gitattributes files and finds the attributes they give paths, as
+// described in gitattributes(5).
+//
+// Macros are expanded when they're set: the built-in binary macro, and those defined with [attr] in
+// the same file.
+package gitattributes
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// FileName is the name of attributes files.
+const FileName = ".gitattributes"
+
+type state int
+
+const (
+	unspecified state = iota
+	set
+	unset
+	valued
+)
+
+// Value is the state of an attribute for a path: set, unset, set to a string, or unspecified.
+type Value struct {
+	state state
+	value string
+}
+
+var (
+	Unspecified = Value{}
+	Set         = Value{state: set}
+	Unset       = Value{state: unset}
+)
+
+// StringValue returns the value of an attribute set to s, as by "name=s".
+func StringValue(s string) Value {
+	return Value{state: valued, value: s}
+}
+
+func (v Value) IsSet() bool {
+	return v.state == set
+}
+
+func (v Value) IsUnset() bool {
+	return v.state == unset
+}
+
+func (v Value) IsSpecified() bool {
+	return v.state != unspecified
+}
+
+// String returns the string an attribute is set to, or "" if it isn't set to one.
+func (v Value) String() string {
+	return v.value
+}
+
+// builtinMacros are the macros git defines.
+var builtinMacros = map[string][]assignment{
+	"binary": {{"diff", Unset}, {"merge", Unset}, {"text", Unset}},
+}
+
+// File is a parsed attributes file.
+type File struct {
+	// dir is the directory the file is in, whose paths its patterns match.
+	dir   []string
+	rules []rule
+}
+
+type rule struct {
+	pattern pattern
+	attrs   []assignment
+}
+
+type assignment struct {
+	name  string
+	value Value
+}
+
+// Parse parses an attributes file in dir, given as path parts from the root. Invalid lines are
+// skipped, like git does.
+func Parse(dir []string, data []byte) *File {
+	f := &File{dir: dir}
+	macros := map[string][]assignment{}
+	for name, attrs := range builtinMacros {
+		macros[name] = attrs
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rawPattern, rest, ok := splitPattern(line)
+		if !ok {
+			continue
+		}
+		attrs := parseAssignments(rest, macros)
+
+		if strings.HasPrefix(rawPattern, "[attr]") {
+			macros[strings.TrimPrefix(rawPattern, "[attr]")] = attrs
+			continue
+		}
+		// Negative patterns aren't allowed.
+		if strings.HasPrefix(rawPattern, "!") {
+			continue
+		}
+		f.rules = append(f.rules, rule{pattern: parsePattern(rawPattern), attrs: attrs})
+	}
+	return f
+}
+
+// Read parses the attributes file among the children of dir, given as path parts from the root. It
+// returns nil if there's none.
+func Read(dir []string, children map[string]fstree.Node) (*File, error) {
+	fileNode, ok := children[FileName].(fstree.FileNode)
+	if !ok {
+		return nil, nil
+	}
+	name := path.Join(path.Join(dir...), FileName)
+	reader, err := fileNode.File().Reader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s failed", name)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s failed", name)
+	}
+	return Parse(dir, data), nil
+}
+
+// splitPattern splits a line into its pattern, which may be quoted, and the rest.
+func splitPattern(line string) (string, string, bool) {
+	if strings.HasPrefix(line, `"`) {
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return "", "", false
+		}
+		pattern, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return pattern, line[end+1:], true
+	}
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], line[i:], true
+	}
+	return line, "", true
+}
+
+func parseAssignments(s string, macros map[string][]assignment) []assignment {
+	var attrs []assignment
+	for _, field := range strings.Fields(s) {
+		var a assignment
+		switch {
+		case strings.HasPrefix(field, "-"):
+			a = assignment{strings.TrimPrefix(field, "-"), Unset}
+		case strings.HasPrefix(field, "!"):
+			a = assignment{strings.TrimPrefix(field, "!"), Unspecified}
+		case strings.Contains(field, "="):
+			i := strings.Index(field, "=")
+			a = assignment{field[:i], StringValue(field[i+1:])}
+		default:
+			a = assignment{field, Set}
+		}
+		if a.name == "" {
+			continue
+		}
+		attrs = append(attrs, a)
+		if expansion, ok := macros[a.name]; ok && a.value.IsSet() {
+			attrs = append(attrs, expansion...)
+		}
+	}
+	return attrs
+}
+
+// pattern is a gitignore-style pattern. Patterns without a slash match names in any directory, and
+// others match paths relative to the attributes file's directory, where ** matches any number of
+// directories, except that a trailing /** only matches what's inside a directory.
+type pattern struct {
+	parts    []string
+	basename bool
+	dirOnly  bool
+}
+
+func parsePattern(s string) pattern {
+	var p pattern
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimSuffix(s, "/")
+	}
+	if !strings.Contains(s, "/") {
+		p.basename = true
+		p.parts = []string{s}
+		return p
+	}
+	p.parts = strings.Split(strings.TrimPrefix(s, "/"), "/")
+	return p
+}
+
+func (p pattern) match(relPath []string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.basename {
+		ok, _ := path.Match(p.parts[0], relPath[len(relPath)-1])
+		return ok
+	}
+	return matchParts(p.parts, relPath)
+}
+
+func matchParts(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchParts(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchParts(pattern[1:], name[1:])
+}
+
+// Stack is the attributes files that apply in a directory, from the root down. Files deeper in the
+// tree take precedence.
+type Stack []*File
+
+// Get returns the value of the attribute name for the file or directory at filePath, given as path
+// parts from the root.
+func (s Stack) Get(filePath []string, isDir bool, name string) Value {
+	for i := len(s) - 1; i >= 0; i-- {
+		f := s[i]
+		if len(filePath) <= len(f.dir) || !hasPrefix(filePath, f.dir) {
+			continue
+		}
+		relPath := filePath[len(f.dir):]
+		// Later lines take precedence.
+		for j := len(f.rules) - 1; j >= 0; j-- {
+			r := f.rules[j]
+			if !r.pattern.match(relPath, isDir) {
+				continue
+			}
+			for k := len(r.attrs) - 1; k >= 0; k-- {
+				if r.attrs[k].name == name {
+					return r.attrs[k].value
+				}
+			}
+		}
+	}
+	return Unspecified
+}
+
+func hasPrefix(parts []string, prefix []string) bool {
+	for i := range prefix {
+		if parts[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
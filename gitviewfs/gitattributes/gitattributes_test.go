@@ -0,0 +1,134 @@
+package gitattributes
+
+import (
+	"strings"
+	"testing"
+)
+
+// testStack is a root attributes file and one in sub/.
+var testStack = Stack{
+	Parse(nil, []byte(`
+# Comments and blank lines are skipped.
+
+*.txt   text eol=crlf
+*.bin   binary
+*.gen   binary text
+/top.txt -text
+docs/** export-ignore
+build/  export-ignore
+*.log   export-ignore
+keep.log !export-ignore
+a/**/z  marked
+**/deep marked=deep
+!*.txt  -text
+"with space.txt" -text
+[attr]generated linguist-generated -diff
+*.pb.go generated
+*.c     ident
+*.c     -ident
+`)),
+	Parse([]string{"sub"}, []byte(`
+*.txt  eol=lf
+*.log  -export-ignore
+`)),
+}
+
+func TestStackGet(t *testing.T) {
+	tests := []struct {
+		path  string
+		isDir bool
+		attr  string
+		want  Value
+	}{
+		{path: "a.txt", attr: "text", want: Set},
+		{path: "dir/a.txt", attr: "eol", want: StringValue("crlf")},
+		{path: "a.go", attr: "text", want: Unspecified},
+		{path: "a.txtx", attr: "text", want: Unspecified},
+
+		// Macros expand where they're set, and later attributes on the line take precedence.
+		{path: "a.bin", attr: "text", want: Unset},
+		{path: "a.bin", attr: "diff", want: Unset},
+		{path: "a.gen", attr: "text", want: Set},
+		{path: "a.pb.go", attr: "diff", want: Unset},
+		{path: "a.pb.go", attr: "linguist-generated", want: Set},
+
+		// Patterns with a leading slash only match in the file's directory.
+		{path: "top.txt", attr: "text", want: Unset},
+		{path: "dir/top.txt", attr: "text", want: Set},
+
+		// A trailing /** matches what's inside, but not the directory itself.
+		{path: "docs", isDir: true, attr: "export-ignore", want: Unspecified},
+		{path: "docs/a.md", attr: "export-ignore", want: Set},
+		{path: "docs/x/y.md", attr: "export-ignore", want: Set},
+		{path: "dir/docs/a.md", attr: "export-ignore", want: Unspecified},
+
+		// Directory patterns only match directories, in any directory.
+		{path: "build", isDir: true, attr: "export-ignore", want: Set},
+		{path: "dir/build", isDir: true, attr: "export-ignore", want: Set},
+		{path: "build", attr: "export-ignore", want: Unspecified},
+
+		// ** in the middle matches any number of directories, and at the start any directory.
+		{path: "a/z", attr: "marked", want: Set},
+		{path: "a/b/c/z", attr: "marked", want: Set},
+		{path: "b/a/z", attr: "marked", want: Unspecified},
+		{path: "deep", attr: "marked", want: StringValue("deep")},
+		{path: "x/y/deep", attr: "marked", want: StringValue("deep")},
+
+		// !attr makes an attribute unspecified, overriding earlier lines, and negative patterns
+		// are skipped.
+		{path: "a.log", attr: "export-ignore", want: Set},
+		{path: "keep.log", attr: "export-ignore", want: Unspecified},
+		{path: "b.txt", attr: "text", want: Set},
+
+		{path: "with space.txt", attr: "text", want: Unset},
+
+		// Later lines take precedence over earlier ones.
+		{path: "a.c", attr: "ident", want: Unset},
+
+		// Deeper files take precedence, and attributes they don't give come from above.
+		{path: "sub/a.txt", attr: "eol", want: StringValue("lf")},
+		{path: "sub/a.txt", attr: "text", want: Set},
+		{path: "sub/a.log", attr: "export-ignore", want: Unset},
+		{path: "other/a.log", attr: "export-ignore", want: Set},
+		{path: "sub", isDir: true, attr: "eol", want: Unspecified},
+	}
+	for _, test := range tests {
+		t.Run(test.path+" "+test.attr, func(t *testing.T) {
+			if got := testStack.Get(strings.Split(test.path, "/"), test.isDir, test.attr); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalidLines(t *testing.T) {
+	f := Parse(nil, []byte("\"unterminated -text\n\"bad\\q\" -text\n= -text\nok -text\n"))
+	var patterns []string
+	for _, r := range f.rules {
+		patterns = append(patterns, strings.Join(r.pattern.parts, "/"))
+	}
+	if want := []string{"=", "ok"}; strings.Join(patterns, " ") != strings.Join(want, " ") {
+		t.Errorf("got patterns %q, want %q", patterns, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	stack := Stack{Parse(nil, []byte("*.txt eol=crlf\n*.auto text=auto eol=crlf\n*.bin -text eol=crlf\n*.c ident export-subst\n"))}
+	tests := []struct {
+		path string
+		want Filter
+	}{
+		{path: "a.txt", want: Filter{CRLF: true}},
+		{path: "a.auto", want: Filter{CRLF: true, AutoText: true}},
+		{path: "a.bin", want: Filter{}},
+		{path: "a.c", want: Filter{Ident: true, ExportSubst: true}},
+		{path: "a.go", want: Filter{}},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if got := stack.Filter(strings.Split(test.path, "/")); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package gitfstree
+
+import (
+	"container/list"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"sync"
+)
+
+// DefaultCacheSize is the number of directories held by the cache NewWithOptions makes when
+// Options.Cache is nil.
+const DefaultCacheSize = 4096
+
+// Cache holds recently read git trees and the children of recently listed ones, keyed by tree hash.
+// Trees never change, so entries never go stale, and one Cache can be shared by several
+// repositories. A nil *Cache caches nothing.
+type Cache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[plumbing.Hash]*list.Element
+	// lru orders entries from most to least recently used.
+	lru    *list.List
+	hits   uint64
+	misses uint64
+}
+
+// CacheStats describes a cache's use.
+type CacheStats struct {
+	// Size is the number of directories the cache can hold.
+	Size    int
+	Entries int
+	// Hits and Misses count listings and lookups of trees' children.
+	Hits   uint64
+	Misses uint64
+}
+
+type cacheEntry struct {
+	hash plumbing.Hash
+	// tree is the decoded tree, if it's been read, and children its children, if it's been listed.
+	tree     *object.Tree
+	children map[string]fstree.Node
+}
+
+// NewCache returns a cache holding up to size directories.
+func NewCache(size int) *Cache {
+	return &Cache{size: size, entries: map[plumbing.Hash]*list.Element{}, lru: list.New()}
+}
+
+// get returns a copy of the cached children of a tree, which the caller may change.
+func (c *Cache) get(hash plumbing.Hash) (map[string]fstree.Node, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok || elem.Value.(*cacheEntry).children == nil {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+
+	cached := elem.Value.(*cacheEntry).children
+	children := make(map[string]fstree.Node, len(cached))
+	for name, child := range cached {
+		children[name] = child
+	}
+	return children, true
+}
+
+// child returns the cached child of a tree called name, without copying the tree's children.
+// cached is false if the tree's children aren't cached; otherwise child is nil if the tree has no
+// child called name.
+func (c *Cache) child(hash plumbing.Hash, name string) (child fstree.Node, cached bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok || elem.Value.(*cacheEntry).children == nil {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).children[name], true
+}
+
+// tree returns the cached decoded tree, without counting toward Stats.
+func (c *Cache) tree(hash plumbing.Hash) (*object.Tree, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok || elem.Value.(*cacheEntry).tree == nil {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).tree, true
+}
+
+// putTree caches a decoded tree, so that looking paths up through a large tree doesn't decode it
+// each time.
+func (c *Cache) putTree(tree *object.Tree) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entry(tree.Hash).tree = tree
+}
+
+// put caches a copy of the children of a tree.
+func (c *Cache) put(hash plumbing.Hash, children map[string]fstree.Node) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	cached := make(map[string]fstree.Node, len(children))
+	for name, child := range children {
+		cached[name] = child
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entry(hash).children = cached
+}
+
+// entry returns the most recently used entry for hash, adding it if the tree isn't cached. c.mu
+// must be held.
+func (c *Cache) entry(hash plumbing.Hash) *cacheEntry {
+	if elem, ok := c.entries[hash]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry)
+	}
+	entry := &cacheEntry{hash: hash}
+	c.entries[hash] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).hash)
+	}
+	return entry
+}
+
+// Drop empties the cache.
+func (c *Cache) Drop() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[plumbing.Hash]*list.Element{}
+	c.lru.Init()
+}
+
+// Stats returns the cache's size and use since it was made. Drop doesn't reset the counts.
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Size: c.size, Entries: c.lru.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+// maxLookups is the number of nodes a lookupCache holds.
+const maxLookups = 64
+
+// lookupCache holds recently looked up nodes that are slow to make, like the results of searches,
+// since every request for a path below them looks them up again. Keys must be comparable. It's
+// emptied when it's full.
+type lookupCache struct {
+	mu    sync.Mutex
+	nodes map[interface{}]fstree.Node
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{nodes: map[interface{}]fstree.Node{}}
+}
+
+func (c *lookupCache) get(key interface{}) (fstree.Node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node, ok := c.nodes[key]
+	return node, ok
+}
+
+func (c *lookupCache) put(key interface{}, node fstree.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.nodes) >= maxLookups {
+		c.nodes = map[interface{}]fstree.Node{}
+	}
+	c.nodes[key] = node
+}
@@ -0,0 +1,148 @@
+package gitfstree
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"strings"
+)
+
+// mergeBaseNode shows the tree of the best common ancestor of two commits, like
+// merge-base/refs/heads/main/refs/heads/topic/, or nothing if they have none. The ancestor is found
+// when the directory is first listed, since listing merge-base/<A>/ makes a node for every
+// reference B.
+type mergeBaseNode struct {
+	repo *repository
+	a, b *object.Commit
+}
+
+type mergeBaseKey struct {
+	a, b plumbing.Hash
+}
+
+func (n *mergeBaseNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	key := mergeBaseKey{a: n.a.Hash, b: n.b.Hash}
+	if base, ok := n.repo.lookups.get(key); ok {
+		return base.(fstree.DirNode).Children()
+	}
+
+	commit, err := mergeBase(n.repo, n.a.Hash, n.b.Hash)
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "find merge base of %s and %s failed", n.a.Hash, n.b.Hash))
+	}
+	var base fstree.DirNode = &staticDirNode{children: map[string]fstree.Node{}}
+	if commit != nil {
+		base = &commitNode{repo: n.repo, commit: commit}
+	} else {
+		n.repo.logger.Debug("no merge base", "a", n.a.Hash, "b", n.b.Hash)
+	}
+	n.repo.lookups.put(key, base)
+	return base.Children()
+}
+
+// rangeRootNode holds ranges of commits named like git log's revision ranges, like
+// range/main..topic/, which are looked up but not listed. Revisions spanning several names, like
+// range/origin/main..topic/, are looked up through a rangeRootNode for each name but the last, whose
+// prefix is the names so far.
+type rangeRootNode struct {
+	repo   *repository
+	prefix string
+}
+
+var _ fstree.LookupDirNode = (*rangeRootNode)(nil)
+
+func (n *rangeRootNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	return map[string]fstree.Node{}, nil
+}
+
+// Lookup returns the range <from>..<to> if name completes it, where from and to are revisions git
+// rev-parse accepts, like branch names, tags and hashes. Otherwise, if name could begin a reference
+// name with a slash in it, it returns the directory of the names after it.
+func (n *rangeRootNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	spec := n.prefix + name
+	pending := spec
+	if i := strings.Index(spec, ".."); i >= 0 {
+		from, fromErr := ResolveCommit(n.repo.Repository, spec[:i])
+		to, toErr := ResolveCommit(n.repo.Repository, spec[i+2:])
+		if fromErr == nil && toErr == nil {
+			return newRangeNode(n.repo, from, to)
+		}
+		pending = spec[i+2:]
+	}
+
+	more, err := isRefPrefix(n.repo, pending+"/")
+	if err != nil {
+		return nil, fserror.Unexpected(err)
+	}
+	if !more {
+		return nil, fserror.ErrNotFound
+	}
+	return &rangeRootNode{repo: n.repo, prefix: spec + "/"}, nil
+}
+
+// ResolveCommit returns the hash of the commit rev names, peeling annotated tags.
+func ResolveCommit(repo *git.Repository, rev string) (plumbing.Hash, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrapf(err, "resolve revision %s failed", rev)
+	}
+	if tag, err := repo.TagObject(*hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, errors.Wrapf(err, "find commit of tag %s failed", tag.Name)
+		}
+		return commit.Hash, nil
+	}
+	return *hash, nil
+}
+
+// refShorteningPrefixes are the prefixes that can be left out of reference names in revisions.
+var refShorteningPrefixes = []string{"", "refs/", "refs/tags/", "refs/heads/", "refs/remotes/"}
+
+// isRefPrefix reports whether a revision starting with prefix could name a reference.
+func isRefPrefix(repo *repository, prefix string) (bool, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return false, errors.Wrap(err, "list references failed")
+	}
+	defer refs.Close()
+
+	found := false
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		for _, shortening := range refShorteningPrefixes {
+			name := string(ref.Name())
+			if strings.HasPrefix(name, shortening) && strings.HasPrefix(name[len(shortening):], prefix) {
+				found = true
+			}
+		}
+		return nil
+	})
+	return found, errors.Wrap(err, "list references failed")
+}
+
+type rangeKey struct {
+	from, to plumbing.Hash
+}
+
+// newRangeNode returns the directory holding a subdirectory for each commit in from..to, named by
+// its hash, showing its tree.
+func newRangeNode(repo *repository, from, to plumbing.Hash) (fstree.Node, *fserror.Error) {
+	key := rangeKey{from: from, to: to}
+	if node, ok := repo.lookups.get(key); ok {
+		return node, nil
+	}
+
+	commits, err := rangeCommits(repo, from, to)
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "list commits in %s..%s failed", from, to))
+	}
+	node := &staticDirNode{children: make(map[string]fstree.Node, len(commits))}
+	for _, commit := range commits {
+		node.children[commit.Hash.String()] = &commitNode{repo: repo, commit: commit}
+	}
+	repo.lookups.put(key, node)
+	return node, nil
+}
@@ -0,0 +1,107 @@
+package gitfstree
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitattributes"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io/ioutil"
+	"path"
+)
+
+// treeFilter is where a tree is in a commit's tree, for applying the attributes that filter its
+// files' contents.
+type treeFilter struct {
+	commit *object.Commit
+	// dir is the tree's path from the commit's root, and attrs the attributes files that apply to it.
+	dir   []string
+	attrs gitattributes.Stack
+}
+
+// filterChildren replaces the children of the tree with nodes filtering their contents, given the
+// attributes files of f's directory and children.
+func (f *treeFilter) filterChildren(repo *repository, children map[string]fstree.Node) *fserror.Error {
+	attrs, ferr := f.childAttrs(children[gitattributes.FileName])
+	if ferr != nil {
+		return ferr
+	}
+	for name, child := range children {
+		children[name] = f.filterChild(repo, name, child, attrs)
+	}
+	return nil
+}
+
+// childAttrs returns the attributes files that apply to the tree's children: f's, and attrsFile,
+// the tree's own .gitattributes, if it has one.
+func (f *treeFilter) childAttrs(attrsFile fstree.Node) (gitattributes.Stack, *fserror.Error) {
+	if attrsFile == nil {
+		return f.attrs, nil
+	}
+	file, err := gitattributes.Read(f.dir, map[string]fstree.Node{gitattributes.FileName: attrsFile})
+	if err != nil {
+		return nil, fserror.Unexpected(err)
+	}
+	if file == nil {
+		return f.attrs, nil
+	}
+	return append(f.attrs[:len(f.attrs):len(f.attrs)], file), nil
+}
+
+// filterChild returns the node filtering the contents of the tree's child called name, given the
+// attributes files that apply to the tree's children.
+func (f *treeFilter) filterChild(repo *repository, name string, child fstree.Node, attrs gitattributes.Stack) fstree.Node {
+	childPath := append(f.dir[:len(f.dir):len(f.dir)], name)
+	switch c := child.(type) {
+	case *treeNode:
+		return &treeNode{
+			repo:   repo,
+			tree:   c.tree,
+			filter: &treeFilter{commit: f.commit, dir: childPath, attrs: attrs},
+		}
+	case *fileNode:
+		if c.file.Mode == filemode.Symlink {
+			return child
+		}
+		if filter := attrs.Filter(childPath); filter != (gitattributes.Filter{}) {
+			return newFilteredFileNode(repo, c.file, f.commit, filter)
+		}
+	}
+	return child
+}
+
+// newFilteredFileNode returns a file whose contents are raw's converted by filter. Sizes reflect the
+// converted contents, so the contents are converted when the file is first looked at.
+func newFilteredFileNode(repo *repository, raw *object.File, commit *object.Commit, filter gitattributes.Filter) *generatedFileNode {
+	key := filteredKey{blob: raw.Hash, filter: filter}
+	if filter.ExportSubst {
+		key.commit = commit.Hash
+	}
+	return &generatedFileNode{
+		repo: repo,
+		key:  key,
+		generate: func() (*object.File, error) {
+			reader, err := raw.Reader()
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			data = filter.Apply(data, raw.Hash, commit)
+			return NewMemoryFile(path.Base(raw.Name), raw.Mode, data), nil
+		},
+		// Show the stored contents rather than none.
+		fallback: func() *object.File { return raw },
+	}
+}
+
+type filteredKey struct {
+	blob plumbing.Hash
+	// commit is the commit whose details export-subst expanded, if it applied.
+	commit plumbing.Hash
+	filter gitattributes.Filter
+}
@@ -0,0 +1,76 @@
+package gitfstree
+
+import (
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"sync"
+)
+
+// generatedFileNode is a file whose contents are made from the repository, like converted contents
+// or a commit's renames. They're made when the file is first looked at, since that can be slow, and
+// cached by key, since nodes are made again for each request.
+type generatedFileNode struct {
+	repo *repository
+	// key identifies the contents in the repository's generatedCache. It must be comparable.
+	key      interface{}
+	generate func() (*object.File, error)
+	// fallback is shown if generating the contents fails, since File can't.
+	fallback func() *object.File
+
+	once sync.Once
+	file *object.File
+}
+
+func (n *generatedFileNode) File() *object.File {
+	n.once.Do(func() {
+		if file, ok := n.repo.generated.get(n.key); ok {
+			n.file = file
+			return
+		}
+		file, err := n.generate()
+		if err != nil {
+			n.repo.logger.Error("generate file failed", "key", n.key, "err", err)
+			n.file = n.fallback()
+			return
+		}
+		n.repo.generated.put(n.key, file)
+		n.file = file
+	})
+	return n.file
+}
+
+// maxGeneratedBytes limits the size of the contents held by a generatedCache.
+const maxGeneratedBytes = 64 << 20
+
+// generatedCache holds recently generated files. It's emptied when it grows too large.
+type generatedCache struct {
+	mu    sync.Mutex
+	files map[interface{}]*object.File
+	bytes int64
+}
+
+func newGeneratedCache() *generatedCache {
+	return &generatedCache{files: map[interface{}]*object.File{}}
+}
+
+func (c *generatedCache) get(key interface{}) (*object.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file, ok := c.files[key]
+	return file, ok
+}
+
+func (c *generatedCache) put(key interface{}, file *object.File) {
+	if file.Size > maxGeneratedBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bytes+file.Size > maxGeneratedBytes {
+		c.files = map[interface{}]*object.File{}
+		c.bytes = 0
+	}
+	if _, ok := c.files[key]; !ok {
+		c.files[key] = file
+		c.bytes += file.Size
+	}
+}
@@ -1,36 +1,257 @@
 package gitfstree
 
 import (
-	"fmt"
 	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
 	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitattributes"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/josh-newman/gitviewfs/gitviewfs/trigram"
 	"github.com/pkg/errors"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
-	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 )
 
+// Options configures a tree.
+type Options struct {
+	// Writable holds path.Match patterns of references, like refs/heads/scratch/*, whose trees can be
+	// changed. Changes are kept in memory until synced, which commits them to the reference.
+	Writable []string
+	// Author is the author and committer of commits made to writable references. Its When is
+	// ignored; commits use the time of syncing.
+	Author object.Signature
+	// Cache holds listed trees. If it's nil, a cache of DefaultCacheSize directories is made.
+	Cache *Cache
+	// Logger, if set, logs problems like tree entries that can't be shown.
+	Logger *logging.Logger
+	// Filter converts the contents of files in commit views as the .gitattributes files of the
+	// commit's tree say: line endings for text with eol=crlf, $Id$ for ident and $Format:...$ for
+	// export-subst. Otherwise files show the bytes stored in the repository.
+	Filter bool
+	// SearchIndex makes searches use the trigram index kept in the git directory, at
+	// trigram.DefaultPath, to skip files that can't match. Files the index doesn't have are read.
+	// The index is reread when it changes.
+	SearchIndex bool
+}
+
+// repository is a repository along with the settings shared by the nodes showing it.
+type repository struct {
+	*git.Repository
+	cache  *Cache
+	logger *logging.Logger
+	// filter is Options.Filter.
+	filter    bool
+	generated *generatedCache
+	lookups   *lookupCache
+	// searchIndex is the trigram index searches use, if any. It's reopened when gitviewfs search
+	// updates it.
+	searchIndexMu sync.Mutex
+	searchIndex   *trigram.Index
+	// hiddenNotes are the notes references whose notes are hidden by directories of other notes,
+	// so each is only warned about once.
+	hiddenNotesMu sync.Mutex
+	hiddenNotes   map[string]bool
+}
+
 func New(repo *git.Repository) (fstree.Node, error) {
-	refs, err := repo.References()
-	defer refs.Close()
+	return NewWithOptions(repo, Options{})
+}
+
+func NewWithOptions(repo *git.Repository, opts Options) (fstree.Node, error) {
+	for _, pattern := range opts.Writable {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid writable reference pattern %q", pattern)
+		}
+	}
+	r := newRepository(repo, opts)
+	root := &rootNode{repo: r, writable: newWritableRefs(r, opts)}
+	if err := root.loadReferences(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// NewTree returns a directory showing a tree's contents, without the virtual files of a commit's
+// directory. opts.Writable and opts.Filter are ignored.
+func NewTree(repo *git.Repository, tree *object.Tree, opts Options) fstree.TreeDirNode {
+	return &treeNode{repo: newRepository(repo, opts), tree: tree}
+}
+
+func newRepository(repo *git.Repository, opts Options) *repository {
+	r := &repository{
+		Repository:  repo,
+		cache:       opts.Cache,
+		logger:      opts.Logger,
+		filter:      opts.Filter,
+		generated:   newGeneratedCache(),
+		lookups:     newLookupCache(),
+		hiddenNotes: map[string]bool{},
+	}
+	if r.cache == nil {
+		r.cache = NewCache(DefaultCacheSize)
+	}
+	if storage, ok := repo.Storer.(fsBasedStorer); ok && opts.SearchIndex {
+		index, err := trigram.Open(trigram.DefaultPath(storage.Filesystem().Root()))
+		if err != nil {
+			r.logger.Warn("open search index failed", "err", err)
+		} else {
+			r.searchIndex = index
+		}
+	}
+	return r
+}
+
+// currentSearchIndex returns the search index, reopening it if it has been updated since it was
+// read, or nil if searches don't use one.
+func (r *repository) currentSearchIndex() *trigram.Index {
+	r.searchIndexMu.Lock()
+	defer r.searchIndexMu.Unlock()
+	if r.searchIndex == nil {
+		return nil
+	}
+	index, err := r.searchIndex.Reopen()
 	if err != nil {
-		return nil, errors.Wrap(err, "list references failed")
+		r.logger.Warn("reopen search index failed", "err", err)
+		return r.searchIndex
 	}
+	r.searchIndex = index
+	return index
+}
+
+// tree returns the tree with the hash, decoding it only if it isn't cached.
+func (r *repository) tree(hash plumbing.Hash) (*object.Tree, error) {
+	if tree, ok := r.cache.tree(hash); ok {
+		return tree, nil
+	}
+	tree, err := r.TreeObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.putTree(tree)
+	return tree, nil
+}
+
+// NewMulti returns a tree with one directory per repository, each containing the same tree
+// NewWithOptions returns for that repository.
+func NewMulti(repos map[string]*git.Repository, opts Options) (fstree.Node, error) {
+	if opts.Cache == nil {
+		opts.Cache = NewCache(DefaultCacheSize)
+	}
+	root := &multiRootNode{staticDirNode{children: map[string]fstree.Node{}}}
+	for name, repo := range repos {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, errors.Errorf("invalid repository name: %q", name)
+		}
+		repoOpts := opts
+		repoOpts.Logger = opts.Logger.With("repo", name)
+		tree, err := NewWithOptions(repo, repoOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create tree for repository %s failed", name)
+		}
+		root.children[name] = tree
+	}
+	return root, nil
+}
+
+// multiRootNode lists the repositories shown by NewMulti.
+type multiRootNode struct {
+	staticDirNode
+}
+
+// Sync saves pending changes in each repository.
+func (n *multiRootNode) Sync() *fserror.Error {
+	for _, child := range n.children {
+		if ferr := child.(fstree.Syncer).Sync(); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// Refresh reloads the references of each repository.
+func (n *multiRootNode) Refresh() *fserror.Error {
+	for _, child := range n.children {
+		if ferr := child.(fstree.Refresher).Refresh(); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// rootNode is the top of the tree. It lists references like referencesNode, plus the virtual
+// directories that aren't backed by a single reference.
+type rootNode struct {
+	repo     *repository
+	writable *writableRefs
+
+	mu sync.Mutex
+	// references is a snapshot of the repository's references, replaced by Refresh.
+	references *referencesNode
+}
 
-	node := referencesNode{repo: repo}
+func (n *rootNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	n.mu.Lock()
+	references := n.references
+	n.mu.Unlock()
+
+	children, ferr := references.Children()
+	if ferr != nil {
+		return nil, ferr
+	}
+	children["reflog"] = newReflogRootNode(n.repo)
+	children["stash"] = newStashRootNode(n.repo)
+	children["search"] = references.withLeaf(func(refName plumbing.ReferenceName, commit *object.Commit) fstree.Node {
+		return &searchRefNode{repo: n.repo, refName: refName, commit: commit}
+	})
+	children["merge-base"] = references.withLeaf(func(_ plumbing.ReferenceName, a *object.Commit) fstree.Node {
+		return references.withLeaf(func(_ plumbing.ReferenceName, b *object.Commit) fstree.Node {
+			return &mergeBaseNode{repo: n.repo, a: a, b: b}
+		})
+	})
+	children["range"] = &rangeRootNode{repo: n.repo}
+	return children, nil
+}
+
+// Refresh reloads the repository's references, so that the tree shows references created, moved
+// or deleted since it was made.
+func (n *rootNode) Refresh() *fserror.Error {
+	if err := n.loadReferences(); err != nil {
+		return fserror.Unexpected(err)
+	}
+	return nil
+}
+
+func (n *rootNode) loadReferences() error {
+	refs, err := n.repo.References()
+	if err != nil {
+		return errors.Wrap(err, "list references failed")
+	}
+	defer refs.Close()
+
+	node := &referencesNode{repo: n.repo, writable: n.writable}
 	err = refs.ForEach(func(ref *plumbing.Reference) error {
 		nameParts := strings.Split(string(ref.Name()), "/")
 		node.entries = append(node.entries, referencesNodeEntry{nameParts: nameParts, ref: ref})
 		return nil
 	})
 	if err != nil {
-		return nil, fserror.Unexpected(errors.Wrap(err, "processing references failed"))
+		return errors.Wrap(err, "processing references failed")
 	}
 
-	return &node, nil
+	n.mu.Lock()
+	n.references = node
+	n.mu.Unlock()
+	return nil
+}
+
+// Sync commits pending changes to writable references.
+func (n *rootNode) Sync() *fserror.Error {
+	return n.writable.sync()
 }
 
 type referencesNodeEntry struct {
@@ -39,8 +260,17 @@ type referencesNodeEntry struct {
 }
 
 type referencesNode struct {
-	repo    *git.Repository
-	entries []referencesNodeEntry
+	repo     *repository
+	writable *writableRefs
+	entries  []referencesNodeEntry
+	// leaf, if set, returns the node a reference leads to, given its commit, rather than the commit's
+	// tree.
+	leaf func(refName plumbing.ReferenceName, commit *object.Commit) fstree.Node
+}
+
+// withLeaf returns a directory listing the same references, which lead to the nodes leaf returns.
+func (n *referencesNode) withLeaf(leaf func(plumbing.ReferenceName, *object.Commit) fstree.Node) *referencesNode {
+	return &referencesNode{repo: n.repo, writable: n.writable, entries: n.entries, leaf: leaf}
 }
 
 func (n *referencesNode) Children() (map[string]fstree.Node, *fserror.Error) {
@@ -57,19 +287,28 @@ func (n *referencesNode) Children() (map[string]fstree.Node, *fserror.Error) {
 				// zero, so we skip them.
 				continue
 			}
+			if ref, ok := n.writable.get(entry.ref.Name()); ok && n.leaf == nil {
+				// Writable references keep their own state, which outlives this snapshot of hash.
+				root, ferr := ref.rootNode(hash)
+				if ferr != nil {
+					return nil, ferr
+				}
+				children[entry.nameParts[0]] = root
+				continue
+			}
+
 			refCommit, err := n.repo.CommitObject(hash)
 			if err == plumbing.ErrObjectNotFound {
-				return nil, fserror.Unexpected(errors.Errorf("Ref name %s points to invalid or non-commit ref %s", entry.ref.Name(), entry.ref.Hash()))
+				return nil, fserror.Unexpected(errors.Wrapf(err, "Ref name %s points to invalid or non-commit ref %s", entry.ref.Name(), entry.ref.Hash()))
 			} else if err != nil {
 				return nil, fserror.Unexpected(errors.Wrap(err, "find ref commit failed"))
 			}
 
-			refTree, err := refCommit.Tree()
-			if err != nil {
-				return nil, fserror.Unexpected(errors.Wrap(err, "find ref tree failed"))
+			if n.leaf != nil {
+				children[entry.nameParts[0]] = n.leaf(entry.ref.Name(), refCommit)
+				continue
 			}
-
-			children[entry.nameParts[0]] = &treeNode{repo: n.repo, tree: refTree}
+			children[entry.nameParts[0]] = &commitNode{repo: n.repo, commit: refCommit}
 
 		default:
 			var child *referencesNode
@@ -80,7 +319,7 @@ func (n *referencesNode) Children() (map[string]fstree.Node, *fserror.Error) {
 					return nil, fserror.Unexpected(errors.Errorf("conflicting parent/child branch name: %v", entry.ref.Name()))
 				}
 			} else {
-				child = &referencesNode{repo: n.repo}
+				child = &referencesNode{repo: n.repo, writable: n.writable, leaf: n.leaf}
 				children[entry.nameParts[0]] = child
 			}
 
@@ -91,33 +330,355 @@ func (n *referencesNode) Children() (map[string]fstree.Node, *fserror.Error) {
 }
 
 type treeNode struct {
-	repo *git.Repository
+	repo *repository
 	tree *object.Tree
+	// filter, if set, is where the tree is in a commit, for filtering its files' contents.
+	filter *treeFilter
+}
+
+func (n *treeNode) Tree() *object.Tree {
+	return n.tree
 }
 
 func (n *treeNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	children, ferr := n.storedChildren()
+	if ferr != nil || n.filter == nil {
+		return children, ferr
+	}
+	if ferr := n.filter.filterChildren(n.repo, children); ferr != nil {
+		return nil, ferr
+	}
+	return children, nil
+}
+
+// storedChildren returns the children showing the tree's entries as they're stored.
+func (n *treeNode) storedChildren() (map[string]fstree.Node, *fserror.Error) {
+	if children, ok := n.repo.cache.get(n.tree.Hash); ok {
+		return children, nil
+	}
+
 	children := map[string]fstree.Node{}
 	for i := range n.tree.Entries {
 		treeEntry := &n.tree.Entries[i]
-		switch treeEntry.Mode {
-		case filemode.Dir:
-			childTree, err := n.repo.TreeObject(treeEntry.Hash)
-			if err != nil {
-				return nil, fserror.Unexpected(err)
-			}
-			children[treeEntry.Name] = &treeNode{repo: n.repo, tree: childTree}
+		child, ferr := n.newChild(treeEntry)
+		if ferr != nil {
+			return nil, ferr
+		}
+		if child == nil {
+			n.repo.logger.Info("skipping tree entry", "tree", n.tree.Hash, "name", treeEntry.Name,
+				"mode", treeEntry.Mode, "hash", treeEntry.Hash)
+			continue
+		}
+		children[treeEntry.Name] = child
+	}
+	n.repo.cache.put(n.tree.Hash, children)
+	return children, nil
+}
+
+// newChild returns the node showing a tree entry as it's stored, or nil if entries like it aren't
+// shown.
+func (n *treeNode) newChild(treeEntry *object.TreeEntry) (fstree.Node, *fserror.Error) {
+	switch treeEntry.Mode {
+	case filemode.Dir:
+		childTree, err := n.repo.tree(treeEntry.Hash)
+		if err != nil {
+			return nil, fserror.Unexpected(err)
+		}
+		return &treeNode{repo: n.repo, tree: childTree}, nil
+
+	case filemode.Regular, filemode.Executable, filemode.Symlink:
+		childFile, err := n.tree.TreeEntryFile(treeEntry)
+		if err != nil {
+			return nil, fserror.Unexpected(err)
+		}
+		return &fileNode{file: childFile}, nil
+	}
+	return nil, nil
+}
+
+// storedChild returns the child showing the entry as it's stored, using the cached children if the
+// tree was listed recently.
+func (n *treeNode) storedChild(treeEntry *object.TreeEntry) (fstree.Node, *fserror.Error) {
+	if child, cached := n.repo.cache.child(n.tree.Hash, treeEntry.Name); cached {
+		return child, nil
+	}
+	return n.newChild(treeEntry)
+}
+
+var (
+	_ fstree.LookupDirNode = (*treeNode)(nil)
+	_ fstree.ReadDirNode   = (*treeNode)(nil)
+)
+
+// Lookup finds the entry called name by binary search, so only its node is made.
+func (n *treeNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	treeEntry := findEntry(n.tree.Entries, name)
+	if treeEntry == nil {
+		return nil, fserror.ErrNotFound
+	}
+	child, ferr := n.storedChild(treeEntry)
+	if ferr != nil {
+		return nil, ferr
+	}
+	if child == nil {
+		return nil, fserror.ErrNotFound
+	}
+	if n.filter == nil {
+		return child, nil
+	}
+	attrs, ferr := n.childAttrs()
+	if ferr != nil {
+		return nil, ferr
+	}
+	return n.filter.filterChild(n.repo, name, child, attrs), nil
+}
+
+// childAttrs returns the attributes files that apply to the children of a filtered tree.
+func (n *treeNode) childAttrs() (gitattributes.Stack, *fserror.Error) {
+	var attrsFile fstree.Node
+	if treeEntry := findEntry(n.tree.Entries, gitattributes.FileName); treeEntry != nil {
+		var ferr *fserror.Error
+		if attrsFile, ferr = n.storedChild(treeEntry); ferr != nil {
+			return nil, ferr
+		}
+	}
+	return n.filter.childAttrs(attrsFile)
+}
+
+// findEntry returns the entry of a tree called name, or nil. Entries are sorted the way git sorts
+// them, comparing directories' names as if they ended in "/", so the name is searched for as both.
+func findEntry(entries []object.TreeEntry, name string) *object.TreeEntry {
+	for _, key := range []string{name, name + "/"} {
+		i := sort.Search(len(entries), func(i int) bool { return entryKey(&entries[i]) >= key })
+		if i < len(entries) && entries[i].Name == name {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+func entryKey(treeEntry *object.TreeEntry) string {
+	if treeEntry.Mode == filemode.Dir {
+		return treeEntry.Name + "/"
+	}
+	return treeEntry.Name
+}
+
+// ReadDir lists the tree's entries in name order, making each one's node as it's reached.
+func (n *treeNode) ReadDir(after string) fstree.DirIterator {
+	return &treeIterator{node: n, after: after}
+}
 
-		case filemode.Regular, filemode.Executable, filemode.Symlink:
-			childFile, err := n.tree.TreeEntryFile(treeEntry)
-			if err != nil {
-				return nil, fserror.Unexpected(err)
+type treeIterator struct {
+	node  *treeNode
+	after string
+
+	started bool
+	// order holds the indexes of the entries not returned yet, in name order.
+	order []int
+	attrs gitattributes.Stack
+}
+
+func (it *treeIterator) Next() (fstree.DirEntry, bool, *fserror.Error) {
+	n := it.node
+	if !it.started {
+		if n.filter != nil {
+			attrs, ferr := n.childAttrs()
+			if ferr != nil {
+				return fstree.DirEntry{}, false, ferr
 			}
-			children[treeEntry.Name] = &fileNode{file: childFile}
+			it.attrs = attrs
+		}
+		for i := range n.tree.Entries {
+			if n.tree.Entries[i].Name > it.after {
+				it.order = append(it.order, i)
+			}
+		}
+		// Git's order only differs from name order around directories, like "a.txt" before "a/".
+		byName := func(i, j int) bool { return n.tree.Entries[it.order[i]].Name < n.tree.Entries[it.order[j]].Name }
+		if !sort.SliceIsSorted(it.order, byName) {
+			sort.SliceStable(it.order, byName)
+		}
+		it.started = true
+	}
 
-		default:
-			// TODO(josh-newman): Use a logger from gitviewfs.
-			fmt.Fprintf(os.Stderr, "skipping file mode %v: %s\n", treeEntry.Mode, treeEntry.Hash)
+	for len(it.order) > 0 {
+		treeEntry := &n.tree.Entries[it.order[0]]
+		it.order = it.order[1:]
+		child, ferr := n.storedChild(treeEntry)
+		if ferr != nil {
+			return fstree.DirEntry{}, false, ferr
 		}
+		if child == nil {
+			continue
+		}
+		if n.filter != nil {
+			child = n.filter.filterChild(n.repo, treeEntry.Name, child, it.attrs)
+		}
+		return fstree.DirEntry{Name: treeEntry.Name, Node: child}, true, nil
+	}
+	return fstree.DirEntry{}, false, nil
+}
+
+// commitNode shows a commit's tree along with a virtual .gitviewfs directory describing the commit.
+// A .gitviewfs entry in the commit's own tree is shadowed.
+type commitNode struct {
+	repo   *repository
+	commit *object.Commit
+	// metadata holds extra children of the .gitviewfs directory, keyed by name.
+	metadata map[string]fstree.Node
+	// extra holds children shown alongside the tree's, like .gitviewfs, shadowing entries of the same
+	// name.
+	extra map[string]fstree.Node
+}
+
+func (n *commitNode) Commit() *object.Commit {
+	return n.commit
+}
+
+func (n *commitNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	root, ferr := n.root()
+	if ferr != nil {
+		return nil, ferr
+	}
+	children, ferr := root.Children()
+	if ferr != nil {
+		return nil, ferr
+	}
+	for name, child := range n.virtualChildren() {
+		children[name] = child
+	}
+	return children, nil
+}
+
+var (
+	_ fstree.LookupDirNode = (*commitNode)(nil)
+	_ fstree.ReadDirNode   = (*commitNode)(nil)
+)
+
+func (n *commitNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	if child, ok := n.extra[name]; ok {
+		return child, nil
+	}
+	if name == ".gitviewfs" {
+		return n.metadataDir(), nil
+	}
+	root, ferr := n.root()
+	if ferr != nil {
+		return nil, ferr
+	}
+	return root.Lookup(name)
+}
+
+func (n *commitNode) ReadDir(after string) fstree.DirIterator {
+	return &commitIterator{node: n, after: after}
+}
+
+// root returns the directory showing the commit's tree.
+func (n *commitNode) root() (*treeNode, *fserror.Error) {
+	tree, err := n.repo.tree(n.commit.TreeHash)
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "find tree of commit %s failed", n.commit.Hash))
+	}
+	root := &treeNode{repo: n.repo, tree: tree}
+	if n.repo.filter {
+		root.filter = &treeFilter{commit: n.commit}
+	}
+	return root, nil
+}
+
+// virtualChildren returns the children the view adds to the commit's tree: .gitviewfs and extra.
+func (n *commitNode) virtualChildren() map[string]fstree.Node {
+	children := map[string]fstree.Node{".gitviewfs": n.metadataDir()}
+	for name, child := range n.extra {
+		children[name] = child
+	}
+	return children
+}
+
+// metadataDir returns the commit's .gitviewfs directory.
+func (n *commitNode) metadataDir() fstree.Node {
+	metadata := commitMetadata(n.repo, n.commit)
+	for name, child := range n.metadata {
+		metadata[name] = child
+	}
+	return &staticDirNode{children: metadata}
+}
+
+// commitIterator lists a commit's tree, with the virtual children in their places.
+type commitIterator struct {
+	node  *commitNode
+	after string
+
+	tree fstree.DirIterator
+	// virtual holds the names of the virtual children, which are skipped in the tree, and pending
+	// the ones not returned yet, in name order.
+	virtual map[string]fstree.Node
+	pending []string
+	// next is the tree's next entry, if it's been read but not returned.
+	next *fstree.DirEntry
+}
+
+func (it *commitIterator) Next() (fstree.DirEntry, bool, *fserror.Error) {
+	if it.tree == nil {
+		root, ferr := it.node.root()
+		if ferr != nil {
+			return fstree.DirEntry{}, false, ferr
+		}
+		virtual := it.node.virtualChildren()
+		for name := range virtual {
+			if name > it.after {
+				it.pending = append(it.pending, name)
+			}
+		}
+		sort.Strings(it.pending)
+		it.virtual = virtual
+		it.tree = root.ReadDir(it.after)
+	}
+	for it.next == nil {
+		entry, ok, ferr := it.tree.Next()
+		if ferr != nil {
+			return fstree.DirEntry{}, false, ferr
+		}
+		if !ok {
+			break
+		}
+		if _, shadowed := it.virtual[entry.Name]; !shadowed {
+			it.next = &entry
+		}
+	}
+
+	if len(it.pending) > 0 && (it.next == nil || it.next.Name > it.pending[0]) {
+		name := it.pending[0]
+		it.pending = it.pending[1:]
+		return fstree.DirEntry{Name: name, Node: it.virtual[name]}, true, nil
+	}
+	if it.next == nil {
+		return fstree.DirEntry{}, false, nil
+	}
+	entry := *it.next
+	it.next = nil
+	return entry, true, nil
+}
+
+// commitMetadata returns the children of the .gitviewfs directory that every commit view has.
+func commitMetadata(repo *repository, commit *object.Commit) map[string]fstree.Node {
+	return map[string]fstree.Node{
+		"commit":  newMemoryFileNode("commit", commit.Hash.String()+"\n"),
+		"notes":   &notesNode{repo: repo, commitHash: commit.Hash},
+		"renames": newRenamesNode(repo, commit),
+	}
+}
+
+// staticDirNode is a directory with a fixed set of children.
+type staticDirNode struct {
+	children map[string]fstree.Node
+}
+
+func (n *staticDirNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	children := make(map[string]fstree.Node, len(n.children))
+	for name, child := range n.children {
+		children[name] = child
 	}
 	return children, nil
 }
@@ -129,3 +690,16 @@ type fileNode struct {
 func (n *fileNode) File() *object.File {
 	return n.file
 }
+
+// NewMemoryFile returns a file whose contents aren't stored in the repository.
+func NewMemoryFile(name string, mode filemode.FileMode, contents []byte) *object.File {
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.BlobObject)
+	obj.Write(contents)
+	return fstree.NewBlobFile(name, mode, obj)
+}
+
+// newMemoryFileNode returns a regular file node with the given contents.
+func newMemoryFileNode(name string, contents string) *fileNode {
+	return &fileNode{file: NewMemoryFile(name, filemode.Regular, []byte(contents))}
+}
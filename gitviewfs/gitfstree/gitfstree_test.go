@@ -0,0 +1,216 @@
+package gitfstree
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// gitOrderEntries are tree entries in the order git stores them, which differs from name order
+// around directories: "a.txt" and "a-b" sort before the directory "a", as if it were "a/".
+var gitOrderEntries = []object.TreeEntry{
+	{Name: "-dash", Mode: filemode.Regular},
+	{Name: "a-b", Mode: filemode.Regular},
+	{Name: "a.txt", Mode: filemode.Regular},
+	{Name: "a", Mode: filemode.Dir},
+	{Name: "a0", Mode: filemode.Executable},
+	{Name: "b.c", Mode: filemode.Regular},
+	{Name: "b", Mode: filemode.Dir},
+	{Name: "link", Mode: filemode.Symlink},
+}
+
+// gitOrderNames are the names of gitOrderEntries in name order.
+var gitOrderNames = []string{"-dash", "a", "a-b", "a.txt", "a0", "b", "b.c", "link"}
+
+func TestFindEntry(t *testing.T) {
+	for i := range gitOrderEntries {
+		name := gitOrderEntries[i].Name
+		if got := findEntry(gitOrderEntries, name); got != &gitOrderEntries[i] {
+			t.Errorf("%s: got %+v", name, got)
+		}
+	}
+	for _, name := range []string{"", "a/", "b.c/", "a.", "a1", "c", "-"} {
+		if got := findEntry(gitOrderEntries, name); got != nil {
+			t.Errorf("%s: got %+v, want none", name, got)
+		}
+	}
+	if got := findEntry(nil, "a"); got != nil {
+		t.Errorf("empty tree: got %+v", got)
+	}
+}
+
+// newTestRepository returns a repository in memory.
+func newTestRepository(t *testing.T) *repository {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRepository(repo, Options{})
+}
+
+func storeBlob(t *testing.T, repo *repository, contents string) plumbing.Hash {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(contents))
+	w.Close()
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func storeObject(t *testing.T, repo *repository, o interface {
+	Encode(plumbing.EncodedObject) error
+}) plumbing.Hash {
+	obj := repo.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// storeTree stores a tree with entries, giving files their names as contents and directories an
+// empty tree, and returns it.
+func storeTree(t *testing.T, repo *repository, entries []object.TreeEntry) *object.Tree {
+	emptyTree := storeObject(t, repo, &object.Tree{})
+	tree := &object.Tree{Entries: append([]object.TreeEntry{}, entries...)}
+	for i := range tree.Entries {
+		if tree.Entries[i].Mode == filemode.Dir {
+			tree.Entries[i].Hash = emptyTree
+		} else {
+			tree.Entries[i].Hash = storeBlob(t, repo, tree.Entries[i].Name)
+		}
+	}
+	stored, err := repo.TreeObject(storeObject(t, repo, tree))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// readNames returns the names ReadDir lists after after.
+func readNames(t *testing.T, dir fstree.DirNode, after string) []string {
+	names := []string{}
+	children := fstree.ReadDir(dir, after)
+	for {
+		entry, ok, ferr := children.Next()
+		if ferr != nil {
+			t.Fatal(ferr)
+		}
+		if !ok {
+			return names
+		}
+		names = append(names, entry.Name)
+	}
+}
+
+// checkResume checks that dir lists names, in order, and that listing resumed after each name, or
+// between two, continues with the names after it.
+func checkResume(t *testing.T, dir fstree.DirNode, names []string) {
+	if got := readNames(t, dir, ""); !reflect.DeepEqual(got, names) {
+		t.Fatalf("got %q, want %q", got, names)
+	}
+	for i, name := range names {
+		for _, after := range []string{name, name + "\x00"} {
+			if got := readNames(t, dir, after); !reflect.DeepEqual(got, names[i+1:]) {
+				t.Errorf("after %q: got %q, want %q", after, got, names[i+1:])
+			}
+		}
+	}
+	if got := readNames(t, dir, "\xff"); len(got) != 0 {
+		t.Errorf("after the last name: got %q", got)
+	}
+}
+
+func TestTreeReadDirResume(t *testing.T) {
+	repo := newTestRepository(t)
+	node := &treeNode{repo: repo, tree: storeTree(t, repo, gitOrderEntries)}
+	checkResume(t, node, gitOrderNames)
+
+	// Listing resumes the same way once the tree's children are cached.
+	if _, ferr := node.Children(); ferr != nil {
+		t.Fatal(ferr)
+	}
+	checkResume(t, node, gitOrderNames)
+}
+
+func TestTreeLookup(t *testing.T) {
+	repo := newTestRepository(t)
+	node := &treeNode{repo: repo, tree: storeTree(t, repo, gitOrderEntries)}
+	for _, entry := range gitOrderEntries {
+		child, ferr := node.Lookup(entry.Name)
+		if ferr != nil {
+			t.Errorf("%s: %v", entry.Name, ferr)
+			continue
+		}
+		if _, isDir := child.(fstree.DirNode); isDir != (entry.Mode == filemode.Dir) {
+			t.Errorf("%s: got %T", entry.Name, child)
+		}
+	}
+	if _, ferr := node.Lookup("a/"); ferr == nil {
+		t.Error("a/: got no error")
+	}
+}
+
+func TestCacheStatsCountLookups(t *testing.T) {
+	repo := newTestRepository(t)
+	repo.cache = NewCache(10)
+	node := &treeNode{repo: repo, tree: storeTree(t, repo, gitOrderEntries)}
+	name := gitOrderEntries[0].Name
+
+	if _, ferr := node.Lookup(name); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if _, ferr := node.Children(); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if _, ferr := node.Lookup(name); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if stats := repo.cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("got %d hits and %d misses, want 1 and 2", stats.Hits, stats.Misses)
+	}
+}
+
+func TestCommitReadDirResume(t *testing.T) {
+	repo := newTestRepository(t)
+	// The tree's own .gitviewfs is shadowed by the virtual one.
+	entries := append([]object.TreeEntry{{Name: ".gitviewfs", Mode: filemode.Regular}}, gitOrderEntries...)
+	tree := storeTree(t, repo, entries)
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	commit, err := repo.CommitObject(storeObject(t, repo, &object.Commit{
+		TreeHash:  tree.Hash,
+		Author:    object.Signature{Name: "A", Email: "a@example.com", When: when},
+		Committer: object.Signature{Name: "A", Email: "a@example.com", When: when},
+		Message:   "commit\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &commitNode{repo: repo, commit: commit}
+	names := []string{"-dash", ".gitviewfs", "a", "a-b", "a.txt", "a0", "b", "b.c", "link"}
+	checkResume(t, node, names)
+	metadata, ferr := node.Lookup(".gitviewfs")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if _, ok := metadata.(fstree.DirNode); !ok {
+		t.Errorf(".gitviewfs: got %T, want the virtual directory", metadata)
+	}
+}
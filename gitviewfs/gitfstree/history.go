@@ -0,0 +1,206 @@
+package gitfstree
+
+import (
+	"container/heap"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"sort"
+)
+
+// ancestors returns the hashes of the commits and every commit they descend from.
+func ancestors(repo *repository, hashes ...plumbing.Hash) (map[plumbing.Hash]bool, error) {
+	seen := map[plumbing.Hash]bool{}
+	err := walkHistory(repo, hashes, func(commit *object.Commit) (bool, error) {
+		seen[commit.Hash] = true
+		return true, nil
+	})
+	return seen, err
+}
+
+// walkHistory calls visit once with the commits at hashes and with each of their ancestors,
+// nearest first. The parents of a commit are only visited if visit returns true for it or another
+// child.
+func walkHistory(repo *repository, hashes []plumbing.Hash, visit func(*object.Commit) (bool, error)) error {
+	queued := map[plumbing.Hash]bool{}
+	var queue []plumbing.Hash
+	for _, hash := range hashes {
+		if !queued[hash] {
+			queued[hash] = true
+			queue = append(queue, hash)
+		}
+	}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return errors.Wrapf(err, "find commit %s failed", hash)
+		}
+		more, err := visit(commit)
+		if err != nil {
+			return err
+		}
+		if !more {
+			continue
+		}
+		for _, parent := range commit.ParentHashes {
+			if !queued[parent] {
+				queued[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return nil
+}
+
+// Flags that mergeBase paints commits with.
+const (
+	// reachedFromA and reachedFromB mark the commits each side descends from.
+	reachedFromA = 1 << iota
+	reachedFromB
+	// stale marks commits below a common ancestor, which can't be the best one.
+	stale
+	// isResult marks common ancestors that have been collected.
+	isResult
+)
+
+// mergeBase returns the best common ancestor of a and b, like git merge-base: a common ancestor
+// that no other common ancestor descends from. If there are several, as after criss-cross merges,
+// the most recently committed is chosen. It returns nil if a and b have no common ancestor.
+//
+// Like git, it walks both histories at once, newest commit first, painting each commit with the
+// sides that reach it. Commits reached from both sides are common, and the walk stops once every
+// commit left to visit is below one.
+func mergeBase(repo *repository, a, b plumbing.Hash) (*object.Commit, error) {
+	if a == b {
+		return repo.CommitObject(a)
+	}
+	flags := map[plumbing.Hash]int{}
+	queue := &commitQueue{}
+	for _, start := range []struct {
+		hash plumbing.Hash
+		flag int
+	}{{a, reachedFromA}, {b, reachedFromB}} {
+		commit, err := repo.CommitObject(start.hash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "find commit %s failed", start.hash)
+		}
+		flags[start.hash] = start.flag
+		heap.Push(queue, commit)
+	}
+
+	var results []*object.Commit
+	for queue.hasUnstale(flags) {
+		commit := heap.Pop(queue).(*object.Commit)
+		paint := flags[commit.Hash] & (reachedFromA | reachedFromB | stale)
+		if paint == reachedFromA|reachedFromB {
+			if flags[commit.Hash]&isResult == 0 {
+				flags[commit.Hash] |= isResult
+				results = append(results, commit)
+			}
+			paint |= stale
+		}
+		for _, parent := range commit.ParentHashes {
+			if flags[parent]&paint == paint {
+				continue
+			}
+			parentCommit, err := repo.CommitObject(parent)
+			if err != nil {
+				return nil, errors.Wrapf(err, "find commit %s failed", parent)
+			}
+			flags[parent] |= paint
+			heap.Push(queue, parentCommit)
+		}
+	}
+
+	var best []*object.Commit
+	for _, result := range results {
+		if flags[result.Hash]&stale == 0 {
+			best = append(best, result)
+		}
+	}
+	if len(best) > 1 {
+		// With clock skew, a common ancestor can be visited before one that descends from it,
+		// and the walk can stop before painting it stale. Those are only possible after
+		// criss-cross merges, so checking for them is rarely needed.
+		var err error
+		if best, err = removeRedundant(repo, best); err != nil {
+			return nil, err
+		}
+	}
+	if len(best) == 0 {
+		return nil, nil
+	}
+	sort.Slice(best, func(i, j int) bool {
+		if ti, tj := best[i].Committer.When, best[j].Committer.When; !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return best[i].Hash.String() < best[j].Hash.String()
+	})
+	return best[0], nil
+}
+
+// removeRedundant returns the commits that none of the others descend from. The history below
+// every commit is walked at once, so what they share is only walked once.
+func removeRedundant(repo *repository, commits []*object.Commit) ([]*object.Commit, error) {
+	var parents []plumbing.Hash
+	for _, commit := range commits {
+		parents = append(parents, commit.ParentHashes...)
+	}
+	below, err := ancestors(repo, parents...)
+	if err != nil {
+		return nil, err
+	}
+	var kept []*object.Commit
+	for _, commit := range commits {
+		if !below[commit.Hash] {
+			kept = append(kept, commit)
+		}
+	}
+	return kept, nil
+}
+
+// commitQueue is a heap of commits, most recently committed first.
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int      { return len(q) }
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*object.Commit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	commit := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return commit
+}
+
+// hasUnstale returns whether any queued commit might still lead to a new common ancestor.
+func (q commitQueue) hasUnstale(flags map[plumbing.Hash]int) bool {
+	for _, commit := range q {
+		if flags[commit.Hash]&stale == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeCommits returns the commits that to descends from, including to, but from doesn't, like git
+// log from..to.
+func rangeCommits(repo *repository, from, to plumbing.Hash) ([]*object.Commit, error) {
+	excluded, err := ancestors(repo, from)
+	if err != nil {
+		return nil, err
+	}
+	var commits []*object.Commit
+	err = walkHistory(repo, []plumbing.Hash{to}, func(commit *object.Commit) (bool, error) {
+		if excluded[commit.Hash] {
+			return false, nil
+		}
+		commits = append(commits, commit)
+		return true, nil
+	})
+	return commits, err
+}
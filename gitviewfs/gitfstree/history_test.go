@@ -0,0 +1,108 @@
+package gitfstree
+
+import (
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"testing"
+	"time"
+)
+
+// history stores commits by name, each committed at its own time.
+type history struct {
+	t       *testing.T
+	repo    *repository
+	commits map[string]plumbing.Hash
+	names   map[plumbing.Hash]string
+}
+
+func newHistory(t *testing.T) *history {
+	return &history{t: t, repo: newTestRepository(t), commits: map[string]plumbing.Hash{}, names: map[plumbing.Hash]string{}}
+}
+
+// commit stores a commit called name, committed minute minutes after a fixed time, with parents.
+func (h *history) commit(name string, minute int, parents ...string) {
+	tree := storeObject(h.t, h.repo, &object.Tree{})
+	signature := object.Signature{Name: "A", Email: "a@example.com", When: time.Date(2020, 1, 1, 0, minute, 0, 0, time.UTC)}
+	commit := &object.Commit{TreeHash: tree, Author: signature, Committer: signature, Message: name + "\n"}
+	for _, parent := range parents {
+		commit.ParentHashes = append(commit.ParentHashes, h.commits[parent])
+	}
+	hash := storeObject(h.t, h.repo, commit)
+	h.commits[name] = hash
+	h.names[hash] = name
+}
+
+// checkMergeBase checks the merge base of a and b both ways round. want is empty for none.
+func (h *history) checkMergeBase(a, b, want string) {
+	h.t.Helper()
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		base, err := mergeBase(h.repo, h.commits[pair[0]], h.commits[pair[1]])
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		got := ""
+		if base != nil {
+			got = h.names[base.Hash]
+		}
+		if got != want {
+			h.t.Errorf("merge base of %s and %s: got %q, want %q", pair[0], pair[1], got, want)
+		}
+	}
+}
+
+func TestMergeBaseLinear(t *testing.T) {
+	h := newHistory(t)
+	h.commit("a", 1)
+	h.commit("b", 2, "a")
+	h.commit("c", 3, "b")
+	h.checkMergeBase("c", "b", "b")
+	h.checkMergeBase("c", "a", "a")
+	h.checkMergeBase("c", "c", "c")
+}
+
+func TestMergeBaseFork(t *testing.T) {
+	h := newHistory(t)
+	h.commit("root", 1)
+	h.commit("base", 2, "root")
+	h.commit("left", 3, "base")
+	h.commit("right1", 4, "base")
+	h.commit("right2", 5, "right1")
+	h.checkMergeBase("left", "right2", "base")
+
+	// Merging the right side in moves the base up to it.
+	h.commit("merge", 6, "left", "right1")
+	h.checkMergeBase("merge", "right2", "right1")
+}
+
+func TestMergeBaseCrissCross(t *testing.T) {
+	h := newHistory(t)
+	h.commit("root", 1)
+	h.commit("x", 2, "root")
+	h.commit("y", 3, "root")
+	// Each side merges the other, so x and y are both best common ancestors.
+	h.commit("left", 4, "x", "y")
+	h.commit("right", 5, "y", "x")
+	h.commit("left2", 6, "left")
+	h.commit("right2", 7, "right")
+	// The most recently committed is chosen.
+	h.checkMergeBase("left2", "right2", "y")
+}
+
+func TestMergeBaseUnrelated(t *testing.T) {
+	h := newHistory(t)
+	h.commit("a", 1)
+	h.commit("b", 2, "a")
+	h.commit("orphan", 3)
+	h.commit("orphan2", 4, "orphan")
+	h.checkMergeBase("b", "orphan2", "")
+}
+
+func TestMergeBaseClockSkew(t *testing.T) {
+	h := newHistory(t)
+	h.commit("old", 10)
+	// skewed was committed on a machine whose clock was behind, before its parent.
+	h.commit("skewed", 1, "old")
+	h.commit("a", 20, "skewed")
+	h.commit("b", 21, "skewed", "old")
+	h.checkMergeBase("a", "b", "skewed")
+}
@@ -0,0 +1,112 @@
+package gitfstree
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"path"
+	"sort"
+)
+
+// mergeTrees merges the changes from base to ours and from base to theirs, entry by entry, and
+// stores the merged tree. Entries changed on both sides conflict unless they were changed the same
+// way, and their paths are returned instead of a tree. Files aren't merged line by line. A zero
+// hash is an empty tree.
+func mergeTrees(repo *repository, base, ours, theirs plumbing.Hash) (plumbing.Hash, []string, error) {
+	var conflicts []string
+	merged, _, err := mergeTree(repo, "", base, ours, theirs, &conflicts)
+	if err != nil || len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return plumbing.ZeroHash, conflicts, err
+	}
+	return merged, nil, nil
+}
+
+// mergeTree merges the trees of the directory dir, returning the merged tree's hash and number of
+// entries, or -1 if it's one of the given trees.
+func mergeTree(repo *repository, dir string, base, ours, theirs plumbing.Hash, conflicts *[]string) (plumbing.Hash, int, error) {
+	switch {
+	case ours == theirs, base == theirs:
+		return ours, -1, nil
+	case base == ours:
+		return theirs, -1, nil
+	}
+
+	var trees [3]map[string]*object.TreeEntry
+	for i, hash := range []plumbing.Hash{base, ours, theirs} {
+		trees[i] = map[string]*object.TreeEntry{}
+		if hash == plumbing.ZeroHash {
+			continue
+		}
+		tree, err := repo.tree(hash)
+		if err != nil {
+			return plumbing.ZeroHash, 0, errors.Wrapf(err, "find tree %s failed", hash)
+		}
+		for j := range tree.Entries {
+			trees[i][tree.Entries[j].Name] = &tree.Entries[j]
+		}
+	}
+
+	names := map[string]bool{}
+	for _, entries := range trees {
+		for name := range entries {
+			names[name] = true
+		}
+	}
+	var entries []object.TreeEntry
+	for name := range names {
+		b, o, t := trees[0][name], trees[1][name], trees[2][name]
+		var entry *object.TreeEntry
+		switch {
+		case sameEntry(o, t), sameEntry(b, t):
+			entry = o
+		case sameEntry(b, o):
+			entry = t
+		case isDirEntry(o) && isDirEntry(t) && (b == nil || isDirEntry(b)):
+			baseHash := plumbing.ZeroHash
+			if b != nil {
+				baseHash = b.Hash
+			}
+			hash, n, err := mergeTree(repo, path.Join(dir, name), baseHash, o.Hash, t.Hash, conflicts)
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			// Git doesn't store empty directories.
+			if n != 0 {
+				entry = &object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash}
+			}
+		default:
+			*conflicts = append(*conflicts, path.Join(dir, name))
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	if len(*conflicts) > 0 {
+		return plumbing.ZeroHash, 0, nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return treeEntrySortName(entries[i]) < treeEntrySortName(entries[j])
+	})
+	tree := &object.Tree{Entries: entries}
+	obj := repo.Storer.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, 0, errors.Wrap(err, "encode tree failed")
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	return hash, len(entries), errors.Wrap(err, "store tree failed")
+}
+
+// sameEntry reports whether a and b, either of which may be missing, have the same contents.
+func sameEntry(a, b *object.TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hash == b.Hash && a.Mode == b.Mode
+}
+
+func isDirEntry(entry *object.TreeEntry) bool {
+	return entry != nil && entry.Mode == filemode.Dir
+}
@@ -0,0 +1,113 @@
+package gitfstree
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"strings"
+)
+
+const notesRefPrefix = "refs/notes/"
+
+// notesNode lists the notes attached to a commit, one file per notes reference. The note from
+// refs/notes/ci/tests is at ci/tests. If refs/notes/ci has a note too, it's hidden by the ci
+// directory, whichever reference is read first. Notes references are read each time the directory
+// is listed, so new notes show up without remounting.
+type notesNode struct {
+	repo       *repository
+	commitHash plumbing.Hash
+}
+
+func (n *notesNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	refs, err := n.repo.References()
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrap(err, "list references failed"))
+	}
+	defer refs.Close()
+
+	root := &staticDirNode{children: map[string]fstree.Node{}}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := string(ref.Name())
+		if !strings.HasPrefix(name, notesRefPrefix) || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		notesCommit, err := n.repo.CommitObject(ref.Hash())
+		if err != nil {
+			return errors.Wrapf(err, "find notes commit for %s failed", name)
+		}
+		notesTree, err := notesCommit.Tree()
+		if err != nil {
+			return errors.Wrapf(err, "find notes tree for %s failed", name)
+		}
+		note, err := findNote(n.repo, notesTree, n.commitHash.String())
+		if err != nil {
+			return errors.Wrapf(err, "find note in %s failed", name)
+		} else if note == nil {
+			return nil
+		}
+
+		parts := strings.Split(strings.TrimPrefix(name, notesRefPrefix), "/")
+		dir := root
+		for i, part := range parts[:len(parts)-1] {
+			child, ok := dir.children[part].(*staticDirNode)
+			if !ok {
+				if _, isNote := dir.children[part].(*fileNode); isNote {
+					n.hide(notesRefPrefix + strings.Join(parts[:i+1], "/"))
+				}
+				child = &staticDirNode{children: map[string]fstree.Node{}}
+				dir.children[part] = child
+			}
+			dir = child
+		}
+		last := parts[len(parts)-1]
+		if _, isDir := dir.children[last].(*staticDirNode); isDir {
+			n.hide(name)
+			return nil
+		}
+		dir.children[last] = &fileNode{file: note}
+		return nil
+	})
+	if err != nil {
+		return nil, fserror.Unexpected(err)
+	}
+	return root.Children()
+}
+
+// hide reports that the note from refName is hidden by a directory of other notes with its name,
+// the first time a note from it is. Git doesn't let both references exist as loose references, but
+// packed ones can.
+func (n *notesNode) hide(refName string) {
+	n.repo.hiddenNotesMu.Lock()
+	warned := n.repo.hiddenNotes[refName]
+	n.repo.hiddenNotes[refName] = true
+	n.repo.hiddenNotesMu.Unlock()
+	if warned {
+		n.repo.logger.Debug("hiding note whose name is a directory of notes", "commit", n.commitHash, "ref", refName)
+		return
+	}
+	n.repo.logger.Warn("hiding notes whose name is a directory of notes", "commit", n.commitHash, "ref", refName)
+}
+
+// findNote returns the note for the object with the given hex hash in a notes tree, or nil if
+// there is none. Notes trees may fan out into directories named by hash prefixes, like ab/cdef...
+func findNote(repo *repository, tree *object.Tree, hash string) (*object.File, error) {
+	for i := range tree.Entries {
+		entry := &tree.Entries[i]
+		switch {
+		case entry.Name == hash && entry.Mode != filemode.Dir:
+			return tree.TreeEntryFile(entry)
+
+		case entry.Mode == filemode.Dir && len(entry.Name) == 2 && strings.HasPrefix(hash, entry.Name):
+			subtree, err := repo.TreeObject(entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			return findNote(repo, subtree, hash[2:])
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,199 @@
+package gitfstree
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// reflogLogsDir is the directory, relative to the git directory, that holds reflog files.
+const reflogLogsDir = "logs"
+
+// fsBasedStorer is implemented by storage kept in a git directory, which is where reflogs are.
+type fsBasedStorer interface {
+	Filesystem() billy.Filesystem
+}
+
+// reflogEntry is one line of a reflog file.
+type reflogEntry struct {
+	oldHash   plumbing.Hash
+	newHash   plumbing.Hash
+	committer string
+	message   string
+}
+
+// maxReflogLineSize bounds the lines readReflogLines accepts. Messages are usually commit subjects,
+// but nothing stops them being long, so the limit is far above bufio.Scanner's default.
+const maxReflogLineSize = 16 << 20
+
+// readReflogLines returns the lines of the reflog for refName, most recent first, so that index N
+// corresponds to refName@{N}.
+func readReflogLines(fs billy.Filesystem, refName string) ([]string, error) {
+	f, err := fs.Open(path.Join(reflogLogsDir, refName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open reflog for %s failed", refName)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxReflogLineSize)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read reflog for %s failed", refName)
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, nil
+}
+
+// parseReflogLine decodes a line of the reflog for refName.
+func parseReflogLine(refName, line string) (reflogEntry, error) {
+	// Format: <old hash> SP <new hash> SP <committer> [TAB <message>]
+	header, message := line, ""
+	if i := strings.IndexByte(line, '\t'); i >= 0 {
+		header, message = line[:i], line[i+1:]
+	}
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 {
+		return reflogEntry{}, errors.Errorf("malformed reflog line for %s: %q", refName, line)
+	}
+	return reflogEntry{
+		oldHash:   plumbing.NewHash(fields[0]),
+		newHash:   plumbing.NewHash(fields[1]),
+		committer: fields[2],
+		message:   message,
+	}, nil
+}
+
+// newReflogRootNode returns the directory listing every reference that has a reflog. Repositories
+// that aren't stored on a filesystem have no reflogs, so their directory is empty.
+func newReflogRootNode(repo *repository) fstree.DirNode {
+	storage, ok := repo.Storer.(fsBasedStorer)
+	if !ok {
+		return &staticDirNode{}
+	}
+	return &reflogDirNode{repo: repo, fs: storage.Filesystem(), dir: reflogLogsDir}
+}
+
+// reflogDirNode mirrors a directory under the reflog directory, like logs/refs/heads.
+type reflogDirNode struct {
+	repo *repository
+	fs   billy.Filesystem
+	dir  string
+}
+
+func (n *reflogDirNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	infos, err := n.fs.ReadDir(n.dir)
+	if os.IsNotExist(err) {
+		return map[string]fstree.Node{}, nil
+	} else if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "list reflog directory %s failed", n.dir))
+	}
+
+	children := map[string]fstree.Node{}
+	for _, info := range infos {
+		childPath := path.Join(n.dir, info.Name())
+		if info.IsDir() {
+			children[info.Name()] = &reflogDirNode{repo: n.repo, fs: n.fs, dir: childPath}
+		} else {
+			refName := strings.TrimPrefix(childPath, reflogLogsDir+"/")
+			children[info.Name()] = &reflogNode{repo: n.repo, fs: n.fs, refName: refName}
+		}
+	}
+	return children, nil
+}
+
+// reflogNode lists the entries of one reference's reflog as directories named by their index.
+type reflogNode struct {
+	repo    *repository
+	fs      billy.Filesystem
+	refName string
+}
+
+var _ fstree.LookupDirNode = (*reflogNode)(nil)
+
+func (n *reflogNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	lines, err := readReflogLines(n.fs, n.refName)
+	if err != nil {
+		return nil, fserror.Unexpected(err)
+	}
+
+	children := map[string]fstree.Node{}
+	for i, line := range lines {
+		child, ferr := n.entryNode(i, line)
+		if ferr != nil {
+			return nil, ferr
+		}
+		if child != nil {
+			children[strconv.Itoa(i)] = child
+		}
+	}
+	return children, nil
+}
+
+// Lookup decodes only the entry called name, rather than every entry in the reflog.
+func (n *reflogNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	i, err := strconv.Atoi(name)
+	if err != nil || i < 0 || strconv.Itoa(i) != name {
+		return nil, fserror.ErrNotFound
+	}
+	lines, err := readReflogLines(n.fs, n.refName)
+	if err != nil {
+		return nil, fserror.Unexpected(err)
+	}
+	if i >= len(lines) {
+		return nil, fserror.ErrNotFound
+	}
+	child, ferr := n.entryNode(i, lines[i])
+	if ferr != nil {
+		return nil, ferr
+	}
+	if child == nil {
+		return nil, fserror.ErrNotFound
+	}
+	return child, nil
+}
+
+// entryNode returns the commit the reflog entry at index i moved the reference to, or nil if
+// there's none to show.
+func (n *reflogNode) entryNode(i int, line string) (fstree.Node, *fserror.Error) {
+	entry, err := parseReflogLine(n.refName, line)
+	if err != nil {
+		return nil, fserror.Unexpected(err)
+	}
+	if entry.newHash == plumbing.ZeroHash {
+		// The reference was deleted by this entry, so there's nothing to show.
+		return nil, nil
+	}
+	commit, err := n.repo.CommitObject(entry.newHash)
+	if err == plumbing.ErrObjectNotFound {
+		// The commit may have been garbage collected since the reflog entry was written.
+		return nil, nil
+	} else if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "find reflog commit %s failed", entry.newHash))
+	}
+
+	reflogFile := newMemoryFileNode("reflog", fmt.Sprintf(
+		"%s@{%d}\nold %s\nnew %s\ncommitter %s\n\n%s\n",
+		n.refName, i, entry.oldHash, entry.newHash, entry.committer, entry.message))
+	return &commitNode{
+		repo:     n.repo,
+		commit:   commit,
+		metadata: map[string]fstree.Node{"reflog": reflogFile},
+	}, nil
+}
@@ -0,0 +1,264 @@
+package gitfstree
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+	"hash/fnv"
+	"io/ioutil"
+	"sort"
+)
+
+// Renames and copies are detected like git diff -M -C does: a file added by a commit is a rename of
+// a file it deleted, or a copy of a file it deleted or changed, if their contents are similar
+// enough.
+const (
+	// minSimilarity is the lowest similarity score, out of 100, of a rename or copy.
+	minSimilarity = 50
+	// maxRenameSources limits the files compared, since each added file is compared with each
+	// source. Beyond it, only identical files are detected.
+	maxRenameSources = 1000
+	// maxChunk is the longest chunk of contents compared. Lines are split into chunks this long.
+	maxChunk = 64
+)
+
+type renamesKey struct {
+	commit plumbing.Hash
+}
+
+// newRenamesNode returns the file listing the renames and copies between each of the commit's
+// parents and the commit, one per line, like git diff --name-status -M -C:
+//
+//	<parent hash> TAB R<score> TAB <old path> TAB <new path>
+//	<parent hash> TAB C<score> TAB <source path> TAB <new path>
+func newRenamesNode(repo *repository, commit *object.Commit) *generatedFileNode {
+	return &generatedFileNode{
+		repo: repo,
+		key:  renamesKey{commit: commit.Hash},
+		generate: func() (*object.File, error) {
+			var out bytes.Buffer
+			for _, parentHash := range commit.ParentHashes {
+				renames, err := detectRenames(repo, parentHash, commit)
+				if err != nil {
+					return nil, err
+				}
+				for _, r := range renames {
+					fmt.Fprintf(&out, "%s\t%c%03d\t%s\t%s\n", parentHash, r.status, r.score, r.from, r.to)
+				}
+			}
+			return NewMemoryFile("renames", filemode.Regular, out.Bytes()), nil
+		},
+		fallback: func() *object.File {
+			return NewMemoryFile("renames", filemode.Regular, nil)
+		},
+	}
+}
+
+type rename struct {
+	// status is 'R' for renames and 'C' for copies.
+	status   byte
+	score    int
+	from, to string
+}
+
+type renameFile struct {
+	path string
+	hash plumbing.Hash
+	// deleted is set for sources deleted by the commit, which can be renamed.
+	deleted bool
+	// chunks holds the number of bytes of the file's contents in each chunk, by chunk hash, once
+	// they're read.
+	chunks map[uint64]int
+	size   int
+}
+
+// detectRenames returns the renames and copies between the parent and the commit, ordered by new
+// path.
+func detectRenames(repo *repository, parentHash plumbing.Hash, commit *object.Commit) ([]rename, error) {
+	parent, err := repo.CommitObject(parentHash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "find parent commit %s failed", parentHash)
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return nil, errors.Wrapf(err, "find tree of commit %s failed", parentHash)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrapf(err, "find tree of commit %s failed", commit.Hash)
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, errors.Wrapf(err, "diff trees of %s and %s failed", parentHash, commit.Hash)
+	}
+
+	var added, sources []*renameFile
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+		switch action {
+		case merkletrie.Insert:
+			if isRenameable(change.To.TreeEntry.Mode) {
+				added = append(added, &renameFile{path: change.To.Name, hash: change.To.TreeEntry.Hash})
+			}
+		case merkletrie.Delete, merkletrie.Modify:
+			if isRenameable(change.From.TreeEntry.Mode) {
+				sources = append(sources, &renameFile{
+					path:    change.From.Name,
+					hash:    change.From.TreeEntry.Hash,
+					deleted: action == merkletrie.Delete,
+				})
+			}
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].path < added[j].path })
+	sort.Slice(sources, func(i, j int) bool { return sources[i].path < sources[j].path })
+
+	renamed := map[*renameFile]bool{}
+	var renames []rename
+	pair := func(source, dest *renameFile, score int) {
+		r := rename{status: 'C', score: score, from: source.path, to: dest.path}
+		if source.deleted && !renamed[source] {
+			r.status = 'R'
+			renamed[source] = true
+		}
+		renames = append(renames, r)
+	}
+
+	// Identical files are paired first, preferring deleted sources so they're renamed.
+	var unpaired []*renameFile
+	for _, dest := range added {
+		var best *renameFile
+		for _, source := range sources {
+			if source.hash != dest.hash {
+				continue
+			}
+			if best == nil {
+				best = source
+			}
+			if source.deleted && !renamed[source] {
+				best = source
+				break
+			}
+		}
+		if best != nil {
+			pair(best, dest, 100)
+		} else {
+			unpaired = append(unpaired, dest)
+		}
+	}
+
+	if len(unpaired) > 0 && len(unpaired) <= maxRenameSources && len(sources) <= maxRenameSources {
+		similar, err := pairSimilar(repo, unpaired, sources)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range similar {
+			pair(p.source, p.dest, p.score)
+		}
+	}
+
+	sort.SliceStable(renames, func(i, j int) bool { return renames[i].to < renames[j].to })
+	return renames, nil
+}
+
+func isRenameable(mode filemode.FileMode) bool {
+	return mode == filemode.Regular || mode == filemode.Executable || mode == filemode.Symlink
+}
+
+type similarPair struct {
+	source, dest *renameFile
+	score        int
+}
+
+// pairSimilar returns the best source of each added file that's similar enough to one, with the most
+// similar pairs first, so that deleted files are renamed to their closest match.
+func pairSimilar(repo *repository, added, sources []*renameFile) ([]similarPair, error) {
+	for _, f := range append(added[:len(added):len(added)], sources...) {
+		if err := f.readChunks(repo); err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []similarPair
+	for _, dest := range added {
+		for _, source := range sources {
+			if score := similarity(source, dest); score >= minSimilarity {
+				candidates = append(candidates, similarPair{source: source, dest: dest, score: score})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	paired := map[*renameFile]bool{}
+	var pairs []similarPair
+	for _, c := range candidates {
+		if !paired[c.dest] {
+			paired[c.dest] = true
+			pairs = append(pairs, c)
+		}
+	}
+	return pairs, nil
+}
+
+// readChunks reads the file's contents and counts its chunks.
+func (f *renameFile) readChunks(repo *repository) error {
+	blob, err := repo.BlobObject(f.hash)
+	if err != nil {
+		return errors.Wrapf(err, "find blob %s failed", f.hash)
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return errors.Wrapf(err, "open blob %s failed", f.hash)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrapf(err, "read blob %s failed", f.hash)
+	}
+
+	f.size = len(data)
+	f.chunks = map[uint64]int{}
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 || n > maxChunk {
+			n = len(data)
+			if n > maxChunk {
+				n = maxChunk
+			}
+		}
+		h := fnv.New64a()
+		h.Write(data[:n])
+		f.chunks[h.Sum64()] += n
+		data = data[n:]
+	}
+	return nil
+}
+
+// similarity returns the share of the larger file's bytes that are in chunks both files have, out
+// of 100.
+func similarity(a, b *renameFile) int {
+	larger, smaller := a.size, b.size
+	if larger < smaller {
+		larger, smaller = smaller, larger
+	}
+	if larger == 0 || smaller*100 < larger*minSimilarity {
+		// The files are too different in size to be similar enough.
+		return 0
+	}
+	common := 0
+	for h, n := range a.chunks {
+		if m := b.chunks[h]; m < n {
+			common += m
+		} else {
+			common += n
+		}
+	}
+	return common * 100 / larger
+}
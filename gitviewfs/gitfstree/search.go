@@ -0,0 +1,145 @@
+package gitfstree
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/trigram"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"sort"
+	"strings"
+)
+
+// regexpQueryPrefix starts queries that are regular expressions rather than literal text.
+const regexpQueryPrefix = "re:"
+
+// searchRefNode searches the tree of a reference's commit. Its children are searches named by
+// their query, like search/refs/heads/master/TODO/, which are looked up but not listed.
+type searchRefNode struct {
+	repo    *repository
+	refName plumbing.ReferenceName
+	commit  *object.Commit
+}
+
+var _ fstree.LookupDirNode = (*searchRefNode)(nil)
+
+func (n *searchRefNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	return map[string]fstree.Node{}, nil
+}
+
+// Lookup searches for files containing query, which is literal text, or a regular expression if
+// it starts with "re:". The search's directory holds symlinks to the matching files, at their
+// paths in the tree. Names starting with a dot aren't searched for, since tools look up names like
+// .git and .DS_Store in every directory; "re:\." searches for them.
+func (n *searchRefNode) Lookup(query string) (fstree.Node, *fserror.Error) {
+	if strings.HasPrefix(query, ".") {
+		return nil, fserror.ErrNotFound
+	}
+	key := searchKey{tree: n.commit.TreeHash, refName: n.refName, query: query}
+	if results, ok := n.repo.lookups.get(key); ok {
+		return results, nil
+	}
+
+	q, err := parseQuery(query)
+	if err != nil {
+		n.repo.logger.Debug("invalid search query", "query", query, "err", err)
+		return nil, fserror.Expected(fuse.EINVAL)
+	}
+	tree, err := n.commit.Tree()
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "find tree of commit %s failed", n.commit.Hash))
+	}
+	paths, err := searchTree(n.repo, tree, q)
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "search tree %s failed", tree.Hash))
+	}
+
+	results := newSearchResults(n.refName, paths)
+	n.repo.lookups.put(key, results)
+	return results, nil
+}
+
+func parseQuery(query string) (*trigram.Query, error) {
+	if query == "" {
+		return nil, errors.New("empty query")
+	}
+	if strings.HasPrefix(query, regexpQueryPrefix) {
+		return trigram.Compile(strings.TrimPrefix(query, regexpQueryPrefix), trigram.QueryOptions{Regexp: true})
+	}
+	return trigram.Compile(query, trigram.QueryOptions{})
+}
+
+// newSearchResults returns the directory of a search's results. Each file path is a symlink to the
+// file in the reference's directory, relative so that it works wherever the tree is served.
+func newSearchResults(refName plumbing.ReferenceName, paths []string) fstree.DirNode {
+	root := &staticDirNode{children: map[string]fstree.Node{}}
+	// The results are in search/<reference>/<query>/.
+	depth := strings.Count(string(refName), "/") + 3
+	for _, filePath := range paths {
+		parts := strings.Split(filePath, "/")
+		dir := root
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := dir.children[part].(*staticDirNode)
+			if !ok {
+				child = &staticDirNode{children: map[string]fstree.Node{}}
+				dir.children[part] = child
+			}
+			dir = child
+		}
+
+		name := parts[len(parts)-1]
+		target := strings.Repeat("../", depth+len(parts)-1) + string(refName) + "/" + filePath
+		dir.children[name] = &fileNode{file: NewMemoryFile(name, filemode.Symlink, []byte(target))}
+	}
+	return root
+}
+
+// searchTree returns the sorted paths of the regular files in tree whose contents match q. Each blob
+// is only read once, however many paths it's at, and blobs the search index rules out aren't read.
+func searchTree(repo *repository, tree *object.Tree, q *trigram.Query) ([]string, error) {
+	candidate := func(plumbing.Hash) bool { return true }
+	if index := repo.currentSearchIndex(); index != nil {
+		candidate = index.Candidates(q)
+	}
+
+	var blobs []plumbing.Hash
+	blobPaths := map[plumbing.Hash][]string{}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "walk tree failed")
+		}
+		if entry.Mode != filemode.Regular && entry.Mode != filemode.Executable || !candidate(entry.Hash) {
+			continue
+		}
+		if _, ok := blobPaths[entry.Hash]; !ok {
+			blobs = append(blobs, entry.Hash)
+		}
+		blobPaths[entry.Hash] = append(blobPaths[entry.Hash], name)
+	}
+
+	matches, err := trigram.Search(repo.Repository, blobs, q)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for hash := range matches {
+		paths = append(paths, blobPaths[hash]...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+type searchKey struct {
+	tree    plumbing.Hash
+	refName plumbing.ReferenceName
+	query   string
+}
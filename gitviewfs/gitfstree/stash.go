@@ -0,0 +1,76 @@
+package gitfstree
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+)
+
+const stashRefName = "refs/stash"
+
+// stashParentNames names the extra parents of a stash commit, in order after the first parent
+// (which is HEAD at the time of stashing).
+var stashParentNames = []string{"index", "untracked"}
+
+// newStashRootNode returns the directory listing stash entries, where stash/N/ is the working tree
+// of stash@{N}. Each entry also holds the stashed index and untracked files, when present, in index/
+// and untracked/, which shadow entries of the working tree with those names.
+func newStashRootNode(repo *repository) fstree.DirNode {
+	storage, ok := repo.Storer.(fsBasedStorer)
+	if !ok {
+		return &staticDirNode{}
+	}
+	return &stashNode{reflog: reflogNode{repo: repo, fs: storage.Filesystem(), refName: stashRefName}}
+}
+
+type stashNode struct {
+	reflog reflogNode
+}
+
+func (n *stashNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	if _, err := n.reflog.fs.Stat(path.Join(reflogLogsDir, stashRefName)); os.IsNotExist(err) {
+		return map[string]fstree.Node{}, nil
+	}
+
+	children, ferr := n.reflog.Children()
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	for _, child := range children {
+		entry, ok := child.(*commitNode)
+		if !ok {
+			return nil, fserror.Unexpected(errors.Errorf("unexpected stash entry node: %v", child))
+		}
+		for i, parentName := range stashParentNames {
+			if i+1 >= len(entry.commit.ParentHashes) {
+				break
+			}
+			parent, ferr := stashParentTree(n.reflog.repo, entry, i+1)
+			if ferr != nil {
+				return nil, ferr
+			}
+			if entry.extra == nil {
+				entry.extra = map[string]fstree.Node{}
+			}
+			entry.extra[parentName] = parent
+		}
+	}
+	return children, nil
+}
+
+// stashParentTree returns the tree of the stash commit's parent at index i.
+func stashParentTree(repo *repository, entry *commitNode, i int) (fstree.Node, *fserror.Error) {
+	parentHash := entry.commit.ParentHashes[i]
+	parent, err := repo.CommitObject(parentHash)
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "find stash parent commit %s failed", parentHash))
+	}
+	tree, err := parent.Tree()
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "find tree of stash parent %s failed", parentHash))
+	}
+	return &treeNode{repo: repo, tree: tree}, nil
+}
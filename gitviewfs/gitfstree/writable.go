@@ -0,0 +1,757 @@
+package gitfstree
+
+import (
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// writableRefs tracks the references that match Options.Writable. Their state lives here rather
+// than in the nodes, which are recreated on every lookup.
+type writableRefs struct {
+	repo *repository
+	opts Options
+
+	mu   sync.Mutex
+	refs map[plumbing.ReferenceName]*writableRef
+}
+
+func newWritableRefs(repo *repository, opts Options) *writableRefs {
+	return &writableRefs{repo: repo, opts: opts, refs: map[plumbing.ReferenceName]*writableRef{}}
+}
+
+// get returns the state of the named reference, or false if it isn't writable.
+func (w *writableRefs) get(name plumbing.ReferenceName) (*writableRef, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ref, ok := w.refs[name]; ok {
+		return ref, true
+	}
+	for _, pattern := range w.opts.Writable {
+		// Patterns are checked in NewWithOptions, so errors can't happen here.
+		if ok, _ := path.Match(pattern, string(name)); ok {
+			ref := &writableRef{repo: w.repo, name: name, author: w.opts.Author}
+			w.refs[name] = ref
+			return ref, true
+		}
+	}
+	return nil, false
+}
+
+// sync commits pending changes in every writable reference.
+func (w *writableRefs) sync() *fserror.Error {
+	w.mu.Lock()
+	refs := make([]*writableRef, 0, len(w.refs))
+	for _, ref := range w.refs {
+		refs = append(refs, ref)
+	}
+	w.mu.Unlock()
+
+	for _, ref := range refs {
+		if ferr := ref.sync(); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// writableRef holds the changes staged for one writable reference. A single mutex guards the
+// whole staged tree.
+type writableRef struct {
+	repo   *repository
+	name   plumbing.ReferenceName
+	author object.Signature
+
+	mu sync.Mutex
+	// base is the commit the staged tree started from, and the parent of the next commit.
+	base  *object.Commit
+	root  *memDir
+	dirty bool
+}
+
+// rootNode returns the reference's tree, starting from the commit hash if nothing has been staged
+// yet.
+func (r *writableRef) rootNode(hash plumbing.Hash) (fstree.Node, *fserror.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.root == nil {
+		commit, err := r.repo.CommitObject(hash)
+		if err != nil {
+			return nil, fserror.Unexpected(errors.Wrapf(err, "find commit %s of %s failed", hash, r.name))
+		}
+		r.base = commit
+		r.root = &memDir{ref: r, treeHash: commit.TreeHash}
+	}
+	return r.root, nil
+}
+
+// sync commits the staged tree, if it changed, and advances the reference to the new commit. If
+// the reference moved since the tree was staged, the changes are committed on top of its new
+// commit when they don't overlap with the changes there. Otherwise they're committed on the old one
+// to a conflict reference, the staged tree is reset to the reference's new tree, and sync fails.
+// The reference is only advanced if it's still where the changes were committed on top of, so a
+// concurrent update, like a push, is rebased onto rather than overwritten.
+func (r *writableRef) sync() *fserror.Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.dirty {
+		return nil
+	}
+
+	treeHash, _, err := r.root.writeTree()
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "write tree for %s failed", r.name))
+	}
+	var commitHash plumbing.Hash
+	var commit *object.Commit
+	for {
+		current, err := r.repo.Reference(r.name, true)
+		if err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "find reference %s failed", r.name))
+		}
+		if current.Hash() != r.base.Hash {
+			if ferr := r.rebase(current.Hash(), &treeHash); ferr != nil {
+				return ferr
+			}
+		}
+		if treeHash == r.base.TreeHash {
+			r.dirty = false
+			return nil
+		}
+
+		var ferr *fserror.Error
+		if commitHash, commit, ferr = r.commit(treeHash, r.base.Hash); ferr != nil {
+			return ferr
+		}
+		err = r.repo.Storer.CheckAndSetReference(
+			plumbing.NewHashReference(r.name, commitHash), plumbing.NewHashReference(r.name, r.base.Hash))
+		if err == nil {
+			break
+		} else if err != storage.ErrReferenceHasChanged {
+			return fserror.Unexpected(errors.Wrapf(err, "update reference %s failed", r.name))
+		}
+		r.repo.logger.Info("reference moved while committing; rebasing", "ref", r.name, "parent", r.base.Hash)
+	}
+	if err := r.appendReflog(r.base.Hash, commitHash, commit.Committer, commit.Message); err != nil {
+		return fserror.Unexpected(err)
+	}
+
+	newBase, err := r.repo.CommitObject(commitHash)
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "find new commit %s failed", commitHash))
+	}
+	r.repo.logger.Info("committed changes", "ref", r.name, "hash", commitHash, "parent", r.base.Hash)
+	r.base = newBase
+	r.dirty = false
+	return nil
+}
+
+// rebase moves the staged changes, whose tree is *treeHash, onto the reference's new commit
+// tipHash. On success, the staged tree shows the merged tree, which is stored in *treeHash.
+func (r *writableRef) rebase(tipHash plumbing.Hash, treeHash *plumbing.Hash) *fserror.Error {
+	tip, err := r.repo.CommitObject(tipHash)
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "find commit %s of %s failed", tipHash, r.name))
+	}
+	merged, conflicts, err := mergeTrees(r.repo, r.base.TreeHash, *treeHash, tip.TreeHash)
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "merge changes to %s failed", r.name))
+	}
+
+	if len(conflicts) == 0 {
+		if err := r.root.rebase(merged); err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "update staged tree of %s failed", r.name))
+		}
+		r.repo.logger.Info("rebased changes", "ref", r.name, "from", r.base.Hash, "onto", tip.Hash)
+		r.base = tip
+		*treeHash = merged
+		return nil
+	}
+
+	// Keep the changes where they can be merged by hand, and start over from the new commit so later
+	// syncs don't fail the same way.
+	conflictName := plumbing.ReferenceName(conflictRefPrefix + strings.TrimPrefix(string(r.name), "refs/"))
+	commitHash, _, ferr := r.commit(*treeHash, r.base.Hash)
+	if ferr != nil {
+		return ferr
+	}
+	if err := r.repo.Storer.SetReference(plumbing.NewHashReference(conflictName, commitHash)); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "update reference %s failed", conflictName))
+	}
+	ferr = fserror.Unexpected(errors.Errorf(
+		"%s moved from %s to %s with conflicting changes to %s; staged changes were saved to %s",
+		r.name, r.base.Hash, tip.Hash, strings.Join(conflicts, ", "), conflictName))
+	r.base = tip
+	r.root = &memDir{ref: r, treeHash: tip.TreeHash}
+	r.dirty = false
+	return ferr
+}
+
+// conflictRefPrefix is where staged changes are saved when they conflict with changes to their
+// reference, like refs/gitviewfs/conflicts/heads/scratch/a for refs/heads/scratch/a.
+const conflictRefPrefix = "refs/gitviewfs/conflicts/"
+
+// commit stores a commit of the tree with the given parent.
+func (r *writableRef) commit(treeHash, parent plumbing.Hash) (plumbing.Hash, *object.Commit, *fserror.Error) {
+	signature := r.author
+	signature.When = time.Now()
+	commit := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      fmt.Sprintf("Update %s via gitviewfs\n", r.name.Short()),
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{parent},
+	}
+	obj := r.repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, nil, fserror.Unexpected(errors.Wrap(err, "encode commit failed"))
+	}
+	commitHash, err := r.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, nil, fserror.Unexpected(errors.Wrap(err, "store commit failed"))
+	}
+	return commitHash, commit, nil
+}
+
+// appendReflog records a reference update the way git does, if the repository keeps reflogs.
+func (r *writableRef) appendReflog(oldHash, newHash plumbing.Hash, signature object.Signature, message string) error {
+	storage, ok := r.repo.Storer.(fsBasedStorer)
+	if !ok {
+		return nil
+	}
+	fs := storage.Filesystem()
+	logPath := path.Join(reflogLogsDir, string(r.name))
+	if err := fs.MkdirAll(path.Dir(logPath), 0755); err != nil {
+		return errors.Wrapf(err, "create reflog directory for %s failed", r.name)
+	}
+	f, err := fs.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open reflog for %s failed", r.name)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s %s %s <%s> %d %s\tcommit: %s\n",
+		oldHash, newHash, signature.Name, signature.Email, signature.When.Unix(),
+		signature.When.Format("-0700"), strings.SplitN(message, "\n", 2)[0])
+	return errors.Wrapf(err, "write reflog for %s failed", r.name)
+}
+
+// memDir is a directory in a writable reference's staged tree. Its entries are loaded from
+// treeHash the first time they're needed, so untouched directories are never read.
+type memDir struct {
+	ref    *writableRef
+	parent *memDir
+	// treeHash is the directory's tree before any changes, or zero for new directories.
+	treeHash plumbing.Hash
+	// entries is nil until loaded.
+	entries map[string]fstree.Node
+	// opaque holds entries that aren't shown, like submodules, so they're kept when committing.
+	opaque map[string]object.TreeEntry
+}
+
+var _ fstree.WritableDirNode = (*memDir)(nil)
+var _ fstree.Syncer = (*memDir)(nil)
+
+func (d *memDir) load() *fserror.Error {
+	if d.entries != nil {
+		return nil
+	}
+	entries := map[string]fstree.Node{}
+	opaque := map[string]object.TreeEntry{}
+	if d.treeHash != plumbing.ZeroHash {
+		tree, err := d.ref.repo.TreeObject(d.treeHash)
+		if err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "find tree %s failed", d.treeHash))
+		}
+		for i := range tree.Entries {
+			treeEntry := &tree.Entries[i]
+			switch treeEntry.Mode {
+			case filemode.Dir:
+				entries[treeEntry.Name] = &memDir{ref: d.ref, parent: d, treeHash: treeEntry.Hash}
+
+			case filemode.Regular, filemode.Executable, filemode.Symlink:
+				file, err := tree.TreeEntryFile(treeEntry)
+				if err != nil {
+					return fserror.Unexpected(err)
+				}
+				entries[treeEntry.Name] = &memFile{ref: d.ref, name: treeEntry.Name, mode: treeEntry.Mode, base: file}
+
+			default:
+				opaque[treeEntry.Name] = *treeEntry
+			}
+		}
+	}
+	d.entries = entries
+	d.opaque = opaque
+	return nil
+}
+
+func (d *memDir) Children() (map[string]fstree.Node, *fserror.Error) {
+	d.ref.mu.Lock()
+	defer d.ref.mu.Unlock()
+
+	if ferr := d.load(); ferr != nil {
+		return nil, ferr
+	}
+	children := make(map[string]fstree.Node, len(d.entries)+1)
+	for name, child := range d.entries {
+		children[name] = child
+	}
+	if d.parent == nil {
+		metadata := commitMetadata(d.ref.repo, d.ref.base)
+		metadata["sync"] = &syncFileNode{ref: d.ref}
+		children[".gitviewfs"] = &staticDirNode{children: metadata}
+	}
+	return children, nil
+}
+
+// checkNewName returns an error if name can't be added to the directory.
+func (d *memDir) checkNewName(name string) *fserror.Error {
+	if d.parent == nil && name == ".gitviewfs" {
+		return fserror.Expected(fuse.EPERM)
+	}
+	if _, ok := d.entries[name]; ok {
+		return fserror.Expected(fuse.Status(syscall.EEXIST))
+	}
+	return nil
+}
+
+func (d *memDir) CreateFile(name string, mode filemode.FileMode) (fstree.WritableFileNode, *fserror.Error) {
+	d.ref.mu.Lock()
+	defer d.ref.mu.Unlock()
+
+	if ferr := d.load(); ferr != nil {
+		return nil, ferr
+	}
+	if ferr := d.checkNewName(name); ferr != nil {
+		return nil, ferr
+	}
+	file := &memFile{ref: d.ref, name: name, mode: mode, contents: []byte{}}
+	d.entries[name] = file
+	delete(d.opaque, name)
+	d.ref.dirty = true
+	return file, nil
+}
+
+func (d *memDir) CreateSymlink(name string, target string) *fserror.Error {
+	d.ref.mu.Lock()
+	defer d.ref.mu.Unlock()
+
+	if ferr := d.load(); ferr != nil {
+		return ferr
+	}
+	if ferr := d.checkNewName(name); ferr != nil {
+		return ferr
+	}
+	d.entries[name] = &memFile{ref: d.ref, name: name, mode: filemode.Symlink, contents: []byte(target)}
+	delete(d.opaque, name)
+	d.ref.dirty = true
+	return nil
+}
+
+func (d *memDir) Mkdir(name string) *fserror.Error {
+	d.ref.mu.Lock()
+	defer d.ref.mu.Unlock()
+
+	if ferr := d.load(); ferr != nil {
+		return ferr
+	}
+	if ferr := d.checkNewName(name); ferr != nil {
+		return ferr
+	}
+	d.entries[name] = &memDir{ref: d.ref, parent: d, entries: map[string]fstree.Node{}, opaque: map[string]object.TreeEntry{}}
+	delete(d.opaque, name)
+	d.ref.dirty = true
+	return nil
+}
+
+func (d *memDir) Remove(name string) *fserror.Error {
+	d.ref.mu.Lock()
+	defer d.ref.mu.Unlock()
+
+	if ferr := d.load(); ferr != nil {
+		return ferr
+	}
+	child, ok := d.entries[name]
+	if !ok {
+		return fserror.Expected(fuse.ENOENT)
+	}
+	if childDir, ok := child.(*memDir); ok {
+		if ferr := childDir.load(); ferr != nil {
+			return ferr
+		}
+		if len(childDir.entries)+len(childDir.opaque) > 0 {
+			return fserror.Expected(fuse.Status(syscall.ENOTEMPTY))
+		}
+	}
+	delete(d.entries, name)
+	d.ref.dirty = true
+	return nil
+}
+
+func (d *memDir) Rename(oldName string, newDir fstree.WritableDirNode, newName string) *fserror.Error {
+	target, ok := newDir.(*memDir)
+	if !ok || target.ref != d.ref {
+		return fserror.Expected(fuse.EXDEV)
+	}
+
+	d.ref.mu.Lock()
+	defer d.ref.mu.Unlock()
+
+	if ferr := d.load(); ferr != nil {
+		return ferr
+	}
+	if ferr := target.load(); ferr != nil {
+		return ferr
+	}
+	child, ok := d.entries[oldName]
+	if !ok {
+		return fserror.Expected(fuse.ENOENT)
+	}
+	if target.parent == nil && newName == ".gitviewfs" {
+		return fserror.Expected(fuse.EPERM)
+	}
+
+	childDir, childIsDir := child.(*memDir)
+	if childIsDir {
+		// A directory can't be moved inside itself.
+		for ancestor := target; ancestor != nil; ancestor = ancestor.parent {
+			if ancestor == childDir {
+				return fserror.Expected(fuse.EINVAL)
+			}
+		}
+	}
+	if existing, ok := target.entries[newName]; ok {
+		existingDir, existingIsDir := existing.(*memDir)
+		switch {
+		case existing == child:
+			return nil
+		case childIsDir && !existingIsDir:
+			return fserror.Expected(fuse.ENOTDIR)
+		case !childIsDir && existingIsDir:
+			return fserror.Expected(fuse.EISDIR)
+		case existingIsDir:
+			if ferr := existingDir.load(); ferr != nil {
+				return ferr
+			}
+			if len(existingDir.entries)+len(existingDir.opaque) > 0 {
+				return fserror.Expected(fuse.Status(syscall.ENOTEMPTY))
+			}
+		}
+	}
+
+	delete(d.entries, oldName)
+	target.entries[newName] = child
+	delete(target.opaque, newName)
+	if childIsDir {
+		childDir.parent = target
+	} else {
+		childFile := child.(*memFile)
+		childFile.name = newName
+		childFile.file = nil
+	}
+	d.ref.dirty = true
+	return nil
+}
+
+func (d *memDir) Sync() *fserror.Error {
+	return d.ref.sync()
+}
+
+// writeTree stores the directory's tree in the repository, returning its hash and number of
+// entries. Empty subdirectories can't be represented in git, so callers skip them.
+func (d *memDir) writeTree() (plumbing.Hash, int, error) {
+	if d.entries == nil {
+		return d.treeHash, -1, nil
+	}
+
+	var entries []object.TreeEntry
+	for name, child := range d.entries {
+		switch c := child.(type) {
+		case *memDir:
+			hash, n, err := c.writeTree()
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			if n == 0 {
+				continue
+			}
+			entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash})
+
+		case *memFile:
+			hash, err := c.writeBlob()
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			entries = append(entries, object.TreeEntry{Name: name, Mode: c.mode, Hash: hash})
+		}
+	}
+	for _, entry := range d.opaque {
+		entries = append(entries, entry)
+	}
+	// Git orders tree entries by name, comparing directories as if their names ended in "/".
+	sort.Slice(entries, func(i, j int) bool {
+		return treeEntrySortName(entries[i]) < treeEntrySortName(entries[j])
+	})
+
+	tree := &object.Tree{Entries: entries}
+	obj := d.ref.repo.Storer.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, 0, errors.Wrap(err, "encode tree failed")
+	}
+	hash, err := d.ref.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, 0, errors.Wrap(err, "store tree failed")
+	}
+	return hash, len(entries), nil
+}
+
+// rebase makes the directory show the tree merged, which is the directory's tree with other changes
+// merged in. Nodes are kept for entries that are still there, so open files stay attached.
+func (d *memDir) rebase(merged plumbing.Hash) error {
+	if d.entries == nil {
+		d.treeHash = merged
+		return nil
+	}
+	tree, err := d.ref.repo.TreeObject(merged)
+	if err != nil {
+		return errors.Wrapf(err, "find tree %s failed", merged)
+	}
+
+	entries := map[string]fstree.Node{}
+	opaque := map[string]object.TreeEntry{}
+	for i := range tree.Entries {
+		treeEntry := &tree.Entries[i]
+		switch treeEntry.Mode {
+		case filemode.Dir:
+			dir, ok := d.entries[treeEntry.Name].(*memDir)
+			if !ok {
+				dir = &memDir{ref: d.ref, parent: d}
+			}
+			if err := dir.rebase(treeEntry.Hash); err != nil {
+				return err
+			}
+			entries[treeEntry.Name] = dir
+
+		case filemode.Regular, filemode.Executable, filemode.Symlink:
+			file, ok := d.entries[treeEntry.Name].(*memFile)
+			ok = ok && file.mode == treeEntry.Mode
+			if ok {
+				hash, err := file.writeBlob()
+				if err != nil {
+					return err
+				}
+				ok = hash == treeEntry.Hash
+			}
+			if !ok {
+				base, err := tree.TreeEntryFile(treeEntry)
+				if err != nil {
+					return err
+				}
+				if file == nil {
+					file = &memFile{ref: d.ref, name: treeEntry.Name}
+				}
+				file.mode, file.base, file.contents, file.file = treeEntry.Mode, base, nil, nil
+			}
+			entries[treeEntry.Name] = file
+
+		default:
+			opaque[treeEntry.Name] = *treeEntry
+		}
+	}
+	d.treeHash = merged
+	d.entries = entries
+	d.opaque = opaque
+	return nil
+}
+
+func treeEntrySortName(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return entry.Name + "/"
+	}
+	return entry.Name
+}
+
+// maxStagedFileSize bounds the files in staged trees, which are held in memory until they're
+// committed.
+const maxStagedFileSize = 256 << 20
+
+// memFile is a file in a writable reference's staged tree. Until it's changed, its contents are
+// read from base.
+type memFile struct {
+	ref  *writableRef
+	name string
+	mode filemode.FileMode
+	// base is the unchanged file, or nil once contents holds the file's data.
+	base     *object.File
+	contents []byte
+	// file caches File's result for changed files.
+	file *object.File
+}
+
+var _ fstree.WritableFileNode = (*memFile)(nil)
+var _ fstree.Syncer = (*memFile)(nil)
+
+func (f *memFile) File() *object.File {
+	f.ref.mu.Lock()
+	defer f.ref.mu.Unlock()
+
+	if f.base != nil {
+		if f.base.Mode != f.mode || f.base.Name != f.name {
+			return object.NewFile(f.name, f.mode, &f.base.Blob)
+		}
+		return f.base
+	}
+	if f.file == nil {
+		f.file = NewMemoryFile(f.name, f.mode, f.contents)
+	}
+	return f.file
+}
+
+// loadContents reads the base file into contents, so it can be changed.
+func (f *memFile) loadContents() *fserror.Error {
+	if f.base == nil {
+		return nil
+	}
+	reader, err := f.base.Reader()
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "open file %s failed", f.base.Hash))
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "read file %s failed", f.base.Hash))
+	}
+	f.contents = contents
+	f.base = nil
+	return nil
+}
+
+func (f *memFile) WriteAt(data []byte, off int64) (int, *fserror.Error) {
+	f.ref.mu.Lock()
+	defer f.ref.mu.Unlock()
+
+	if off+int64(len(data)) > maxStagedFileSize {
+		return 0, fserror.Expected(fuse.Status(syscall.EFBIG))
+	}
+	if ferr := f.loadContents(); ferr != nil {
+		return 0, ferr
+	}
+	if end := off + int64(len(data)); end > int64(len(f.contents)) {
+		f.contents = append(f.contents, make([]byte, end-int64(len(f.contents)))...)
+	}
+	copy(f.contents[off:], data)
+	f.file = nil
+	f.ref.dirty = true
+	return len(data), nil
+}
+
+func (f *memFile) Truncate(size int64) *fserror.Error {
+	f.ref.mu.Lock()
+	defer f.ref.mu.Unlock()
+
+	if size > maxStagedFileSize {
+		return fserror.Expected(fuse.Status(syscall.EFBIG))
+	}
+	if ferr := f.loadContents(); ferr != nil {
+		return ferr
+	}
+	if size <= int64(len(f.contents)) {
+		f.contents = f.contents[:size]
+	} else {
+		f.contents = append(f.contents, make([]byte, size-int64(len(f.contents)))...)
+	}
+	f.file = nil
+	f.ref.dirty = true
+	return nil
+}
+
+func (f *memFile) SetMode(mode filemode.FileMode) *fserror.Error {
+	f.ref.mu.Lock()
+	defer f.ref.mu.Unlock()
+
+	if f.mode == filemode.Symlink || (mode != filemode.Regular && mode != filemode.Executable) {
+		return fserror.Expected(fuse.EPERM)
+	}
+	if f.mode != mode {
+		f.mode = mode
+		f.file = nil
+		f.ref.dirty = true
+	}
+	return nil
+}
+
+func (f *memFile) Sync() *fserror.Error {
+	return f.ref.sync()
+}
+
+// writeBlob stores the file's contents in the repository, returning its hash.
+func (f *memFile) writeBlob() (plumbing.Hash, error) {
+	if f.base != nil {
+		return f.base.Hash, nil
+	}
+	obj := f.ref.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(f.contents)))
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrap(err, "create blob writer failed")
+	}
+	if _, err := writer.Write(f.contents); err != nil {
+		writer.Close()
+		return plumbing.ZeroHash, errors.Wrap(err, "write blob failed")
+	}
+	if err := writer.Close(); err != nil {
+		return plumbing.ZeroHash, errors.Wrap(err, "write blob failed")
+	}
+	hash, err := f.ref.repo.Storer.SetEncodedObject(obj)
+	return hash, errors.Wrap(err, "store blob failed")
+}
+
+// syncFileNode is the .gitviewfs/sync file of a writable reference. Writing to it commits the
+// staged changes.
+type syncFileNode struct {
+	ref *writableRef
+}
+
+var _ fstree.WritableFileNode = (*syncFileNode)(nil)
+
+func (n *syncFileNode) File() *object.File {
+	return NewMemoryFile("sync", filemode.Regular, nil)
+}
+
+func (n *syncFileNode) WriteAt(data []byte, off int64) (int, *fserror.Error) {
+	if ferr := n.ref.sync(); ferr != nil {
+		return 0, ferr
+	}
+	return len(data), nil
+}
+
+func (n *syncFileNode) Truncate(size int64) *fserror.Error {
+	return nil
+}
+
+func (n *syncFileNode) SetMode(mode filemode.FileMode) *fserror.Error {
+	return fserror.Expected(fuse.EPERM)
+}
+
+func (n *syncFileNode) Sync() *fserror.Error {
+	return n.ref.sync()
+}
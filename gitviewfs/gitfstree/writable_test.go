@@ -0,0 +1,193 @@
+package gitfstree
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testRefName = plumbing.ReferenceName("refs/heads/scratch")
+
+// storeCommit stores a commit of regular files with the given contents, and returns its hash.
+func storeCommit(t *testing.T, repo *repository, files map[string]string, parents ...plumbing.Hash) plumbing.Hash {
+	tree := &object.Tree{}
+	for name, contents := range files {
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: storeBlob(t, repo, contents)})
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return tree.Entries[i].Name < tree.Entries[j].Name })
+	signature := object.Signature{Name: "A", Email: "a@example.com", When: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	return storeObject(t, repo, &object.Commit{
+		TreeHash:     storeObject(t, repo, tree),
+		Author:       signature,
+		Committer:    signature,
+		Message:      "commit\n",
+		ParentHashes: parents,
+	})
+}
+
+func setTestRef(t *testing.T, repo *repository, hash plumbing.Hash) {
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(testRefName, hash)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestWritableRef returns a writable reference to a commit of files, and its staged tree.
+func newTestWritableRef(t *testing.T, files map[string]string) (*repository, *writableRef, *memDir) {
+	repo := newTestRepository(t)
+	base := storeCommit(t, repo, files)
+	setTestRef(t, repo, base)
+	ref := &writableRef{repo: repo, name: testRefName}
+	root, ferr := ref.rootNode(base)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	return repo, ref, root.(*memDir)
+}
+
+// writeFile replaces the contents of the staged file called name.
+func writeFile(t *testing.T, dir *memDir, name, contents string) {
+	child, ferr := fstree.Child(dir, name)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	file := child.(fstree.WritableFileNode)
+	if ferr := file.Truncate(0); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if _, ferr := file.WriteAt([]byte(contents), 0); ferr != nil {
+		t.Fatal(ferr)
+	}
+}
+
+// checkCommit checks that the commit at hash has the given parent and file contents.
+func checkCommit(t *testing.T, repo *repository, hash, parent plumbing.Hash, files map[string]string) {
+	t.Helper()
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commit.ParentHashes) != 1 || commit.ParentHashes[0] != parent {
+		t.Errorf("%s: got parents %v, want %s", hash, commit.ParentHashes, parent)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Entries) != len(files) {
+		t.Errorf("%s: got %d files, want %d", hash, len(tree.Entries), len(files))
+	}
+	for name, want := range files {
+		file, err := tree.File(name)
+		if err != nil {
+			t.Errorf("%s: %s: %v", hash, name, err)
+			continue
+		}
+		if got, err := file.Contents(); err != nil || got != want {
+			t.Errorf("%s: %s: got %q and error %v, want %q", hash, name, got, err, want)
+		}
+	}
+}
+
+func refHash(t *testing.T, repo *repository, name plumbing.ReferenceName) plumbing.Hash {
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref.Hash()
+}
+
+func TestWritableSync(t *testing.T) {
+	repo, ref, root := newTestWritableRef(t, map[string]string{"a": "a\n", "b": "b\n"})
+	base := refHash(t, repo, testRefName)
+
+	writeFile(t, root, "a", "changed\n")
+	if _, ferr := root.CreateFile("new", filemode.Regular); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if ferr := root.Sync(); ferr != nil {
+		t.Fatal(ferr)
+	}
+	synced := refHash(t, repo, testRefName)
+	checkCommit(t, repo, synced, base, map[string]string{"a": "changed\n", "b": "b\n", "new": ""})
+
+	// Syncing again without changes doesn't commit.
+	if ferr := ref.sync(); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got := refHash(t, repo, testRefName); got != synced {
+		t.Errorf("got %s after syncing again, want %s", got, synced)
+	}
+}
+
+func TestWritableSyncRebase(t *testing.T) {
+	repo, _, root := newTestWritableRef(t, map[string]string{"a": "a\n", "b": "b\n"})
+	base := refHash(t, repo, testRefName)
+
+	writeFile(t, root, "a", "ours\n")
+	// The reference moves with a change that doesn't overlap.
+	tip := storeCommit(t, repo, map[string]string{"a": "a\n", "b": "theirs\n"}, base)
+	setTestRef(t, repo, tip)
+
+	if ferr := root.Sync(); ferr != nil {
+		t.Fatal(ferr)
+	}
+	checkCommit(t, repo, refHash(t, repo, testRefName), tip, map[string]string{"a": "ours\n", "b": "theirs\n"})
+	b, ferr := fstree.Child(root, "b")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got, err := b.(fstree.FileNode).File().Contents(); err != nil || got != "theirs\n" {
+		t.Errorf("staged b: got %q and error %v", got, err)
+	}
+}
+
+func TestWritableSyncConflict(t *testing.T) {
+	repo, _, root := newTestWritableRef(t, map[string]string{"a": "a\n"})
+	base := refHash(t, repo, testRefName)
+
+	writeFile(t, root, "a", "ours\n")
+	tip := storeCommit(t, repo, map[string]string{"a": "theirs\n"}, base)
+	setTestRef(t, repo, tip)
+
+	if ferr := root.Sync(); ferr == nil {
+		t.Fatal("got no error")
+	}
+	if got := refHash(t, repo, testRefName); got != tip {
+		t.Errorf("got %s, want the reference left at %s", got, tip)
+	}
+	// The staged changes are kept on the old commit, and staging starts over from the new one.
+	conflict := refHash(t, repo, plumbing.ReferenceName(conflictRefPrefix+"heads/scratch"))
+	checkCommit(t, repo, conflict, base, map[string]string{"a": "ours\n"})
+	a, ferr := fstree.Child(root.ref.root, "a")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got, err := a.(fstree.FileNode).File().Contents(); err != nil || got != "theirs\n" {
+		t.Errorf("staged a: got %q and error %v", got, err)
+	}
+}
+
+func TestMemFileTooBig(t *testing.T) {
+	_, _, root := newTestWritableRef(t, map[string]string{"a": "a\n"})
+	child, ferr := fstree.Child(root, "a")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	file := child.(fstree.WritableFileNode)
+
+	if _, ferr := file.WriteAt([]byte("x"), maxStagedFileSize); ferr == nil || ferr.Status != fuse.Status(syscall.EFBIG) {
+		t.Errorf("write past the limit: got %v", ferr)
+	}
+	if ferr := file.Truncate(maxStagedFileSize + 1); ferr == nil || ferr.Status != fuse.Status(syscall.EFBIG) {
+		t.Errorf("truncate past the limit: got %v", ferr)
+	}
+	if got, err := file.File().Contents(); err != nil || got != "a\n" {
+		t.Errorf("got %q and error %v, want the file unchanged", got, err)
+	}
+}
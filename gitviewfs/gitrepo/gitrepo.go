@@ -0,0 +1,271 @@
+// Package gitrepo finds and opens git repositories in the layouts git itself supports: working
+// trees with a .git directory, bare repositories, linked worktrees whose .git is a "gitdir:" file,
+// explicit git directories (like git's --git-dir and GIT_DIR) and object alternates.
+package gitrepo
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxAlternatesDepth limits how deeply alternates of alternates are followed, matching git.
+const maxAlternatesDepth = 5
+
+// Options overrides repository discovery. The zero value discovers everything from the path.
+type Options struct {
+	// GitDir is the git directory to use instead of discovering one, like git's --git-dir.
+	GitDir string
+	// CommonDir is the directory holding objects and references shared by linked worktrees, like
+	// GIT_COMMON_DIR. By default it's read from the git directory's commondir file, if any.
+	CommonDir string
+	// CeilingDirectories stop discovery from looking in them or their parents for a repository,
+	// like GIT_CEILING_DIRECTORIES.
+	CeilingDirectories []string
+}
+
+// OptionsFromEnv returns Options set from the GIT_DIR, GIT_COMMON_DIR and GIT_CEILING_DIRECTORIES
+// environment variables.
+func OptionsFromEnv() Options {
+	var ceilings []string
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_CEILING_DIRECTORIES")) {
+		if dir != "" {
+			ceilings = append(ceilings, dir)
+		}
+	}
+	return Options{
+		GitDir:             os.Getenv("GIT_DIR"),
+		CommonDir:          os.Getenv("GIT_COMMON_DIR"),
+		CeilingDirectories: ceilings,
+	}
+}
+
+// Layout describes where a repository's files are.
+type Layout struct {
+	// GitDir is the repository's git directory. For linked worktrees it's the worktree's private
+	// directory, like /repo/.git/worktrees/name.
+	GitDir string
+	// CommonDir holds the objects and references. It's the same as GitDir except for linked
+	// worktrees.
+	CommonDir string
+	// WorkTree is the working tree directory, or empty for bare repositories.
+	WorkTree string
+}
+
+// Discover finds the layout of the repository at path or, like git, the nearest of its parent
+// directories holding one. It returns git.ErrRepositoryNotExists if there's none.
+func Discover(path string, opts Options) (*Layout, error) {
+	var layout *Layout
+	if opts.GitDir != "" {
+		layout = &Layout{GitDir: opts.GitDir, WorkTree: path}
+		if !isGitDir(layout.GitDir) {
+			return nil, git.ErrRepositoryNotExists
+		}
+	} else {
+		dir, err := filepath.Abs(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve %s failed", path)
+		}
+		for {
+			layout, err = discoverAt(dir)
+			if err != nil {
+				return nil, err
+			} else if layout != nil {
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir || isCeiling(parent, opts.CeilingDirectories) {
+				return nil, git.ErrRepositoryNotExists
+			}
+			dir = parent
+		}
+	}
+
+	layout.CommonDir = opts.CommonDir
+	if layout.CommonDir == "" {
+		commonDir, err := readCommonDirFile(layout.GitDir)
+		if err != nil {
+			return nil, err
+		}
+		layout.CommonDir = commonDir
+	}
+	return layout, nil
+}
+
+// discoverAt returns the layout of the repository whose working tree or bare git directory is dir,
+// without looking in parent directories, or nil if dir isn't one. Its CommonDir isn't set.
+func discoverAt(dir string) (*Layout, error) {
+	dotGit := filepath.Join(dir, ".git")
+	info, err := os.Stat(dotGit)
+	switch {
+	case err == nil && info.IsDir():
+		if !isGitDir(dotGit) {
+			return nil, nil
+		}
+		return &Layout{GitDir: dotGit, WorkTree: dir}, nil
+	case err == nil:
+		gitDir, err := readGitDirFile(dotGit)
+		if err != nil {
+			return nil, err
+		}
+		if !isGitDir(gitDir) {
+			return nil, errors.Errorf("%s names %s, which isn't a git directory", dotGit, gitDir)
+		}
+		return &Layout{GitDir: gitDir, WorkTree: dir}, nil
+	case os.IsNotExist(err):
+		// Bare repositories have no .git, and the directory itself is the git directory.
+		if !isGitDir(dir) {
+			return nil, nil
+		}
+		return &Layout{GitDir: dir}, nil
+	default:
+		return nil, errors.Wrapf(err, "stat %s failed", dotGit)
+	}
+}
+
+// isCeiling reports whether discovery should stop before looking in dir.
+func isCeiling(dir string, ceilings []string) bool {
+	for _, ceiling := range ceilings {
+		if abs, err := filepath.Abs(ceiling); err == nil && abs == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Open opens the repository at path, as described by Discover.
+func Open(path string, opts Options) (*git.Repository, error) {
+	layout, err := Discover(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return OpenLayout(layout)
+}
+
+// OpenLayout opens the repository with the given layout.
+func OpenLayout(layout *Layout) (*git.Repository, error) {
+	var fs billy.Filesystem = osfs.New(layout.CommonDir)
+	if filepath.Clean(layout.GitDir) != filepath.Clean(layout.CommonDir) {
+		fs = &worktreeFS{Filesystem: fs, private: osfs.New(layout.GitDir)}
+	}
+
+	storage, err := newStorage(fs, layout.CommonDir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var workTree billy.Filesystem
+	if layout.WorkTree != "" {
+		workTree = osfs.New(layout.WorkTree)
+	}
+	return git.Open(storage, workTree)
+}
+
+// newStorage returns storage for the git directory in fs, falling back to the repository's
+// alternates for objects it doesn't have.
+func newStorage(fs billy.Filesystem, commonDir string, depth int) (*alternatesStorage, error) {
+	storage, err := filesystem.NewStorage(fs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open storage at %s failed", commonDir)
+	}
+
+	alternates, err := readAlternates(commonDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &alternatesStorage{Storage: storage}
+	if depth >= maxAlternatesDepth {
+		return s, nil
+	}
+	for _, objectsDir := range alternates {
+		// Alternates name object directories; their storage is rooted at the parent.
+		altDir := filepath.Dir(objectsDir)
+		alt, err := newStorage(osfs.New(altDir), altDir, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		s.alternates = append(s.alternates, alt)
+	}
+	return s, nil
+}
+
+// isGitDir reports whether dir looks like a git directory. Like git, it checks for HEAD and an
+// objects directory (which linked worktrees keep in their common directory instead).
+func isGitDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(dir, "commondir")); err == nil {
+		return true
+	}
+	info, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && info.IsDir()
+}
+
+// readGitDirFile returns the git directory named by a .git file containing "gitdir: <path>".
+func readGitDirFile(dotGit string) (string, error) {
+	contents, err := ioutil.ReadFile(dotGit)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s failed", dotGit)
+	}
+	line := strings.TrimSpace(string(contents))
+	const prefix = "gitdir:"
+	if !strings.HasPrefix(line, prefix) {
+		return "", errors.Errorf("malformed .git file %s: %q", dotGit, line)
+	}
+	return resolvePath(filepath.Dir(dotGit), strings.TrimSpace(strings.TrimPrefix(line, prefix))), nil
+}
+
+// readCommonDirFile returns the common directory named by gitDir's commondir file, or gitDir if
+// there isn't one.
+func readCommonDirFile(gitDir string) (string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if os.IsNotExist(err) {
+		return gitDir, nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "read commondir in %s failed", gitDir)
+	}
+	return resolvePath(gitDir, strings.TrimSpace(string(contents))), nil
+}
+
+// readAlternates returns the object directories listed in commonDir's objects/info/alternates.
+func readAlternates(commonDir string) ([]string, error) {
+	objectsDir := filepath.Join(commonDir, "objects")
+	f, err := os.Open(filepath.Join(objectsDir, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "open alternates in %s failed", commonDir)
+	}
+	defer f.Close()
+
+	var alternates []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		alternates = append(alternates, resolvePath(objectsDir, line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read alternates in %s failed", commonDir)
+	}
+	return alternates, nil
+}
+
+// resolvePath interprets p relative to base, unless it's absolute.
+func resolvePath(base, p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(base, p)
+}
@@ -0,0 +1,99 @@
+package gitrepo
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiscoverDir finds the repositories that are immediate children of dir, keyed by name. Bare
+// repositories named like name.git are keyed by name. Children that aren't repositories are
+// skipped, rather than found in dir or its parents.
+func DiscoverDir(dir string) (map[string]*Layout, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list repositories in %s failed", dir)
+	}
+
+	layouts := map[string]*Layout{}
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		layout, err := discoverAt(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		} else if layout == nil {
+			continue
+		}
+		if layout.CommonDir, err = readCommonDirFile(layout.GitDir); err != nil {
+			return nil, err
+		}
+
+		name := info.Name()
+		if layout.WorkTree == "" {
+			name = strings.TrimSuffix(name, ".git")
+		}
+		if _, ok := layouts[name]; ok {
+			return nil, errors.Errorf("duplicate repository name %s in %s", name, dir)
+		}
+		layouts[name] = layout
+	}
+	return layouts, nil
+}
+
+// ReadList reads a file listing repositories, one per line as "<name> <path>". Blank lines and
+// lines starting with # are ignored, and relative paths are relative to the file's directory.
+func ReadList(filename string) (map[string]*Layout, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open repository list %s failed", filename)
+	}
+	defer f.Close()
+
+	layouts := map[string]*Layout{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected \"<name> <path>\", got %q", filename, lineNum, line)
+		}
+
+		name, path := fields[0], resolvePath(filepath.Dir(filename), fields[1])
+		if _, ok := layouts[name]; ok {
+			return nil, errors.Errorf("%s:%d: duplicate repository name %s", filename, lineNum, name)
+		}
+		layout, err := Discover(path, Options{})
+		if err == git.ErrRepositoryNotExists {
+			return nil, errors.Errorf("%s:%d: no git repository found: %s", filename, lineNum, path)
+		} else if err != nil {
+			return nil, err
+		}
+		layouts[name] = layout
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read repository list %s failed", filename)
+	}
+	return layouts, nil
+}
+
+// OpenAll opens each of the repositories.
+func OpenAll(layouts map[string]*Layout) (map[string]*git.Repository, error) {
+	repos := make(map[string]*git.Repository, len(layouts))
+	for name, layout := range layouts {
+		repo, err := OpenLayout(layout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open repository %s failed", name)
+		}
+		repos[name] = repo
+	}
+	return repos, nil
+}
@@ -0,0 +1,263 @@
+package gitrepo
+
+import (
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/helper/chroot"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// alternatesStorage looks up objects in its alternates when the repository itself doesn't have
+// them, and includes the alternates' objects when iterating. New objects are only written to the
+// repository itself.
+type alternatesStorage struct {
+	*filesystem.Storage
+	alternates []*alternatesStorage
+}
+
+func (s *alternatesStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storage.EncodedObject(t, h)
+	if err != plumbing.ErrObjectNotFound {
+		return obj, err
+	}
+	for _, alt := range s.alternates {
+		obj, err := alt.EncodedObject(t, h)
+		if err != plumbing.ErrObjectNotFound {
+			return obj, err
+		}
+	}
+	return nil, plumbing.ErrObjectNotFound
+}
+
+func (s *alternatesStorage) DeltaObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storage.DeltaObject(t, h)
+	if err != plumbing.ErrObjectNotFound {
+		return obj, err
+	}
+	for _, alt := range s.alternates {
+		obj, err := alt.DeltaObject(t, h)
+		if err != plumbing.ErrObjectNotFound {
+			return obj, err
+		}
+	}
+	return nil, plumbing.ErrObjectNotFound
+}
+
+func (s *alternatesStorage) HasEncodedObject(h plumbing.Hash) error {
+	err := s.Storage.HasEncodedObject(h)
+	if err != plumbing.ErrObjectNotFound {
+		return err
+	}
+	for _, alt := range s.alternates {
+		if err := alt.HasEncodedObject(h); err != plumbing.ErrObjectNotFound {
+			return err
+		}
+	}
+	return plumbing.ErrObjectNotFound
+}
+
+func (s *alternatesStorage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size, err := s.Storage.EncodedObjectSize(h)
+	if err != plumbing.ErrObjectNotFound {
+		return size, err
+	}
+	for _, alt := range s.alternates {
+		size, err := alt.EncodedObjectSize(h)
+		if err != plumbing.ErrObjectNotFound {
+			return size, err
+		}
+	}
+	return 0, plumbing.ErrObjectNotFound
+}
+
+// IterEncodedObjects iterates over the objects of type t in the repository and then its
+// alternates, skipping objects already seen.
+func (s *alternatesStorage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	iter, err := s.Storage.IterEncodedObjects(t)
+	if err != nil || len(s.alternates) == 0 {
+		return iter, err
+	}
+	iters := []storer.EncodedObjectIter{iter}
+	for _, alt := range s.alternates {
+		altIter, err := alt.IterEncodedObjects(t)
+		if err != nil {
+			for _, iter := range iters {
+				iter.Close()
+			}
+			return nil, err
+		}
+		iters = append(iters, altIter)
+	}
+	return &uniqueObjectIter{
+		EncodedObjectIter: storer.NewMultiEncodedObjectIter(iters),
+		seen:              map[plumbing.Hash]bool{},
+	}, nil
+}
+
+// uniqueObjectIter skips objects its iterator has already returned, such as objects both a
+// repository and its alternate have.
+type uniqueObjectIter struct {
+	storer.EncodedObjectIter
+	seen map[plumbing.Hash]bool
+}
+
+func (iter *uniqueObjectIter) Next() (plumbing.EncodedObject, error) {
+	for {
+		obj, err := iter.EncodedObjectIter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !iter.seen[obj.Hash()] {
+			iter.seen[obj.Hash()] = true
+			return obj, nil
+		}
+	}
+}
+
+func (iter *uniqueObjectIter) ForEach(cb func(plumbing.EncodedObject) error) error {
+	defer iter.Close()
+	for {
+		obj, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := cb(obj); err == storer.ErrStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// worktreePrivatePaths are the files a linked worktree keeps in its own git directory rather than
+// the common directory. Paths under a listed directory are private too.
+var worktreePrivatePaths = []string{
+	"HEAD",
+	"ORIG_HEAD",
+	"FETCH_HEAD",
+	"MERGE_HEAD",
+	"CHERRY_PICK_HEAD",
+	"index",
+	"logs/HEAD",
+	"refs/bisect",
+	"refs/rewritten",
+	"refs/worktree",
+}
+
+// worktreeFS presents a linked worktree's git directory and its common directory as a single git
+// directory, which is the layout go-git expects.
+type worktreeFS struct {
+	// Filesystem is the common directory.
+	billy.Filesystem
+	// private is the worktree's own git directory.
+	private billy.Filesystem
+}
+
+func (fs *worktreeFS) route(filename string) billy.Filesystem {
+	filename = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(filename)), "/")
+	for _, p := range worktreePrivatePaths {
+		if filename == p || strings.HasPrefix(filename, p+"/") {
+			return fs.private
+		}
+	}
+	return fs.Filesystem
+}
+
+func (fs *worktreeFS) Create(filename string) (billy.File, error) {
+	return fs.route(filename).Create(filename)
+}
+
+func (fs *worktreeFS) Open(filename string) (billy.File, error) {
+	return fs.route(filename).Open(filename)
+}
+
+func (fs *worktreeFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	return fs.route(filename).OpenFile(filename, flag, perm)
+}
+
+func (fs *worktreeFS) Stat(filename string) (os.FileInfo, error) {
+	return fs.route(filename).Stat(filename)
+}
+
+func (fs *worktreeFS) Lstat(filename string) (os.FileInfo, error) {
+	return fs.route(filename).Lstat(filename)
+}
+
+func (fs *worktreeFS) Readlink(link string) (string, error) {
+	return fs.route(link).Readlink(link)
+}
+
+func (fs *worktreeFS) Remove(filename string) error {
+	return fs.route(filename).Remove(filename)
+}
+
+func (fs *worktreeFS) Symlink(target, link string) error {
+	return fs.route(link).Symlink(target, link)
+}
+
+func (fs *worktreeFS) MkdirAll(filename string, perm os.FileMode) error {
+	return fs.route(filename).MkdirAll(filename, perm)
+}
+
+// TempFile creates the file in the directory that a file named like prefix in dir would belong
+// to, so it can be renamed into place.
+func (fs *worktreeFS) TempFile(dir, prefix string) (billy.File, error) {
+	return fs.route(path.Join(filepath.ToSlash(dir), prefix)).TempFile(dir, prefix)
+}
+
+// Rename renames within the common or the worktree's directory. Renaming between them fails with
+// os.ErrInvalid, since they may be on different filesystems.
+func (fs *worktreeFS) Rename(oldpath, newpath string) error {
+	from, to := fs.route(oldpath), fs.route(newpath)
+	if from != to {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrInvalid}
+	}
+	return from.Rename(oldpath, newpath)
+}
+
+// Chroot returns the subdirectory p, whose files are routed by their full paths.
+func (fs *worktreeFS) Chroot(p string) (billy.Filesystem, error) {
+	return chroot.New(fs, p), nil
+}
+
+// Join joins path elements the same way for both directories.
+func (fs *worktreeFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+// ReadDir lists dirname in the common directory, replacing or adding entries that belong to the
+// worktree.
+func (fs *worktreeFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	common, commonErr := fs.Filesystem.ReadDir(dirname)
+	if commonErr != nil && !os.IsNotExist(commonErr) {
+		return nil, commonErr
+	}
+	private, privateErr := fs.private.ReadDir(dirname)
+	if privateErr != nil && !os.IsNotExist(privateErr) {
+		return nil, privateErr
+	}
+	if commonErr != nil && privateErr != nil {
+		return nil, commonErr
+	}
+
+	var infos []os.FileInfo
+	for _, info := range common {
+		if fs.route(path.Join(dirname, info.Name())) == fs.Filesystem {
+			infos = append(infos, info)
+		}
+	}
+	for _, info := range private {
+		if fs.route(path.Join(dirname, info.Name())) == fs.private {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
@@ -0,0 +1,226 @@
+// Package httpfs serves a tree over HTTP or WebDAV, for machines that can't mount FUSE filesystems.
+//
+// Directories are listed as HTML pages, and files are served with their size and a type guessed
+// from their name or contents. Files support range and conditional requests: a file's ETag is its
+// blob hash, and its modification time is the time of the commit it's shown in. Symlinks within
+// the tree redirect to their targets.
+package httpfs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Handler serves a tree over HTTP.
+type Handler struct {
+	root   fstree.Node
+	logger *logging.Logger
+}
+
+func NewHandler(root fstree.Node, logger *logging.Logger) *Handler {
+	return &Handler{root: root, logger: logger}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := cleanPath(r.URL.Path)
+	h.logger.Debug("request", "op", r.Method, "path", name)
+	node, commit, ferr := lookup(h.root, name)
+	if ferr != nil {
+		h.error(w, r.Method, name, ferr)
+		return
+	}
+
+	switch n := node.(type) {
+	case fstree.DirNode:
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		h.serveDir(w, r, name, n)
+
+	case fstree.FileNode:
+		if strings.HasSuffix(r.URL.Path, "/") {
+			redirect(w, r, "../"+path.Base(r.URL.Path), http.StatusMovedPermanently)
+			return
+		}
+		file := n.File()
+		if file.Mode == filemode.Symlink {
+			h.serveSymlink(w, r, name, file, commit.path)
+			return
+		}
+		serveFile(w, r, file, commit)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// cleanPath returns the tree path for a URL path, like "refs/heads/master" for
+// "/refs/heads/master/". Paths can't go above the root.
+func cleanPath(urlPath string) string {
+	return strings.Trim(path.Clean("/"+urlPath), "/")
+}
+
+// commitLocation is the commit shown by a node or its nearest ancestor.
+type commitLocation struct {
+	commit *object.Commit
+	// path is the path of the node showing the commit.
+	path string
+}
+
+// lookup finds the node at name, along with the commit it's part of, if any.
+func lookup(root fstree.Node, name string) (fstree.Node, commitLocation, *fserror.Error) {
+	node := root
+	var commit commitLocation
+	if commitNode, ok := node.(fstree.CommitDirNode); ok {
+		commit = commitLocation{commit: commitNode.Commit()}
+	}
+	if name == "" {
+		return node, commit, nil
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		dirNode, ok := node.(fstree.DirNode)
+		if !ok {
+			return nil, commitLocation{}, fserror.Expected(fuse.ENOTDIR)
+		}
+		child, ferr := fstree.Child(dirNode, part)
+		if ferr != nil {
+			return nil, commitLocation{}, ferr
+		}
+		node = child
+		if commitNode, ok := node.(fstree.CommitDirNode); ok {
+			commit = commitLocation{commit: commitNode.Commit(), path: strings.Join(parts[:i+1], "/")}
+		}
+	}
+	return node, commit, nil
+}
+
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, name string, node fstree.DirNode) {
+	var names []string
+	children := fstree.ReadDir(node, "")
+	for {
+		child, ok, ferr := children.Next()
+		if ferr != nil {
+			h.error(w, r.Method, name, ferr)
+			return
+		}
+		if !ok {
+			break
+		}
+		childName := child.Name
+		if _, ok := child.Node.(fstree.DirNode); ok {
+			childName += "/"
+		}
+		names = append(names, childName)
+	}
+
+	title := html.EscapeString("Index of /" + name)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<!doctype html>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<h1>%s</h1>\n<pre>\n", title, title)
+	if name != "" {
+		fmt.Fprintln(&buf, `<a href="../">../</a>`)
+	}
+	for _, childName := range names {
+		// Like http.FileServer, this escapes names that would otherwise look like URL schemes.
+		href := (&url.URL{Path: childName}).String()
+		fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(childName))
+	}
+	fmt.Fprintln(&buf, "</pre>")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// serveSymlink redirects to the target of a symlink, if it's in the same commit, or in the tree
+// below root if the symlink isn't part of a commit.
+func (h *Handler) serveSymlink(w http.ResponseWriter, r *http.Request, name string, file *object.File, root string) {
+	reader, err := file.Reader()
+	if err != nil {
+		h.error(w, r.Method, name, fserror.Unexpected(err))
+		return
+	}
+	defer reader.Close()
+	target, err := ioutil.ReadAll(reader)
+	if err != nil {
+		h.error(w, r.Method, name, fserror.Unexpected(err))
+		return
+	}
+
+	resolved := path.Join(path.Dir(name), string(target))
+	if path.IsAbs(string(target)) || (root != "" && resolved != root && !strings.HasPrefix(resolved, root+"/")) ||
+		resolved == ".." || strings.HasPrefix(resolved, "../") {
+		http.Error(w, "symlink target is outside the tree: "+string(target), http.StatusNotFound)
+		return
+	}
+	// Symlinks can change, so the redirect is temporary.
+	redirect(w, r, string(target), http.StatusFound)
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, file *object.File, commit commitLocation) {
+	if file.Hash != plumbing.ZeroHash {
+		w.Header().Set("ETag", `"`+file.Hash.String()+`"`)
+	}
+	var modTime time.Time
+	if commit.commit != nil {
+		modTime = commit.commit.Committer.When
+	}
+
+	content := fstree.NewFileReader(file)
+	defer content.Close()
+	// ServeContent sets Content-Type from the name or contents, and handles ranges and conditions.
+	http.ServeContent(w, r, file.Name, modTime, content)
+}
+
+// redirect redirects to target, relative to the request's URL, keeping its query.
+func redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, code)
+}
+
+func (h *Handler) error(w http.ResponseWriter, op string, name string, ferr *fserror.Error) {
+	code := statusCode(ferr)
+	if ferr.UnexpectedErr != nil {
+		h.logger.Error("unexpected error", "op", op, "path", name, "kind", ferr.Kind, "err", ferr.UnexpectedErr)
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// statusCode returns the HTTP status for an error.
+func statusCode(ferr *fserror.Error) int {
+	switch ferr.Kind {
+	case fserror.NotFound, fserror.NotDir:
+		return http.StatusNotFound
+	case fserror.Permission:
+		return http.StatusForbidden
+	case fserror.Unsupported:
+		return http.StatusNotImplemented
+	case fserror.Other:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,287 @@
+package httpfs
+
+import (
+	"context"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"golang.org/x/net/webdav"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// NewWebDAVHandler returns a handler serving root over WebDAV, read-only. Modification times are
+// commit times; directories that aren't part of a commit, like refs/heads, show the time the handler
+// was created. Symlinks are shown as files containing their targets, since WebDAV has no links.
+func NewWebDAVHandler(root fstree.Node, logger *logging.Logger) http.Handler {
+	return readOnly(&webdav.Handler{
+		FileSystem: &webdavFS{root: root, logger: logger, started: time.Now()},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.Debug("request failed", "op", r.Method, "path", r.URL.Path, "err", err)
+			} else {
+				logger.Debug("request", "op", r.Method, "path", r.URL.Path)
+			}
+		},
+	})
+}
+
+// writeMethods are the WebDAV methods that modify resources.
+var writeMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"COPY":            true,
+	"MOVE":            true,
+	"PROPPATCH":       true,
+}
+
+// readOnly rejects writes before they reach handler, which would otherwise report some of them as
+// missing files.
+func readOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if writeMethods[r.Method] {
+			http.Error(w, "read-only file system", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// webdavFS is a read-only webdav.FileSystem showing a tree.
+type webdavFS struct {
+	root    fstree.Node
+	logger  *logging.Logger
+	started time.Time
+}
+
+var _ webdav.FileSystem = (*webdavFS)(nil)
+
+func (fs *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	info, err := fs.stat("Open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &webdavDir{fs: fs, info: info}, nil
+	}
+	return &webdavFile{info: info, content: info.content()}, nil
+}
+
+func (fs *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.stat("Stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (fs *webdavFS) stat(op string, name string) (*webdavInfo, error) {
+	name = cleanPath(name)
+	node, commit, ferr := lookup(fs.root, name)
+	if ferr != nil {
+		return nil, fs.osError(op, name, ferr)
+	}
+	return fs.newInfo(path.Base("/"+name), node, commit.commit), nil
+}
+
+func (fs *webdavFS) newInfo(name string, node fstree.Node, commit *object.Commit) *webdavInfo {
+	if commitNode, ok := node.(fstree.CommitDirNode); ok {
+		commit = commitNode.Commit()
+	}
+	modTime := fs.started
+	if commit != nil {
+		modTime = commit.Committer.When
+	}
+	return &webdavInfo{name: name, node: node, commit: commit, modTime: modTime}
+}
+
+// osError returns the os error webdav.Handler expects for ferr, logging it if it's unexpected.
+func (fs *webdavFS) osError(op string, name string, ferr *fserror.Error) error {
+	switch ferr.Kind {
+	case fserror.NotFound, fserror.NotDir:
+		return os.ErrNotExist
+	case fserror.Permission:
+		return os.ErrPermission
+	}
+	if ferr.UnexpectedErr != nil {
+		fs.logger.Error("unexpected error", "op", op, "path", name, "kind", ferr.Kind, "err", ferr.UnexpectedErr)
+	}
+	return ferr
+}
+
+// webdavInfo describes a node. Its modification time is the time of the commit it's part of.
+type webdavInfo struct {
+	name    string
+	node    fstree.Node
+	commit  *object.Commit
+	modTime time.Time
+}
+
+var _ os.FileInfo = (*webdavInfo)(nil)
+var _ webdav.ETager = (*webdavInfo)(nil)
+
+func (i *webdavInfo) Name() string {
+	return i.name
+}
+
+func (i *webdavInfo) Size() int64 {
+	if fileNode, ok := i.node.(fstree.FileNode); ok {
+		return fileNode.File().Size
+	}
+	return 0
+}
+
+func (i *webdavInfo) Mode() os.FileMode {
+	if i.IsDir() {
+		return os.ModeDir | 0555
+	}
+	if i.node.(fstree.FileNode).File().Mode == filemode.Executable {
+		return 0555
+	}
+	return 0444
+}
+
+func (i *webdavInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *webdavInfo) IsDir() bool {
+	_, ok := i.node.(fstree.DirNode)
+	return ok
+}
+
+func (i *webdavInfo) Sys() interface{} {
+	return nil
+}
+
+// ETag returns a file's blob hash, like Handler does. Directories use the default ETag.
+func (i *webdavInfo) ETag(ctx context.Context) (string, error) {
+	fileNode, ok := i.node.(fstree.FileNode)
+	if !ok || fileNode.File().Hash == plumbing.ZeroHash {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fileNode.File().Hash.String() + `"`, nil
+}
+
+func (i *webdavInfo) content() *fstree.FileReader {
+	return fstree.NewFileReader(i.node.(fstree.FileNode).File())
+}
+
+// webdavFile is an open file. Symlinks read as their targets.
+type webdavFile struct {
+	info    *webdavInfo
+	content *fstree.FileReader
+}
+
+var _ webdav.File = (*webdavFile)(nil)
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	return f.content.Read(p)
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	return f.content.Seek(offset, whence)
+}
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *webdavFile) Close() error {
+	return f.content.Close()
+}
+
+// webdavDir is an open directory, listed in name order.
+type webdavDir struct {
+	fs   *webdavFS
+	info *webdavInfo
+	// children are the entries not yet returned by Readdir, loaded by its first call.
+	children []os.FileInfo
+	loaded   bool
+}
+
+var _ webdav.File = (*webdavDir)(nil)
+
+func (d *webdavDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *webdavDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+// Readdir returns up to count entries, or all of them if count <= 0, like os.File.Readdir.
+func (d *webdavDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.loaded {
+		children := fstree.ReadDir(d.info.node.(fstree.DirNode), "")
+		for {
+			child, ok, ferr := children.Next()
+			if ferr != nil {
+				return nil, d.fs.osError("Readdir", d.info.name, ferr)
+			}
+			if !ok {
+				break
+			}
+			d.children = append(d.children, d.fs.newInfo(child.Name, child.Node, d.info.commit))
+		}
+		d.loaded = true
+	}
+
+	if count <= 0 {
+		infos := d.children
+		d.children = nil
+		return infos, nil
+	}
+	if len(d.children) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.children) {
+		count = len(d.children)
+	}
+	infos := d.children[:count]
+	d.children = d.children[count:]
+	return infos, nil
+}
+
+func (d *webdavDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *webdavDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *webdavDir) Close() error {
+	return nil
+}
@@ -0,0 +1,239 @@
+// Package logging is a leveled logger writing structured records as logfmt or JSON. Records are a
+// message plus alternating keys and values, like:
+//
+//	logger.Error("unexpected error", "op", "GetAttr", "path", name, "err", err)
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named by s, like "info".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level: %q", s)
+}
+
+type Format int
+
+const (
+	Logfmt Format = iota
+	JSON
+)
+
+// ParseFormat returns the format named by s, "logfmt" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt":
+		return Logfmt, nil
+	case "json":
+		return JSON, nil
+	default:
+		return 0, errors.Errorf("unknown log format: %q", s)
+	}
+}
+
+// Logger writes records at or above its level. Loggers made by With share their parent's output and
+// level. A nil *Logger discards everything.
+type Logger struct {
+	out *output
+	// keyvals are added to every record, before the record's own.
+	keyvals []interface{}
+}
+
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  Level
+}
+
+func New(w io.Writer, format Format, level Level) *Logger {
+	return &Logger{out: &output{w: w, format: format, level: level}}
+}
+
+// Discard returns a logger that writes nothing, until its level is lowered.
+func Discard() *Logger {
+	return New(ioutil.Discard, Logfmt, Error+1)
+}
+
+// With returns a logger adding keyvals to every record.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	combined := make([]interface{}, 0, len(l.keyvals)+len(keyvals))
+	combined = append(combined, l.keyvals...)
+	combined = append(combined, keyvals...)
+	return &Logger{out: l.out, keyvals: combined}
+}
+
+func (l *Logger) Level() Level {
+	if l == nil {
+		return Error + 1
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	return l.out.level
+}
+
+// SetLevel changes the level of this logger and every logger sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	if l == nil {
+		return
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.level = level
+}
+
+// Enabled returns whether records at level are written, for skipping expensive logging.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(Debug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(Info, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(Warn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(Error, msg, keyvals) }
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if l == nil {
+		return
+	}
+	all := make([]interface{}, 0, 6+len(l.keyvals)+len(keyvals))
+	all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level, "msg", msg)
+	all = append(all, l.keyvals...)
+	all = append(all, keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "(missing)")
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	if level < l.out.level {
+		return
+	}
+	var buf bytes.Buffer
+	if l.out.format == JSON {
+		writeJSON(&buf, all)
+	} else {
+		writeLogfmt(&buf, all)
+	}
+	// Logging has nowhere to report its own errors.
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeLogfmt(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtValue(formatKey(keyvals[i])))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(formatValue(keyvals[i+1])))
+	}
+	buf.WriteByte('\n')
+}
+
+// logfmtValue quotes s if it's empty or contains spaces, quotes, equals signs or control
+// characters.
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func writeJSON(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, formatKey(keyvals[i]))
+		buf.WriteByte(':')
+		switch value := keyvals[i+1].(type) {
+		case bool, int, int64, uint32, uint64:
+			fmt.Fprint(buf, value)
+		default:
+			writeJSONString(buf, formatValue(value))
+		}
+	}
+	buf.WriteString("}\n")
+}
+
+// writeJSONString writes s as a JSON string, replacing invalid UTF-8 like encoding/json does.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < ' ':
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[r>>4])
+			buf.WriteByte(hex[r&0xf])
+		default:
+			// Ranging over a string turns invalid UTF-8 into utf8.RuneError, U+FFFD.
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func formatKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	// Sprint uses Error and String methods, and recovers if they panic.
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,135 @@
+package gitviewfs
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/josh-newman/gitviewfs/gitviewfs/gitfstree"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency histogram's buckets.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics records how a filesystem is used. It serves them over HTTP in the Prometheus text format.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	mu               sync.Mutex
+	ops              map[string]*opMetrics
+	bytesRead        uint64
+	unexpectedErrors uint64
+	// cache is the filesystem's tree cache, set when the filesystem is made.
+	cache *gitfstree.Cache
+}
+
+type opMetrics struct {
+	count uint64
+	// buckets counts requests by the first latency bucket they fit in; the last is for the rest.
+	buckets []uint64
+	seconds float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{ops: map[string]*opMetrics{}}
+}
+
+// observe records a request for op that started at start. Use it as: defer m.observe(op, time.Now())
+func (m *Metrics) observe(op string, start time.Time) {
+	if m == nil {
+		return
+	}
+	seconds := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metrics, ok := m.ops[op]
+	if !ok {
+		metrics = &opMetrics{buckets: make([]uint64, len(latencyBuckets)+1)}
+		m.ops[op] = metrics
+	}
+	metrics.count++
+	metrics.seconds += seconds
+	metrics.buckets[sort.SearchFloat64s(latencyBuckets, seconds)]++
+}
+
+func (m *Metrics) addBytesRead(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesRead += uint64(n)
+}
+
+func (m *Metrics) addUnexpectedError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unexpectedErrors++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops := make([]string, 0, len(m.ops))
+	for op := range m.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintln(buf, "# HELP gitviewfs_requests_total Requests handled, by FUSE operation.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_requests_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(buf, "gitviewfs_requests_total{op=%q} %d\n", op, m.ops[op].count)
+	}
+
+	fmt.Fprintln(buf, "# HELP gitviewfs_request_duration_seconds Request latencies, by FUSE operation.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_request_duration_seconds histogram")
+	for _, op := range ops {
+		metrics := m.ops[op]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += metrics.buckets[i]
+			fmt.Fprintf(buf, "gitviewfs_request_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, cumulative)
+		}
+		fmt.Fprintf(buf, "gitviewfs_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, metrics.count)
+		fmt.Fprintf(buf, "gitviewfs_request_duration_seconds_sum{op=%q} %g\n", op, metrics.seconds)
+		fmt.Fprintf(buf, "gitviewfs_request_duration_seconds_count{op=%q} %d\n", op, metrics.count)
+	}
+
+	fmt.Fprintln(buf, "# HELP gitviewfs_read_bytes_total Bytes returned by reads.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_read_bytes_total counter")
+	fmt.Fprintf(buf, "gitviewfs_read_bytes_total %d\n", m.bytesRead)
+
+	fmt.Fprintln(buf, "# HELP gitviewfs_unexpected_errors_total Requests failed by unexpected errors.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_unexpected_errors_total counter")
+	fmt.Fprintf(buf, "gitviewfs_unexpected_errors_total %d\n", m.unexpectedErrors)
+
+	cacheStats := m.cache.Stats()
+	fmt.Fprintln(buf, "# HELP gitviewfs_cache_hits_total Directory listings and lookups found in the tree cache.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_cache_hits_total counter")
+	fmt.Fprintf(buf, "gitviewfs_cache_hits_total %d\n", cacheStats.Hits)
+	fmt.Fprintln(buf, "# HELP gitviewfs_cache_misses_total Directory listings and lookups not found in the tree cache.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_cache_misses_total counter")
+	fmt.Fprintf(buf, "gitviewfs_cache_misses_total %d\n", cacheStats.Misses)
+	fmt.Fprintln(buf, "# HELP gitviewfs_cache_hit_ratio Fraction of tree cache lookups that were hits.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_cache_hit_ratio gauge")
+	var hitRatio float64
+	if lookups := cacheStats.Hits + cacheStats.Misses; lookups > 0 {
+		hitRatio = float64(cacheStats.Hits) / float64(lookups)
+	}
+	fmt.Fprintf(buf, "gitviewfs_cache_hit_ratio %g\n", hitRatio)
+	fmt.Fprintln(buf, "# HELP gitviewfs_cache_entries Directories held in the tree cache.")
+	fmt.Fprintln(buf, "# TYPE gitviewfs_cache_entries gauge")
+	fmt.Fprintf(buf, "gitviewfs_cache_entries %d\n", cacheStats.Entries)
+}
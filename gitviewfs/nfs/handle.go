@@ -0,0 +1,145 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"hash/fnv"
+	"strings"
+	"syscall"
+)
+
+// maxHandleSize is the size limit of NFSv3 file handles (NFS3_FHSIZE).
+const maxHandleSize = 64
+
+// File handles hold everything needed to find their file again, so the server keeps no state
+// for them: the file's fstree.FileID, then its path, a component at a time. Components are written
+// whole, as a length byte below hashedComponent and the name, as long as the components after them
+// still fit hashed. Hashed components are two bytes, hashedComponent or'd with a hash of the name,
+// and are found by listing their directory, so only paths too long to write whole need listable
+// directories.
+const (
+	fileIDSize      = 8
+	hashedComponent = 0x80
+	hashedSize      = 2
+)
+
+var (
+	errStale       = fserror.Expected(fuse.Status(syscall.ESTALE))
+	errNameTooLong = fserror.Expected(fuse.Status(syscall.ENAMETOOLONG))
+)
+
+// handle returns f's handle. It fails if f's path is too deep to fit, even hashed.
+func handle(f *file) ([]byte, *fserror.Error) {
+	h := make([]byte, fileIDSize, maxHandleSize)
+	binary.BigEndian.PutUint64(h, fstree.FileID(f.node, f.path))
+	for i, name := range f.path {
+		hashedRest := hashedSize * (len(f.path) - i - 1)
+		if len(name) < hashedComponent && len(h)+1+len(name)+hashedRest <= maxHandleSize {
+			h = append(h, byte(len(name)))
+			h = append(h, name...)
+			continue
+		}
+		if len(h)+hashedSize+hashedRest > maxHandleSize {
+			return nil, errNameTooLong
+		}
+		h = append(h, 0, 0)
+		binary.BigEndian.PutUint16(h[len(h)-hashedSize:], hashedComponent<<8|componentHash(name))
+	}
+	return h, nil
+}
+
+// componentHash returns the 15 bits of name's hash stored for it in handles.
+func componentHash(name string) uint16 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return uint16(h.Sum32()) &^ (hashedComponent << 8)
+}
+
+// handlePart is a path component in a handle: its name, or its hash if hashed is set.
+type handlePart struct {
+	name   string
+	hashed bool
+	hash   uint16
+}
+
+// resolve returns the file with handle h, if its path still shows the same file.
+func (s *Server) resolve(h []byte) (*file, *fserror.Error) {
+	if len(h) < fileIDSize {
+		return nil, errStale
+	}
+	fileID := binary.BigEndian.Uint64(h)
+	var parts []handlePart
+	for rest := h[fileIDSize:]; len(rest) > 0; {
+		if rest[0]&hashedComponent != 0 {
+			if len(rest) < hashedSize {
+				return nil, errStale
+			}
+			hash := binary.BigEndian.Uint16(rest) &^ (hashedComponent << 8)
+			parts = append(parts, handlePart{hashed: true, hash: hash})
+			rest = rest[hashedSize:]
+			continue
+		}
+		n := int(rest[0])
+		if n == 0 || len(rest) < 1+n {
+			return nil, errStale
+		}
+		name := string(rest[1 : 1+n])
+		if name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, errStale
+		}
+		parts = append(parts, handlePart{name: name})
+		rest = rest[1+n:]
+	}
+
+	root, ferr := s.lookup(nil)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return s.resolveParts(root, parts, fileID)
+}
+
+// resolveParts returns the file at parts below f whose file ID is fileID. Hashed parts can match
+// several names, which are tried in order.
+func (s *Server) resolveParts(f *file, parts []handlePart, fileID uint64) (*file, *fserror.Error) {
+	if len(parts) == 0 {
+		if fstree.FileID(f.node, f.path) != fileID {
+			return nil, errStale
+		}
+		return f, nil
+	}
+
+	part := parts[0]
+	if !part.hashed {
+		next, ferr := s.walk(f, part.name)
+		if ferr != nil && (ferr.Kind == fserror.NotFound || ferr.Kind == fserror.NotDir) {
+			return nil, errStale
+		} else if ferr != nil {
+			return nil, ferr
+		}
+		return s.resolveParts(next, parts[1:], fileID)
+	}
+
+	dirNode, ok := f.node.(fstree.DirNode)
+	if !ok {
+		return nil, errStale
+	}
+	children := fstree.ReadDir(dirNode, "")
+	for {
+		entry, ok, ferr := children.Next()
+		if ferr != nil {
+			return nil, ferr
+		}
+		if !ok {
+			return nil, errStale
+		}
+		if componentHash(entry.Name) != part.hash {
+			continue
+		}
+		found, ferr := s.resolveParts(f.child(entry.Name, entry.Node), parts[1:], fileID)
+		if ferr != errStale {
+			return found, ferr
+		}
+	}
+}
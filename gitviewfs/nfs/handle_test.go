@@ -0,0 +1,163 @@
+package nfs
+
+import (
+	"fmt"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree/fstreetest"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// deepDir returns nested directories named name, depth deep, with a file at the bottom.
+func deepDir(name string, depth int) fstreetest.Dir {
+	dir := fstreetest.Dir{"file": fstreetest.NewFile("file", filemode.Regular, "deep\n")}
+	for i := 1; i < depth; i++ {
+		dir = fstreetest.Dir{name: dir}
+	}
+	return dir
+}
+
+// collidingNames returns two names too long to be written whole into handles, with the same hash.
+func collidingNames() (string, string) {
+	prefix := strings.Repeat("x", hashedComponent)
+	seen := map[uint16]string{}
+	for i := 0; ; i++ {
+		name := fmt.Sprint(prefix, i)
+		if other, ok := seen[componentHash(name)]; ok {
+			return other, name
+		}
+		seen[componentHash(name)] = name
+	}
+}
+
+func newTestTree() fstreetest.Dir {
+	first, second := collidingNames()
+	return fstreetest.Dir{
+		"dir": fstreetest.Dir{
+			"file": fstreetest.NewFile("file", filemode.Regular, "contents\n"),
+		},
+		"long":      deepDir(strings.Repeat("l", 40), 3),
+		"deep":      deepDir("d", 27),
+		"too-deep":  deepDir("d", 28),
+		"colliding": fstreetest.Dir{first: fstreetest.Dir{}, second: fstreetest.Dir{"file": fstreetest.NewFile("file", filemode.Regular, "second\n")}},
+	}
+}
+
+func TestHandleRoundTrip(t *testing.T) {
+	first, second := collidingNames()
+	tests := []struct {
+		name string
+		path []string
+	}{
+		{name: "root"},
+		{name: "file", path: []string{"dir", "file"}},
+		{name: "long names", path: []string{"long", strings.Repeat("l", 40), strings.Repeat("l", 40), "file"}},
+		{name: "deep", path: append([]string{"deep"}, append(strings.Split(strings.Repeat("d", 26), ""), "file")...)},
+		{name: "colliding hash, first", path: []string{"colliding", first}},
+		{name: "colliding hash, second", path: []string{"colliding", second, "file"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := newTestTree()
+			f, ferr := NewServer(root, nil).lookup(test.path)
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			h, ferr := handle(f)
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			if len(h) > maxHandleSize {
+				t.Fatalf("handle is %d bytes", len(h))
+			}
+
+			// A new server, as after a restart, finds the file from the handle alone.
+			got, ferr := NewServer(root, nil).resolve(h)
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			if !reflect.DeepEqual(got.path, f.path) || fstree.FileID(got.node, got.path) != fstree.FileID(f.node, f.path) {
+				t.Errorf("got %q, want %q", got.path, f.path)
+			}
+		})
+	}
+}
+
+func TestHandleTooDeep(t *testing.T) {
+	path := append([]string{"too-deep"}, append(strings.Split(strings.Repeat("d", 27), ""), "file")...)
+	f, ferr := NewServer(newTestTree(), nil).lookup(path)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if h, ferr := handle(f); ferr != errNameTooLong {
+		t.Errorf("got % x and error %v", h, ferr)
+	}
+}
+
+func TestHandleStale(t *testing.T) {
+	root := newTestTree()
+	s := NewServer(root, nil)
+	f, ferr := s.lookup([]string{"dir", "file"})
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	h, ferr := handle(f)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+
+	root["dir"].(fstreetest.Dir)["file"] = fstreetest.NewFile("file", filemode.Regular, "changed\n")
+	if _, ferr := s.resolve(h); ferr != errStale {
+		t.Errorf("changed file: got error %v", ferr)
+	}
+	delete(root["dir"].(fstreetest.Dir), "file")
+	if _, ferr := s.resolve(h); ferr != errStale {
+		t.Errorf("removed file: got error %v", ferr)
+	}
+	root["dir"] = fstreetest.NewFile("dir", filemode.Regular, "")
+	if _, ferr := s.resolve(h); ferr != errStale {
+		t.Errorf("directory replaced by a file: got error %v", ferr)
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	s := NewServer(newTestTree(), nil)
+	f, ferr := s.lookup([]string{"dir", "file"})
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	h, ferr := handle(f)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	withPath := func(path ...byte) []byte {
+		return append(append([]byte{}, h[:fileIDSize]...), path...)
+	}
+
+	tests := []struct {
+		name string
+		h    []byte
+	}{
+		{name: "empty", h: nil},
+		{name: "short file ID", h: h[:fileIDSize-1]},
+		{name: "wrong file ID", h: append([]byte{^h[0]}, h[1:]...)},
+		{name: "truncated name", h: h[:len(h)-1]},
+		{name: "truncated hash", h: withPath(3, 'd', 'i', 'r', hashedComponent)},
+		{name: "empty name", h: withPath(0)},
+		{name: "dot", h: withPath(1, '.')},
+		{name: "dot dot", h: withPath(3, 'd', 'i', 'r', 2, '.', '.')},
+		{name: "slash", h: withPath(8, 'd', 'i', 'r', '/', 'f', 'i', 'l', 'e')},
+		{name: "missing name", h: withPath(7, 'm', 'i', 's', 's', 'i', 'n', 'g')},
+		{name: "below a file", h: withPath(3, 'd', 'i', 'r', 4, 'f', 'i', 'l', 'e', 1, 'x')},
+		{name: "garbage", h: []byte(strings.Repeat("\xff", maxHandleSize))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if f, ferr := s.resolve(test.h); ferr != errStale {
+				t.Errorf("got %v and error %v", f, ferr)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package nfs
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	mountProgram = 100005
+	mountVersion = 3
+)
+
+// maxMountPath is the longest path in a MOUNT request.
+const maxMountPath = 1024
+
+// Mount statuses (mountstat3), from RFC 1813. Those in common with NFS statuses have the same values.
+const (
+	mnt3OK        = 0
+	mnt3ErrNotDir = 20
+)
+
+var mountProcedures = map[uint32]procedure{
+	0: {"MOUNT NULL", null},
+	1: {"MNT", (*call).mnt},
+	2: {"DUMP", (*call).dump},
+	3: {"UMNT", (*call).umnt},
+	4: {"UMNTALL", null},
+	5: {"EXPORT", (*call).export},
+}
+
+// mnt returns the handle of the mounted path, which can be any directory in the tree, like
+// /refs/heads/master.
+func (c *call) mnt(d *decoder, e *encoder) error {
+	dirPath := d.str(maxMountPath)
+	if err := d.args(); err != nil {
+		return err
+	}
+
+	var parts []string
+	if name := strings.Trim(path.Clean("/"+dirPath), "/"); name != "" {
+		parts = strings.Split(name, "/")
+	}
+	f, ferr := c.server.lookup(parts)
+	var h []byte
+	if ferr == nil {
+		h, ferr = handle(f)
+	}
+	if ferr != nil {
+		e.u32(c.report(ferr))
+		return nil
+	}
+	if !f.isDir() {
+		e.u32(mnt3ErrNotDir)
+		return nil
+	}
+	c.logger.Info("mounted", "path", "/"+strings.Join(parts, "/"))
+	e.u32(mnt3OK)
+	e.opaque(h)
+	// The authentication flavors clients can use, though credentials are ignored.
+	e.u32(1)
+	e.u32(authSys)
+	return nil
+}
+
+// dump lists no mounts, since mounts aren't tracked.
+func (c *call) dump(d *decoder, e *encoder) error {
+	e.bool(false)
+	return nil
+}
+
+func (c *call) umnt(d *decoder, e *encoder) error {
+	d.str(maxMountPath)
+	return d.args()
+}
+
+// export lists the root as the only export, open to everyone.
+func (c *call) export(d *decoder, e *encoder) error {
+	e.bool(true)
+	e.str("/")
+	e.bool(false) // no groups
+	e.bool(false)
+	return nil
+}
@@ -0,0 +1,764 @@
+// Package nfs serves a tree as a read-only NFSv3 server, for hosts where FUSE isn't allowed but an
+// NFS client is. The MOUNT and NFS programs share one TCP port, and there's no portmapper or lock
+// manager, so clients need to be told the ports and not to lock:
+//
+//	mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,mountproto=tcp,nolock localhost:/ /mnt
+//
+// File handles hold the file's path and a hash of its contents (see fstree.FileID), so they're the
+// same across restarts and the server keeps nothing for them. A handle goes stale when a refresh
+// changes what's at its path.
+package nfs
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	nfsProgram = 100003
+	nfsVersion = 3
+)
+
+// NFS statuses (nfsstat3), from RFC 1813.
+const (
+	nfs3OK             = 0
+	nfs3ErrPerm        = 1
+	nfs3ErrNoEnt       = 2
+	nfs3ErrIO          = 5
+	nfs3ErrAcces       = 13
+	nfs3ErrExist       = 17
+	nfs3ErrNotDir      = 20
+	nfs3ErrIsDir       = 21
+	nfs3ErrInval       = 22
+	nfs3ErrROFS        = 30
+	nfs3ErrNameTooLong = 63
+	nfs3ErrNotEmpty    = 66
+	nfs3ErrStale       = 70
+	nfs3ErrNotSupp     = 10004
+)
+
+var nfsStatuses = map[fuse.Status]uint32{
+	fuse.EPERM:                        nfs3ErrPerm,
+	fuse.ENOENT:                       nfs3ErrNoEnt,
+	fuse.EIO:                          nfs3ErrIO,
+	fuse.EACCES:                       nfs3ErrAcces,
+	fuse.Status(syscall.EEXIST):       nfs3ErrExist,
+	fuse.ENOTDIR:                      nfs3ErrNotDir,
+	fuse.Status(syscall.EISDIR):       nfs3ErrIsDir,
+	fuse.EINVAL:                       nfs3ErrInval,
+	fuse.EROFS:                        nfs3ErrROFS,
+	fuse.Status(syscall.ENAMETOOLONG): nfs3ErrNameTooLong,
+	fuse.Status(syscall.ENOTEMPTY):    nfs3ErrNotEmpty,
+	fuse.Status(syscall.ESTALE):       nfs3ErrStale,
+	fuse.ENOSYS:                       nfs3ErrNotSupp,
+	fuse.Status(syscall.EOPNOTSUPP):   nfs3ErrNotSupp,
+}
+
+// File types (ftype3).
+const (
+	nf3Reg = 1
+	nf3Dir = 2
+	nf3Lnk = 5
+)
+
+// Access bits (ACCESS3_*).
+const (
+	access3Read    = 0x01
+	access3Lookup  = 0x02
+	access3Execute = 0x20
+)
+
+// Filesystem properties (FSF3_*).
+const (
+	fsf3Symlink     = 0x02
+	fsf3Homogeneous = 0x08
+)
+
+// maxRead is the most data a READ returns.
+const maxRead = 1 << 20
+
+// maxName is the longest name in a request.
+const maxName = 255
+
+// maxReaders is the most files kept open between reads.
+const maxReaders = 64
+
+// maxResumes is the most directories whose listings are remembered between pages.
+const maxResumes = 256
+
+// Server serves a tree to NFS clients.
+type Server struct {
+	root    fstree.Node
+	logger  *logging.Logger
+	started time.Time
+
+	mu sync.Mutex
+	// readers are files left open after reads, by handle, so sequential reads don't start over.
+	readers map[string]*fstree.FileReader
+	// resumes are where the last pages of directories ended, by handle, so the next pages don't
+	// list them from the start.
+	resumes map[string]resumePoint
+}
+
+// resumePoint is the cookie and name of the entry a page of a directory ended at.
+type resumePoint struct {
+	cookie uint64
+	name   string
+}
+
+func NewServer(root fstree.Node, logger *logging.Logger) *Server {
+	return &Server{
+		root:    root,
+		logger:  logger,
+		started: time.Now(),
+		readers: map[string]*fstree.FileReader{},
+		resumes: map[string]resumePoint{},
+	}
+}
+
+// Serve serves connections from listener until accepting one fails.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "accept connection failed")
+		}
+		go s.serveConn(netConn)
+	}
+}
+
+// file is a node and where it is.
+type file struct {
+	node   fstree.Node
+	path   []string
+	commit *object.Commit
+}
+
+// lookup finds the file at parts below the tree root.
+func (s *Server) lookup(parts []string) (*file, *fserror.Error) {
+	f := &file{node: s.root}
+	if commitNode, ok := s.root.(fstree.CommitDirNode); ok {
+		f.commit = commitNode.Commit()
+	}
+	for _, part := range parts {
+		next, ferr := s.walk(f, part)
+		if ferr != nil {
+			return nil, ferr
+		}
+		f = next
+	}
+	return f, nil
+}
+
+// walk returns the file named name in f's directory.
+func (s *Server) walk(f *file, name string) (*file, *fserror.Error) {
+	switch name {
+	case ".":
+		return f, nil
+	case "..":
+		if len(f.path) == 0 {
+			return f, nil
+		}
+		return s.lookup(f.path[:len(f.path)-1])
+	}
+
+	dirNode, ok := f.node.(fstree.DirNode)
+	if !ok {
+		return nil, fserror.ErrNotDir
+	}
+	child, ferr := fstree.Child(dirNode, name)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return f.child(name, child), nil
+}
+
+func (f *file) child(name string, node fstree.Node) *file {
+	child := &file{node: node, path: append(f.path[:len(f.path):len(f.path)], name), commit: f.commit}
+	if commitNode, ok := node.(fstree.CommitDirNode); ok {
+		child.commit = commitNode.Commit()
+	}
+	return child
+}
+
+func (f *file) isDir() bool {
+	_, ok := f.node.(fstree.DirNode)
+	return ok
+}
+
+// gitFile returns f's file, or nil if it's a directory.
+func (f *file) gitFile() *object.File {
+	if fileNode, ok := f.node.(fstree.FileNode); ok {
+		return fileNode.File()
+	}
+	return nil
+}
+
+// takeReader returns a reader for f, reusing one left open by putReader.
+func (s *Server) takeReader(h []byte, f *object.File) *fstree.FileReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reader, ok := s.readers[string(h)]; ok {
+		delete(s.readers, string(h))
+		return reader
+	}
+	return fstree.NewFileReader(f)
+}
+
+// putReader leaves reader open for the next read of the file with handle h.
+func (s *Server) putReader(h []byte, reader *fstree.FileReader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.readers[string(h)]; ok {
+		reader.Close()
+		return
+	}
+	for key, other := range s.readers {
+		if len(s.readers) < maxReaders {
+			break
+		}
+		other.Close()
+		delete(s.readers, key)
+	}
+	s.readers[string(h)] = reader
+}
+
+var nfsProcedures = map[uint32]procedure{
+	0:  {"NULL", null},
+	1:  {"GETATTR", (*call).getattr},
+	2:  {"SETATTR", readOnly(false, 1)},
+	3:  {"LOOKUP", (*call).lookup},
+	4:  {"ACCESS", (*call).access},
+	5:  {"READLINK", (*call).readlink},
+	6:  {"READ", (*call).read},
+	7:  {"WRITE", readOnly(false, 1)},
+	8:  {"CREATE", readOnly(false, 1)},
+	9:  {"MKDIR", readOnly(false, 1)},
+	10: {"SYMLINK", readOnly(false, 1)},
+	11: {"MKNOD", readOnly(false, 1)},
+	12: {"REMOVE", readOnly(false, 1)},
+	13: {"RMDIR", readOnly(false, 1)},
+	14: {"RENAME", readOnly(false, 2)},
+	15: {"LINK", readOnly(true, 1)},
+	16: {"READDIR", (*call).readdir},
+	17: {"READDIRPLUS", (*call).readdirplus},
+	18: {"FSSTAT", (*call).fsstat},
+	19: {"FSINFO", (*call).fsinfo},
+	20: {"PATHCONF", (*call).pathconf},
+	21: {"COMMIT", readOnly(false, 1)},
+}
+
+func null(c *call, d *decoder, e *encoder) error {
+	return nil
+}
+
+// readOnly returns a procedure that fails because it would change the tree. Its result has a
+// wcc_data for each of wccs changed objects, after the file's attributes if fileAttrs is set.
+func readOnly(fileAttrs bool, wccs int) func(c *call, d *decoder, e *encoder) error {
+	return func(c *call, d *decoder, e *encoder) error {
+		e.u32(nfs3ErrROFS)
+		if fileAttrs {
+			e.bool(false)
+		}
+		for i := 0; i < wccs; i++ {
+			// Neither the attributes before nor after.
+			e.bool(false)
+			e.bool(false)
+		}
+		return nil
+	}
+}
+
+// resolveArg decodes a file handle argument and resolves it. If it fails, it encodes the status and
+// empty attributes, which every failed result starts with.
+func (c *call) resolveArg(d *decoder, e *encoder) (*file, []byte, error) {
+	h := d.opaque(maxHandleSize)
+	if err := d.args(); err != nil {
+		return nil, nil, err
+	}
+	f, ferr := c.server.resolve(h)
+	if ferr != nil {
+		e.u32(c.report(ferr))
+		e.bool(false)
+		return nil, nil, nil
+	}
+	return f, h, nil
+}
+
+func (c *call) getattr(d *decoder, e *encoder) error {
+	h := d.opaque(maxHandleSize)
+	if err := d.args(); err != nil {
+		return err
+	}
+	f, ferr := c.server.resolve(h)
+	if ferr != nil {
+		e.u32(c.report(ferr))
+		return nil
+	}
+	e.u32(nfs3OK)
+	c.fattr(e, f)
+	return nil
+}
+
+func (c *call) lookup(d *decoder, e *encoder) error {
+	dir, _, err := c.resolveArg(d, e)
+	name := d.str(maxName)
+	if err != nil || dir == nil {
+		return err
+	}
+	if err := d.args(); err != nil {
+		return err
+	}
+
+	f, ferr := c.server.walk(dir, name)
+	var h []byte
+	if ferr == nil {
+		h, ferr = handle(f)
+	}
+	if ferr != nil {
+		e.u32(c.report(ferr))
+		c.postOpAttr(e, dir)
+		return nil
+	}
+	e.u32(nfs3OK)
+	e.opaque(h)
+	c.postOpAttr(e, f)
+	c.postOpAttr(e, dir)
+	return nil
+}
+
+func (c *call) access(d *decoder, e *encoder) error {
+	f, _, err := c.resolveArg(d, e)
+	requested := d.u32()
+	if err != nil || f == nil {
+		return err
+	}
+	if err := d.args(); err != nil {
+		return err
+	}
+
+	allowed := uint32(access3Read)
+	if f.isDir() {
+		allowed |= access3Lookup | access3Execute
+	} else if f.gitFile().Mode == filemode.Executable {
+		allowed |= access3Execute
+	}
+	e.u32(nfs3OK)
+	c.postOpAttr(e, f)
+	e.u32(requested & allowed)
+	return nil
+}
+
+func (c *call) readlink(d *decoder, e *encoder) error {
+	f, _, err := c.resolveArg(d, e)
+	if err != nil || f == nil {
+		return err
+	}
+	gitFile := f.gitFile()
+	if gitFile == nil || gitFile.Mode != filemode.Symlink {
+		e.u32(nfs3ErrInval)
+		c.postOpAttr(e, f)
+		return nil
+	}
+
+	target, err := readAll(gitFile)
+	if err != nil {
+		e.u32(c.report(fserror.Unexpected(err)))
+		c.postOpAttr(e, f)
+		return nil
+	}
+	e.u32(nfs3OK)
+	c.postOpAttr(e, f)
+	e.str(string(target))
+	return nil
+}
+
+func readAll(f *object.File) ([]byte, error) {
+	reader, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (c *call) read(d *decoder, e *encoder) error {
+	f, h, err := c.resolveArg(d, e)
+	offset, count := d.u64(), d.u32()
+	if err != nil || f == nil {
+		return err
+	}
+	if err := d.args(); err != nil {
+		return err
+	}
+	gitFile := f.gitFile()
+	if gitFile == nil {
+		e.u32(nfs3ErrIsDir)
+		c.postOpAttr(e, f)
+		return nil
+	}
+	if count > maxRead {
+		count = maxRead
+	}
+
+	reader := c.server.takeReader(h, gitFile)
+	data := make([]byte, count)
+	n := 0
+	_, err = reader.Seek(int64(offset), io.SeekStart)
+	if err == nil {
+		n, err = io.ReadFull(reader, data)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		reader.Close()
+		e.u32(c.report(fserror.Unexpected(err)))
+		c.postOpAttr(e, f)
+		return nil
+	}
+	c.server.putReader(h, reader)
+
+	e.u32(nfs3OK)
+	c.postOpAttr(e, f)
+	e.u32(uint32(n))
+	e.bool(offset+uint64(n) >= uint64(gitFile.Size))
+	e.opaque(data[:n])
+	return nil
+}
+
+// dirEntry is a directory entry. Its file is nil for "." and "..".
+type dirEntry struct {
+	name   string
+	fileID uint64
+	file   *file
+	cookie uint64
+}
+
+// dirLister lists a directory from a cookie on. Cookies number the entries from 1, "." and ".."
+// first, and the rest in name order.
+type dirLister struct {
+	dir      *file
+	children fstree.DirIterator
+	// cookie is that of the entry next returns.
+	cookie uint64
+}
+
+// listFrom returns a lister for the entries of dir, which has handle h, after the one with cookie.
+// The directory is listed from the name of that entry if the last page of it ended there, and
+// otherwise from the start.
+func (s *Server) listFrom(dir *file, h []byte, cookie uint64) (*dirLister, *fserror.Error) {
+	l := &dirLister{dir: dir, cookie: cookie + 1}
+	dirNode := dir.node.(fstree.DirNode)
+	if name, ok := s.takeResume(h, cookie); ok {
+		l.children = fstree.ReadDir(dirNode, name)
+		return l, nil
+	}
+	l.children = fstree.ReadDir(dirNode, "")
+	for skip := cookie; skip > 2; skip-- {
+		if _, ok, ferr := l.children.Next(); ferr != nil {
+			return nil, ferr
+		} else if !ok {
+			break
+		}
+	}
+	return l, nil
+}
+
+// next returns the next entry, or false after the last.
+func (l *dirLister) next() (dirEntry, bool, *fserror.Error) {
+	cookie := l.cookie
+	if cookie <= 2 {
+		name := "."
+		if cookie == 2 {
+			name = ".."
+		}
+		// ".." shows the directory's own file ID; clients look its parent up to find the real one.
+		l.cookie++
+		return dirEntry{name: name, fileID: fstree.FileID(l.dir.node, l.dir.path), cookie: cookie}, true, nil
+	}
+	entry, ok, ferr := l.children.Next()
+	if ferr != nil || !ok {
+		return dirEntry{}, false, ferr
+	}
+	l.cookie++
+	child := l.dir.child(entry.Name, entry.Node)
+	return dirEntry{name: entry.Name, fileID: fstree.FileID(child.node, child.path), file: child, cookie: cookie}, true, nil
+}
+
+// takeResume returns the name of the entry with cookie in the directory with handle h, if the last
+// page listed of it ended there.
+func (s *Server) takeResume(h []byte, cookie uint64) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resume, ok := s.resumes[string(h)]
+	if !ok || resume.cookie != cookie {
+		return "", false
+	}
+	delete(s.resumes, string(h))
+	return resume.name, true
+}
+
+// putResume records that a page of the directory with handle h ended at entry, so the next page
+// can be listed from its name.
+func (s *Server) putResume(h []byte, entry dirEntry) {
+	if entry.file == nil {
+		// The next page starts with the directory's first child anyway.
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.resumes {
+		if len(s.resumes) < maxResumes {
+			break
+		}
+		delete(s.resumes, key)
+	}
+	s.resumes[string(h)] = resumePoint{cookie: entry.cookie, name: entry.name}
+}
+
+// readdirArgs decodes the arguments READDIR and READDIRPLUS start with, and returns the directory
+// with its handle and a lister for its entries after the cookie.
+func (c *call) readdirArgs(d *decoder, e *encoder) (*file, []byte, *dirLister, error) {
+	dir, h, err := c.resolveArg(d, e)
+	cookie := d.u64()
+	d.next(8) // cookieverf
+	if err != nil || dir == nil {
+		return nil, nil, nil, err
+	}
+	if !dir.isDir() {
+		e.u32(nfs3ErrNotDir)
+		c.postOpAttr(e, dir)
+		return nil, nil, nil, nil
+	}
+	lister, ferr := c.server.listFrom(dir, h, cookie)
+	if ferr != nil {
+		e.u32(c.report(ferr))
+		c.postOpAttr(e, dir)
+		return nil, nil, nil, nil
+	}
+	return dir, h, lister, nil
+}
+
+// entrySize is the encoded size of an entry's file ID, name and cookie.
+func entrySize(entry dirEntry) int {
+	return 8 + 4 + len(entry.name) + pad(len(entry.name)) + 8
+}
+
+// listPage encodes entries from lister for as long as fits returns true for them, then the end of
+// the list. It reports an error listing before anything is encoded.
+func (c *call) listPage(e *encoder, dir *file, h []byte, lister *dirLister, fits func(entry dirEntry) bool, encode func(entry dirEntry)) {
+	var entries []dirEntry
+	eof := false
+	for {
+		entry, ok, ferr := lister.next()
+		if ferr != nil {
+			e.u32(c.report(ferr))
+			c.postOpAttr(e, dir)
+			return
+		}
+		if !ok {
+			eof = true
+			break
+		}
+		if !fits(entry) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	e.u32(nfs3OK)
+	c.postOpAttr(e, dir)
+	e.fixed(make([]byte, 8)) // cookieverf
+	for _, entry := range entries {
+		e.bool(true)
+		e.u64(entry.fileID)
+		e.str(entry.name)
+		e.u64(entry.cookie)
+		encode(entry)
+	}
+	e.bool(false)
+	e.bool(eof)
+	if !eof && len(entries) > 0 {
+		c.server.putResume(h, entries[len(entries)-1])
+	}
+}
+
+func (c *call) readdir(d *decoder, e *encoder) error {
+	dir, h, lister, err := c.readdirArgs(d, e)
+	count := d.u32()
+	if err != nil || dir == nil {
+		return err
+	}
+	if err := d.args(); err != nil {
+		return err
+	}
+
+	// Leave room for the status, the directory's attributes, the verifier, the end of the list and
+	// the EOF flag.
+	size := 4 + 4 + fattrSize + 8 + 8
+	fits := func(entry dirEntry) bool {
+		size += 4 + entrySize(entry)
+		return size <= int(count)
+	}
+	c.listPage(e, dir, h, lister, fits, func(dirEntry) {})
+	return nil
+}
+
+func (c *call) readdirplus(d *decoder, e *encoder) error {
+	dir, h, lister, err := c.readdirArgs(d, e)
+	dirCount, maxCount := d.u32(), d.u32()
+	if err != nil || dir == nil {
+		return err
+	}
+	if err := d.args(); err != nil {
+		return err
+	}
+
+	// dirCount limits the file IDs, names and cookies, and maxCount the whole result.
+	dirSize := 0
+	size := 4 + 4 + fattrSize + 8 + 8
+	handles := map[string][]byte{}
+	fits := func(entry dirEntry) bool {
+		var h []byte
+		if entry.file != nil {
+			// Files too deep for a handle are listed without one, and fail to be looked up.
+			h, _ = handle(entry.file)
+			handles[entry.name] = h
+		}
+		dirSize += entrySize(entry)
+		size += 4 + entrySize(entry) + 4 + 4
+		if entry.file != nil {
+			size += fattrSize
+		}
+		if h != nil {
+			size += 4 + len(h) + pad(len(h))
+		}
+		return dirSize <= int(dirCount) && size <= int(maxCount)
+	}
+	encode := func(entry dirEntry) {
+		if entry.file == nil {
+			e.bool(false)
+			e.bool(false)
+			return
+		}
+		c.postOpAttr(e, entry.file)
+		h := handles[entry.name]
+		e.bool(h != nil)
+		if h != nil {
+			e.opaque(h)
+		}
+	}
+	c.listPage(e, dir, h, lister, fits, encode)
+	return nil
+}
+
+func (c *call) fsstat(d *decoder, e *encoder) error {
+	f, _, err := c.resolveArg(d, e)
+	if err != nil || f == nil {
+		return err
+	}
+	e.u32(nfs3OK)
+	c.postOpAttr(e, f)
+	for i := 0; i < 6; i++ {
+		// Total, free and available bytes and files.
+		e.u64(0)
+	}
+	e.u32(0) // invarsec
+	return nil
+}
+
+func (c *call) fsinfo(d *decoder, e *encoder) error {
+	f, _, err := c.resolveArg(d, e)
+	if err != nil || f == nil {
+		return err
+	}
+	e.u32(nfs3OK)
+	c.postOpAttr(e, f)
+	e.u32(maxRead) // rtmax
+	e.u32(maxRead) // rtpref
+	e.u32(4096)    // rtmult
+	e.u32(maxRead) // wtmax
+	e.u32(maxRead) // wtpref
+	e.u32(4096)    // wtmult
+	e.u32(maxRead) // dtpref
+	e.u64(math.MaxInt64)
+	e.u32(0) // time_delta seconds
+	e.u32(1) // time_delta nanoseconds
+	e.u32(fsf3Symlink | fsf3Homogeneous)
+	return nil
+}
+
+func (c *call) pathconf(d *decoder, e *encoder) error {
+	f, _, err := c.resolveArg(d, e)
+	if err != nil || f == nil {
+		return err
+	}
+	e.u32(nfs3OK)
+	c.postOpAttr(e, f)
+	e.u32(1)       // linkmax
+	e.u32(maxName) // name_max
+	e.bool(true)   // no_trunc
+	e.bool(true)   // chown_restricted
+	e.bool(false)  // case_insensitive
+	e.bool(true)   // case_preserving
+	return nil
+}
+
+// fattrSize is the encoded size of fattr3.
+const fattrSize = 84
+
+func (c *call) postOpAttr(e *encoder, f *file) {
+	e.bool(true)
+	c.fattr(e, f)
+}
+
+// fattr encodes f's attributes. Its times are the time of the commit it's part of.
+func (c *call) fattr(e *encoder, f *file) {
+	var typ, mode uint32
+	var size uint64
+	if gitFile := f.gitFile(); gitFile != nil {
+		size = uint64(gitFile.Size)
+		switch gitFile.Mode {
+		case filemode.Symlink:
+			typ, mode = nf3Lnk, 0777
+		case filemode.Executable:
+			typ, mode = nf3Reg, 0555
+		default:
+			typ, mode = nf3Reg, 0444
+		}
+	} else {
+		typ, mode = nf3Dir, 0555
+	}
+	modTime := c.server.started
+	if f.commit != nil {
+		modTime = f.commit.Committer.When
+	}
+
+	e.u32(typ)
+	e.u32(mode)
+	e.u32(1) // nlink
+	e.u32(uint32(os.Getuid()))
+	e.u32(uint32(os.Getgid()))
+	e.u64(size)
+	e.u64(size) // used
+	e.u32(0)    // rdev
+	e.u32(0)
+	e.u64(0) // fsid
+	e.u64(fstree.FileID(f.node, f.path))
+	for i := 0; i < 3; i++ {
+		// atime, mtime and ctime.
+		e.u32(uint32(modTime.Unix()))
+		e.u32(uint32(modTime.Nanosecond()))
+	}
+}
@@ -0,0 +1,228 @@
+package nfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ONC RPC message fields, from RFC 5531.
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	rejectRPCMismatch = 0
+
+	authNone = 0
+	authSys  = 1
+)
+
+// maxAuth is the largest credential or verifier body.
+const maxAuth = 400
+
+// maxRecord is the largest request accepted. Requests are small except for writes, which fail.
+const maxRecord = maxRead + 4096
+
+// maxInFlight is the most calls handled at once for one connection. Each can hold a READ's worth
+// of data, so a client sending calls faster than they're answered can't use unbounded memory.
+const maxInFlight = 64
+
+// lastFragment marks the last fragment of a record in RPC's record marking.
+const lastFragment = 1 << 31
+
+var errGarbageArgs = errors.New("garbage arguments")
+
+type program struct {
+	version    uint32
+	procedures map[uint32]procedure
+}
+
+type procedure struct {
+	name string
+	// handle decodes the procedure's arguments from d and encodes its result to e. It returns
+	// errGarbageArgs if the arguments can't be decoded.
+	handle func(c *call, d *decoder, e *encoder) error
+}
+
+var programs = map[uint32]program{
+	mountProgram: {version: mountVersion, procedures: mountProcedures},
+	nfsProgram:   {version: nfsVersion, procedures: nfsProcedures},
+}
+
+// call is a request being handled.
+type call struct {
+	server *Server
+	logger *logging.Logger
+	op     string
+}
+
+func (s *Server) serveConn(netConn net.Conn) {
+	logger := s.logger.With("remote", netConn.RemoteAddr().String())
+	defer netConn.Close()
+	logger.Debug("connection opened")
+
+	// Calls are handled concurrently, since clients send several at once, and replied to in any
+	// order. Once maxInFlight are being handled, reading more waits for one to finish.
+	var writeMu sync.Mutex
+	inFlight := make(chan struct{}, maxInFlight)
+	reader := bufio.NewReader(netConn)
+	for {
+		record, err := readRecord(reader)
+		if err == io.EOF {
+			logger.Debug("connection closed")
+			return
+		} else if err != nil {
+			logger.Warn("read request failed", "err", err)
+			return
+		}
+
+		inFlight <- struct{}{}
+		go func() {
+			defer func() { <-inFlight }()
+			reply := s.handleCall(logger, record)
+			if reply == nil {
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if err := writeRecord(netConn, reply); err != nil {
+				logger.Warn("write reply failed", "err", err)
+			}
+		}()
+	}
+}
+
+// readRecord reads a record made of one or more fragments.
+func readRecord(reader io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF && len(record) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		fragment := binary.BigEndian.Uint32(header[:])
+		size := int(fragment &^ lastFragment)
+		if len(record)+size > maxRecord {
+			return nil, errors.Errorf("record too long: over %d bytes", maxRecord)
+		}
+		start := len(record)
+		record = append(record, make([]byte, size)...)
+		if _, err := io.ReadFull(reader, record[start:]); err != nil {
+			return nil, errors.Wrap(err, "read record failed")
+		}
+		if fragment&lastFragment != 0 {
+			return record, nil
+		}
+	}
+}
+
+func writeRecord(writer io.Writer, record []byte) error {
+	e := &encoder{data: make([]byte, 0, 4+len(record))}
+	e.u32(lastFragment | uint32(len(record)))
+	e.data = append(e.data, record...)
+	_, err := writer.Write(e.data)
+	return err
+}
+
+// handleCall handles an RPC call and returns the reply, or nil if the call can't be replied to.
+func (s *Server) handleCall(logger *logging.Logger, record []byte) []byte {
+	d := &decoder{data: record}
+	xid, msgType := d.u32(), d.u32()
+	if d.err != nil || msgType != msgCall {
+		logger.Warn("invalid RPC call", "type", msgType, "err", d.err)
+		return nil
+	}
+	rpcVers, prog, vers, proc := d.u32(), d.u32(), d.u32(), d.u32()
+	// Credentials are ignored: everyone can read everything.
+	d.u32()
+	d.opaque(maxAuth)
+	d.u32()
+	d.opaque(maxAuth)
+
+	e := &encoder{}
+	e.u32(xid)
+	e.u32(msgReply)
+	if rpcVers != rpcVersion {
+		e.u32(replyDenied)
+		e.u32(rejectRPCMismatch)
+		e.u32(rpcVersion)
+		e.u32(rpcVersion)
+		return e.data
+	}
+	e.u32(replyAccepted)
+	e.u32(authNone)
+	e.opaque(nil)
+	if d.err != nil {
+		e.u32(acceptGarbageArgs)
+		return e.data
+	}
+
+	p, ok := programs[prog]
+	if !ok {
+		e.u32(acceptProgUnavail)
+		return e.data
+	}
+	if vers != p.version {
+		e.u32(acceptProgMismatch)
+		e.u32(p.version)
+		e.u32(p.version)
+		return e.data
+	}
+	procedure, ok := p.procedures[proc]
+	if !ok {
+		e.u32(acceptProcUnavail)
+		return e.data
+	}
+
+	c := &call{server: s, logger: logger, op: procedure.name}
+	logger.Debug("request", "op", procedure.name)
+	result := &encoder{}
+	if err := procedure.handle(c, d, result); err != nil {
+		logger.Debug("request failed", "op", procedure.name, "err", err)
+		e.u32(acceptGarbageArgs)
+		return e.data
+	}
+	e.u32(acceptSuccess)
+	e.data = append(e.data, result.data...)
+	return e.data
+}
+
+// args returns errGarbageArgs if the arguments couldn't be decoded.
+func (d *decoder) args() error {
+	if d.err != nil {
+		return errGarbageArgs
+	}
+	return nil
+}
+
+// report logs ferr, returned by the call, and returns the NFS status to fail it with.
+func (c *call) report(ferr *fserror.Error) uint32 {
+	if ferr.UnexpectedErr != nil {
+		c.logger.Error("unexpected error", "op", c.op, "kind", ferr.Kind, "err", ferr.UnexpectedErr)
+	} else {
+		c.logger.Debug("request failed", "op", c.op, "kind", ferr.Kind, "status", ferr.Status)
+	}
+	if status, ok := nfsStatuses[ferr.Status]; ok {
+		return status
+	}
+	return nfs3ErrIO
+}
@@ -0,0 +1,206 @@
+package nfs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// rpcCall returns an RPC call of the procedure proc, with the arguments encoded by args.
+func rpcCall(prog, proc uint32, args func(e *encoder)) []byte {
+	e := &encoder{}
+	e.u32(1) // xid
+	e.u32(msgCall)
+	e.u32(rpcVersion)
+	e.u32(prog)
+	e.u32(programs[prog].version)
+	e.u32(proc)
+	for i := 0; i < 2; i++ {
+		// Credentials and verifier.
+		e.u32(authNone)
+		e.opaque(nil)
+	}
+	args(e)
+	return e.data
+}
+
+// acceptStatus returns the accept_stat of an accepted reply, or -1 if reply isn't one.
+func acceptStatus(reply []byte) int {
+	d := &decoder{data: reply}
+	d.u32() // xid
+	if d.u32() != msgReply || d.u32() != replyAccepted {
+		return -1
+	}
+	d.u32()
+	d.opaque(maxAuth)
+	status := d.u32()
+	if d.err != nil {
+		return -1
+	}
+	return int(status)
+}
+
+// testCalls are valid calls of each procedure that has arguments, given the root's handle.
+func testCalls(root []byte) map[string][]byte {
+	withHandle := func(e *encoder) { e.opaque(root) }
+	return map[string][]byte{
+		"MNT":         rpcCall(mountProgram, 1, func(e *encoder) { e.str("/dir") }),
+		"UMNT":        rpcCall(mountProgram, 3, func(e *encoder) { e.str("/dir") }),
+		"GETATTR":     rpcCall(nfsProgram, 1, withHandle),
+		"LOOKUP":      rpcCall(nfsProgram, 3, func(e *encoder) { e.opaque(root); e.str("dir") }),
+		"ACCESS":      rpcCall(nfsProgram, 4, func(e *encoder) { e.opaque(root); e.u32(access3Read) }),
+		"READLINK":    rpcCall(nfsProgram, 5, withHandle),
+		"READ":        rpcCall(nfsProgram, 6, func(e *encoder) { e.opaque(root); e.u64(0); e.u32(100) }),
+		"READDIR":     rpcCall(nfsProgram, 16, func(e *encoder) { e.opaque(root); e.u64(0); e.fixed(make([]byte, 8)); e.u32(4096) }),
+		"READDIRPLUS": rpcCall(nfsProgram, 17, func(e *encoder) { e.opaque(root); e.u64(0); e.fixed(make([]byte, 8)); e.u32(4096); e.u32(4096) }),
+		"FSSTAT":      rpcCall(nfsProgram, 18, withHandle),
+		"FSINFO":      rpcCall(nfsProgram, 19, withHandle),
+		"PATHCONF":    rpcCall(nfsProgram, 20, withHandle),
+	}
+}
+
+func rootHandle(t *testing.T, s *Server) []byte {
+	root, ferr := s.lookup(nil)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	h, ferr := handle(root)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	return h
+}
+
+func TestHandleCall(t *testing.T) {
+	s := NewServer(newTestTree(), nil)
+	for name, call := range testCalls(rootHandle(t, s)) {
+		if status := acceptStatus(s.handleCall(nil, call)); status != acceptSuccess {
+			t.Errorf("%s: got accept status %d", name, status)
+		}
+	}
+}
+
+func TestHandleCallTruncated(t *testing.T) {
+	s := NewServer(newTestTree(), nil)
+	for name, call := range testCalls(rootHandle(t, s)) {
+		for n := 0; n < len(call); n++ {
+			want := acceptGarbageArgs
+			if n < 12 {
+				// Calls too short to have an RPC version aren't replied to or are rejected.
+				want = -1
+			}
+			if status := acceptStatus(s.handleCall(nil, call[:n])); status != want {
+				t.Errorf("%s with %d of %d bytes: got accept status %d", name, n, len(call), status)
+			}
+		}
+	}
+}
+
+func TestHandleCallGarbage(t *testing.T) {
+	s := NewServer(newTestTree(), nil)
+	garbage := [][]byte{
+		bytes.Repeat([]byte{0xff}, 16),
+		bytes.Repeat([]byte{0x80}, 64),
+		{0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff},
+		{0, 0, 0, maxHandleSize + 1},
+	}
+	for _, prog := range []uint32{mountProgram, nfsProgram} {
+		for proc := range programs[prog].procedures {
+			for _, args := range garbage {
+				// Replies don't matter, only that there's no panic.
+				s.handleCall(nil, rpcCall(prog, proc, func(e *encoder) { e.data = append(e.data, args...) }))
+			}
+		}
+	}
+}
+
+func TestMountThenLookUpAfterRestart(t *testing.T) {
+	root := newTestTree()
+	s := NewServer(root, nil)
+	reply := s.handleCall(nil, testCalls(nil)["MNT"])
+	d := &decoder{data: reply}
+	d.next(4 * 5) // Up to the accepted reply's verifier, which is empty.
+	if status, mountStatus := d.u32(), d.u32(); status != acceptSuccess || mountStatus != mnt3OK {
+		t.Fatalf("mount: got accept status %d and mount status %d", status, mountStatus)
+	}
+	dir := d.opaque(maxHandleSize)
+
+	// A new server, as after a restart, accepts the handle.
+	s = NewServer(root, nil)
+	reply = s.handleCall(nil, rpcCall(nfsProgram, 3, func(e *encoder) { e.opaque(dir); e.str("file") }))
+	d = &decoder{data: reply}
+	d.next(4 * 5)
+	if status, nfsStatus := d.u32(), d.u32(); status != acceptSuccess || nfsStatus != nfs3OK {
+		t.Fatalf("lookup: got accept status %d and NFS status %d", status, nfsStatus)
+	}
+	file := d.opaque(maxHandleSize)
+	f, ferr := s.resolve(file)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got := f.gitFile(); got == nil || got.Name != "file" || got.Size != int64(len("contents\n")) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+// readdirPage lists the page of dir after cookie, returning the names and cookies on it and whether
+// it's the last.
+func readdirPage(t *testing.T, s *Server, dir []byte, cookie uint64, count uint32) ([]string, []uint64, bool) {
+	reply := s.handleCall(nil, rpcCall(nfsProgram, 16, func(e *encoder) {
+		e.opaque(dir)
+		e.u64(cookie)
+		e.fixed(make([]byte, 8))
+		e.u32(count)
+	}))
+	d := &decoder{data: reply}
+	d.next(4 * 5)
+	if status, nfsStatus := d.u32(), d.u32(); status != acceptSuccess || nfsStatus != nfs3OK {
+		t.Fatalf("readdir: got accept status %d and NFS status %d", status, nfsStatus)
+	}
+	d.next(4 + fattrSize + 8) // Attributes and verifier.
+	var names []string
+	var cookies []uint64
+	for d.u32() == 1 {
+		d.u64() // fileid
+		names = append(names, d.str(maxName))
+		cookies = append(cookies, d.u64())
+	}
+	eof := d.u32() == 1
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	return names, cookies, eof
+}
+
+func TestReaddirPages(t *testing.T) {
+	root := newTestTree()
+	want := []string{".", "..", "colliding", "deep", "dir", "long", "too-deep"}
+	for _, restart := range []bool{false, true} {
+		s := NewServer(root, nil)
+		dir := rootHandle(t, s)
+		var got []string
+		cookie := uint64(0)
+		for pages := 0; ; pages++ {
+			if pages > len(want) {
+				t.Fatalf("restart %v: got no end after %q", restart, got)
+			}
+			if restart {
+				// A new server has no record of where the last page ended.
+				s = NewServer(root, nil)
+			}
+			// Room for two short entries.
+			names, cookies, eof := readdirPage(t, s, dir, cookie, 4+4+fattrSize+8+8+2*(4+8+4+4+8))
+			got = append(got, names...)
+			if eof {
+				break
+			}
+			if len(cookies) == 0 {
+				t.Fatalf("restart %v: got an empty page after %q", restart, got)
+			}
+			cookie = cookies[len(cookies)-1]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("restart %v: got %q, want %q", restart, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+)
+
+// decoder reads XDR values, remembering the first error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = errors.New("message too short")
+		return make([]byte, n)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+// opaque reads variable-length opaque data of at most max bytes.
+func (d *decoder) opaque(max int) []byte {
+	n := int(d.u32())
+	if d.err == nil && n > max {
+		d.err = errors.Errorf("opaque data too long: %d bytes", n)
+	}
+	if d.err != nil {
+		return nil
+	}
+	b := d.next(n)
+	d.next(pad(n))
+	return b
+}
+
+func (d *decoder) str(max int) string {
+	return string(d.opaque(max))
+}
+
+// encoder writes XDR values.
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) u32(v uint32) {
+	e.data = append(e.data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v >> 32))
+	e.u32(uint32(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u32(1)
+	} else {
+		e.u32(0)
+	}
+}
+
+// fixed writes fixed-length opaque data.
+func (e *encoder) fixed(b []byte) {
+	e.data = append(e.data, b...)
+	e.data = append(e.data, make([]byte, pad(len(b)))...)
+}
+
+func (e *encoder) opaque(b []byte) {
+	e.u32(uint32(len(b)))
+	e.fixed(b)
+}
+
+func (e *encoder) str(s string) {
+	e.opaque([]byte(s))
+}
+
+// pad returns the padding after n bytes, which XDR aligns to 4 bytes.
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
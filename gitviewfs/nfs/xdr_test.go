@@ -0,0 +1,128 @@
+package nfs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// codecTests are values with their XDR encodings: big-endian, and padded to multiples of 4 bytes.
+var codecTests = []struct {
+	name   string
+	encode func(e *encoder)
+	decode func(d *decoder) interface{}
+	value  interface{}
+	want   []byte
+}{
+	{
+		name:   "u32",
+		encode: func(e *encoder) { e.u32(0x01020304) },
+		decode: func(d *decoder) interface{} { return d.u32() },
+		value:  uint32(0x01020304),
+		want:   []byte{1, 2, 3, 4},
+	},
+	{
+		name:   "u64",
+		encode: func(e *encoder) { e.u64(0x05060708090a0b0c) },
+		decode: func(d *decoder) interface{} { return d.u64() },
+		value:  uint64(0x05060708090a0b0c),
+		want:   []byte{5, 6, 7, 8, 9, 0xa, 0xb, 0xc},
+	},
+	{
+		name:   "true",
+		encode: func(e *encoder) { e.bool(true) },
+		decode: func(d *decoder) interface{} { return d.u32() },
+		value:  uint32(1),
+		want:   []byte{0, 0, 0, 1},
+	},
+	{
+		name:   "false",
+		encode: func(e *encoder) { e.bool(false) },
+		decode: func(d *decoder) interface{} { return d.u32() },
+		value:  uint32(0),
+		want:   []byte{0, 0, 0, 0},
+	},
+	{
+		name:   "empty opaque",
+		encode: func(e *encoder) { e.opaque(nil) },
+		decode: func(d *decoder) interface{} { return d.opaque(0) },
+		value:  []byte{},
+		want:   []byte{0, 0, 0, 0},
+	},
+	{
+		name:   "opaque",
+		encode: func(e *encoder) { e.opaque([]byte{1, 2, 3, 4, 5}) },
+		decode: func(d *decoder) interface{} { return d.opaque(5) },
+		value:  []byte{1, 2, 3, 4, 5},
+		want:   []byte{0, 0, 0, 5, 1, 2, 3, 4, 5, 0, 0, 0},
+	},
+	{
+		name:   "str",
+		encode: func(e *encoder) { e.str("abcde") },
+		decode: func(d *decoder) interface{} { return d.str(maxName) },
+		value:  "abcde",
+		want:   []byte{0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e', 0, 0, 0},
+	},
+	{
+		name:   "str without padding",
+		encode: func(e *encoder) { e.str("abcd") },
+		decode: func(d *decoder) interface{} { return d.str(maxName) },
+		value:  "abcd",
+		want:   []byte{0, 0, 0, 4, 'a', 'b', 'c', 'd'},
+	},
+	{
+		name:   "fixed",
+		encode: func(e *encoder) { e.fixed([]byte{9, 8, 7}) },
+		decode: func(d *decoder) interface{} { return d.next(4) },
+		value:  []byte{9, 8, 7, 0},
+		want:   []byte{9, 8, 7, 0},
+	},
+}
+
+func TestCodec(t *testing.T) {
+	for _, test := range codecTests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &encoder{}
+			test.encode(e)
+			if !bytes.Equal(e.data, test.want) {
+				t.Errorf("encoded % x, want % x", e.data, test.want)
+			}
+
+			d := &decoder{data: test.want}
+			if got := test.decode(d); d.err != nil || !reflect.DeepEqual(got, test.value) {
+				t.Errorf("decoded %#v and error %v, want %#v", got, d.err, test.value)
+			}
+			if len(d.data) != 0 {
+				t.Errorf("%d bytes left over", len(d.data))
+			}
+
+			// Every prefix of the encoding is an error, not a shorter value.
+			for n := 0; n < len(test.want); n++ {
+				d := &decoder{data: test.want[:n]}
+				if test.decode(d); d.err == nil {
+					t.Errorf("%d of %d bytes: got no error", n, len(test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestDecoderOpaqueTooLong(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "over max", data: []byte{0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e', 0, 0, 0}},
+		{name: "negative length", data: []byte{0xff, 0xff, 0xff, 0xff, 'a'}},
+		{name: "longer than message", data: []byte{0, 0, 0, 4, 'a'}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &decoder{data: test.data}
+			d.opaque(4)
+			if d.err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
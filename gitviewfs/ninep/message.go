@@ -0,0 +1,140 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/pkg/errors"
+)
+
+// Message types of 9P2000.L. Each R-message's type is its T-message's type plus one.
+const (
+	rlerror      = 7
+	tstatfs      = 8
+	tlopen       = 12
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	trename      = 20
+	treadlink    = 22
+	tgetattr     = 24
+	tsetattr     = 26
+	txattrwalk   = 30
+	txattrcreate = 32
+	treaddir     = 40
+	tfsync       = 50
+	tlock        = 52
+	tgetlock     = 54
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	tauth        = 102
+	tattach      = 104
+	tflush       = 108
+	twalk        = 110
+	tread        = 116
+	twrite       = 118
+	tclunk       = 120
+	tremove      = 122
+)
+
+// headerSize is the size of a message's size, type and tag.
+const headerSize = 7
+
+// Qid types.
+const (
+	qtDir     = 0x80
+	qtSymlink = 0x02
+	qtFile    = 0x00
+)
+
+// qidSize is the encoded size of a qid.
+const qidSize = 13
+
+// qid is the server's identity for a file.
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// decoder reads the fields of a message, remembering the first error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.data) < n {
+		d.err = errors.New("message too short")
+		return make([]byte, n)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+// done returns an error if the request was malformed.
+func (d *decoder) done() *fserror.Error {
+	if d.err != nil {
+		return errInvalid
+	}
+	return nil
+}
+
+// encoder builds a message.
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.data = append(e.data, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.data = append(e.data, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.data = append(e.data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) str(v string) {
+	e.u16(uint16(len(v)))
+	e.data = append(e.data, v...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
@@ -0,0 +1,261 @@
+package ninep
+
+import (
+	"bytes"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree/fstreetest"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	e := &encoder{}
+	e.u8(0xfe)
+	e.u16(0xbeef)
+	e.u32(0xdeadbeef)
+	e.u64(0x0123456789abcdef)
+	e.str("")
+	e.str("refs/heads/master")
+	e.qid(qid{typ: qtSymlink, version: 7, path: 1<<63 | 42})
+
+	d := &decoder{data: e.data}
+	if got := d.u8(); got != 0xfe {
+		t.Errorf("u8: got %#x", got)
+	}
+	if got := d.u16(); got != 0xbeef {
+		t.Errorf("u16: got %#x", got)
+	}
+	if got := d.u32(); got != 0xdeadbeef {
+		t.Errorf("u32: got %#x", got)
+	}
+	if got := d.u64(); got != 0x0123456789abcdef {
+		t.Errorf("u64: got %#x", got)
+	}
+	if got := d.str(); got != "" {
+		t.Errorf("empty str: got %q", got)
+	}
+	if got := d.str(); got != "refs/heads/master" {
+		t.Errorf("str: got %q", got)
+	}
+	if got := (qid{typ: d.u8(), version: d.u32(), path: d.u64()}); got != (qid{typ: qtSymlink, version: 7, path: 1<<63 | 42}) {
+		t.Errorf("qid: got %+v", got)
+	}
+	if ferr := d.done(); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if len(d.data) != 0 {
+		t.Errorf("%d bytes left over", len(d.data))
+	}
+}
+
+func TestCodecLittleEndian(t *testing.T) {
+	e := &encoder{}
+	e.u16(0x0102)
+	e.u32(0x03040506)
+	e.u64(0x0708090a0b0c0d0e)
+	e.str("ab")
+	want := []byte{2, 1, 6, 5, 4, 3, 0xe, 0xd, 0xc, 0xb, 0xa, 9, 8, 7, 2, 0, 'a', 'b'}
+	if !bytes.Equal(e.data, want) {
+		t.Errorf("got % x, want % x", e.data, want)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	e := &encoder{}
+	e.u32(1)
+	e.u64(2)
+	e.str("name")
+	for n := 0; n < len(e.data); n++ {
+		d := &decoder{data: e.data[:n]}
+		d.u32()
+		d.u64()
+		d.str()
+		if d.done() != errInvalid {
+			t.Errorf("%d of %d bytes: got no error", n, len(e.data))
+		}
+	}
+
+	// A string's length can claim more than the message has.
+	d := &decoder{data: []byte{0xff, 0xff, 'a'}}
+	if got := d.str(); got != string(make([]byte, 0xffff)) || d.done() != errInvalid {
+		t.Errorf("got %d bytes and error %v", len(got), d.done())
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	message := func(size uint32, body ...byte) []byte {
+		e := &encoder{}
+		e.u32(size)
+		e.u8(tversion)
+		e.u16(0xffff)
+		e.data = append(e.data, body...)
+		return e.data
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		wantBody []byte
+		wantErr  bool
+	}{
+		{name: "empty body", data: message(headerSize), wantBody: []byte{}},
+		{name: "body", data: message(headerSize+2, 1, 2), wantBody: []byte{1, 2}},
+		{name: "size smaller than header", data: message(headerSize - 1), wantErr: true},
+		{name: "size larger than msize", data: message(maxMsize + 1), wantErr: true},
+		{name: "truncated header", data: message(headerSize)[:5], wantErr: true},
+		{name: "truncated body", data: message(headerSize+4, 1, 2), wantErr: true},
+		{name: "no message", data: nil, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &conn{msize: maxMsize}
+			msgType, tag, body, err := c.readMessage(bytes.NewReader(test.data))
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgType != tversion || tag != 0xffff || !bytes.Equal(body, test.wantBody) {
+				t.Errorf("got type %d, tag %#x and body %v", msgType, tag, body)
+			}
+		})
+	}
+}
+
+func newTestConn() *conn {
+	root := fstreetest.Dir{
+		"dir": fstreetest.Dir{
+			"file": fstreetest.NewFile("file", filemode.Regular, "contents\n"),
+		},
+		"link": fstreetest.NewFile("link", filemode.Symlink, "dir/file"),
+	}
+	return &conn{server: NewServer(root, nil), msize: maxMsize, fids: map[uint32]*fid{}}
+}
+
+// request returns a request body encoded by encode.
+func request(encode func(e *encoder)) []byte {
+	e := &encoder{}
+	encode(e)
+	return e.data
+}
+
+// requests are valid requests for each handler that reads a body, given that fid 1 is attached to
+// the root and fid 2 is the open file dir/file.
+var requests = map[uint8][]byte{
+	tversion:  request(func(e *encoder) { e.u32(8192); e.str(version) }),
+	tattach:   request(func(e *encoder) { e.u32(3); e.u32(^uint32(0)); e.str("user"); e.str("dir") }),
+	tflush:    request(func(e *encoder) { e.u16(1) }),
+	twalk:     request(func(e *encoder) { e.u32(1); e.u32(4); e.u16(2); e.str("dir"); e.str("file") }),
+	tlopen:    request(func(e *encoder) { e.u32(1); e.u32(0) }),
+	tread:     request(func(e *encoder) { e.u32(2); e.u64(3); e.u32(100) }),
+	treaddir:  request(func(e *encoder) { e.u32(1); e.u64(0); e.u32(1000) }),
+	treadlink: request(func(e *encoder) { e.u32(1) }),
+	tgetattr:  request(func(e *encoder) { e.u32(2); e.u64(getattrBasic) }),
+	tstatfs:   request(func(e *encoder) { e.u32(1) }),
+	tfsync:    request(func(e *encoder) { e.u32(2) }),
+	tclunk:    request(func(e *encoder) { e.u32(2) }),
+	tremove:   request(func(e *encoder) { e.u32(2) }),
+}
+
+// setUpFids attaches fid 1 to the root and opens dir/file as fid 2.
+func setUpFids(t *testing.T, c *conn) {
+	for _, step := range []struct {
+		msgType uint8
+		body    []byte
+	}{
+		{tattach, request(func(e *encoder) { e.u32(1); e.u32(^uint32(0)); e.str("user"); e.str("") })},
+		{twalk, request(func(e *encoder) { e.u32(1); e.u32(2); e.u16(2); e.str("dir"); e.str("file") })},
+		{tlopen, request(func(e *encoder) { e.u32(2); e.u32(0) })},
+	} {
+		if replyType, reply := c.handle(step.msgType, step.body); replyType != step.msgType+1 {
+			t.Fatalf("set up: request %d failed: % x", step.msgType, reply)
+		}
+	}
+}
+
+func TestHandleTruncated(t *testing.T) {
+	for msgType, body := range requests {
+		for n := 0; n < len(body); n++ {
+			c := newTestConn()
+			setUpFids(t, c)
+			replyType, reply := c.handle(msgType, body[:n])
+			if replyType != rlerror {
+				t.Errorf("%s with %d of %d bytes: got reply type %d", handlers[msgType].name, n, len(body), replyType)
+				continue
+			}
+			d := &decoder{data: reply}
+			if errno := d.u32(); errno != uint32(syscall.EINVAL) {
+				t.Errorf("%s with %d of %d bytes: got errno %d", handlers[msgType].name, n, len(body), errno)
+			}
+		}
+	}
+}
+
+func TestHandleGarbage(t *testing.T) {
+	garbage := [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		bytes.Repeat([]byte{0x80}, 64),
+		{1, 0, 0, 0, 4, 0, 0, 0, 0xff, 0xff, 'a'},
+	}
+	for msgType := 0; msgType < 256; msgType++ {
+		for _, body := range garbage {
+			c := newTestConn()
+			setUpFids(t, c)
+			// Replies don't matter, only that there's no panic.
+			c.handle(uint8(msgType), body)
+		}
+	}
+}
+
+func TestHandleRoundTrip(t *testing.T) {
+	c := newTestConn()
+	setUpFids(t, c)
+
+	replyType, reply := c.handle(tread, requests[tread])
+	if replyType != tread+1 {
+		t.Fatalf("got reply type %d", replyType)
+	}
+	d := &decoder{data: reply}
+	if n := d.u32(); string(d.next(int(n))) != "tents\n" || d.done() != nil {
+		t.Errorf("read: got % x", reply)
+	}
+
+	replyType, reply = c.handle(twalk, request(func(e *encoder) { e.u32(1); e.u32(5); e.u16(1); e.str("link") }))
+	if replyType != twalk+1 {
+		t.Fatalf("walk: got reply type %d", replyType)
+	}
+	d = &decoder{data: reply}
+	if n, typ := d.u16(), d.u8(); n != 1 || typ != qtSymlink {
+		t.Errorf("walk: got % x", reply)
+	}
+	replyType, reply = c.handle(treadlink, request(func(e *encoder) { e.u32(5) }))
+	d = &decoder{data: reply}
+	if target := d.str(); replyType != treadlink+1 || target != "dir/file" {
+		t.Errorf("readlink: got type %d and % x", replyType, reply)
+	}
+
+	replyType, reply = c.handle(tlopen, requests[tlopen])
+	if replyType != tlopen+1 {
+		t.Fatalf("open: got reply type %d", replyType)
+	}
+	replyType, reply = c.handle(treaddir, requests[treaddir])
+	if replyType != treaddir+1 {
+		t.Fatalf("readdir: got reply type %d", replyType)
+	}
+	d = &decoder{data: reply}
+	d.u32()
+	var names []string
+	for len(d.data) > 0 && d.err == nil {
+		d.next(qidSize)
+		d.u64()
+		d.u8()
+		names = append(names, d.str())
+	}
+	if want := []string{".", "..", "dir", "link"}; d.done() != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("readdir: got %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,713 @@
+// Package ninep serves a tree over 9P2000.L, the 9P dialect of Linux's v9fs client, so virtual
+// machines and sandboxes can mount it without FUSE. It's read-only.
+//
+// Qid paths are fstree.FileIDs, derived from object hashes.
+package ninep
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/logging"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// version is the only protocol version the server speaks.
+const version = "9P2000.L"
+
+// maxMsize is the largest message size the server agrees to.
+const maxMsize = 1 << 20
+
+// minMsize is the smallest message size the server agrees to, enough for any reply but Rread and
+// Rreaddir, which are limited by the requested count.
+const minMsize = 4096
+
+// maxWalk is the most names one Twalk can have.
+const maxWalk = 16
+
+var (
+	errBadFid      = fserror.Expected(fuse.Status(syscall.EBADF))
+	errInvalid     = fserror.Expected(fuse.EINVAL)
+	errReadOnly    = fserror.Expected(fuse.EROFS)
+	errUnsupported = fserror.ErrUnsupported
+)
+
+// Server serves a tree to 9P clients.
+type Server struct {
+	root    fstree.Node
+	logger  *logging.Logger
+	started time.Time
+}
+
+func NewServer(root fstree.Node, logger *logging.Logger) *Server {
+	return &Server{root: root, logger: logger, started: time.Now()}
+}
+
+// Serve serves connections from listener until accepting one fails.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "accept connection failed")
+		}
+		go s.serveConn(netConn)
+	}
+}
+
+// conn is a client connection. Its requests are handled one at a time, in order, so Tflush never
+// has anything to cancel.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	logger  *logging.Logger
+	msize   uint32
+	fids    map[uint32]*fid
+}
+
+// fid is a node a client has walked to.
+type fid struct {
+	node fstree.Node
+	// path is the node's path from the tree root, and root is the length of the prefix that was
+	// attached, which ".." doesn't leave.
+	path   []string
+	root   int
+	commit *object.Commit
+	open   bool
+	// reader is an open file's contents.
+	reader *fstree.FileReader
+	// entries are an open directory's entries, listed when it was opened.
+	entries []dirEntry
+}
+
+type dirEntry struct {
+	name string
+	qid  qid
+}
+
+type handler struct {
+	name   string
+	handle func(c *conn, d *decoder, e *encoder) *fserror.Error
+}
+
+var handlers = map[uint8]handler{
+	tversion:     {"Tversion", (*conn).version},
+	tauth:        {"Tauth", unsupported},
+	tattach:      {"Tattach", (*conn).attach},
+	tflush:       {"Tflush", (*conn).flush},
+	twalk:        {"Twalk", (*conn).walk},
+	tlopen:       {"Tlopen", (*conn).lopen},
+	tread:        {"Tread", (*conn).read},
+	treaddir:     {"Treaddir", (*conn).readdir},
+	treadlink:    {"Treadlink", (*conn).readlink},
+	tgetattr:     {"Tgetattr", (*conn).getattr},
+	tstatfs:      {"Tstatfs", (*conn).statfs},
+	tfsync:       {"Tfsync", (*conn).fsync},
+	tlock:        {"Tlock", (*conn).lock},
+	tgetlock:     {"Tgetlock", (*conn).getlock},
+	tclunk:       {"Tclunk", (*conn).clunk},
+	tremove:      {"Tremove", (*conn).remove},
+	txattrwalk:   {"Txattrwalk", unsupported},
+	txattrcreate: {"Txattrcreate", readOnly},
+	tlcreate:     {"Tlcreate", readOnly},
+	tsymlink:     {"Tsymlink", readOnly},
+	tmknod:       {"Tmknod", readOnly},
+	trename:      {"Trename", readOnly},
+	tsetattr:     {"Tsetattr", readOnly},
+	tlink:        {"Tlink", readOnly},
+	tmkdir:       {"Tmkdir", readOnly},
+	trenameat:    {"Trenameat", readOnly},
+	tunlinkat:    {"Tunlinkat", readOnly},
+	twrite:       {"Twrite", readOnly},
+}
+
+func unsupported(c *conn, d *decoder, e *encoder) *fserror.Error {
+	return errUnsupported
+}
+
+func readOnly(c *conn, d *decoder, e *encoder) *fserror.Error {
+	return errReadOnly
+}
+
+func (s *Server) serveConn(netConn net.Conn) {
+	c := &conn{
+		server:  s,
+		netConn: netConn,
+		logger:  s.logger.With("remote", netConn.RemoteAddr().String()),
+		msize:   maxMsize,
+		fids:    map[uint32]*fid{},
+	}
+	defer c.close()
+	c.logger.Debug("connection opened")
+
+	reader := bufio.NewReader(netConn)
+	for {
+		msgType, tag, body, err := c.readMessage(reader)
+		if err == io.EOF {
+			c.logger.Debug("connection closed")
+			return
+		} else if err != nil {
+			c.logger.Warn("read request failed", "err", err)
+			return
+		}
+		replyType, reply := c.handle(msgType, body)
+		if err := c.writeMessage(replyType, tag, reply); err != nil {
+			c.logger.Warn("write reply failed", "err", err)
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.clunkAll()
+	c.netConn.Close()
+}
+
+func (c *conn) clunkAll() {
+	for id, f := range c.fids {
+		f.close()
+		delete(c.fids, id)
+	}
+}
+
+func (c *conn) readMessage(reader io.Reader) (uint8, uint16, []byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size < headerSize || size > c.msize {
+		return 0, 0, nil, errors.Errorf("invalid message size %d", size)
+	}
+	body := make([]byte, size-headerSize)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, 0, nil, errors.Wrap(err, "read message failed")
+	}
+	return header[4], binary.LittleEndian.Uint16(header[5:]), body, nil
+}
+
+func (c *conn) writeMessage(msgType uint8, tag uint16, body []byte) error {
+	e := &encoder{data: make([]byte, 0, headerSize+len(body))}
+	e.u32(uint32(headerSize + len(body)))
+	e.u8(msgType)
+	e.u16(tag)
+	e.data = append(e.data, body...)
+	_, err := c.netConn.Write(e.data)
+	return err
+}
+
+// handle handles a request and returns the reply.
+func (c *conn) handle(msgType uint8, body []byte) (uint8, []byte) {
+	h, ok := handlers[msgType]
+	if !ok {
+		h = handler{name: "unknown", handle: unsupported}
+	}
+	c.logger.Debug("request", "op", h.name)
+
+	d := &decoder{data: body}
+	e := &encoder{}
+	ferr := h.handle(c, d, e)
+	if ferr == nil {
+		return msgType + 1, e.data
+	}
+
+	if ferr.UnexpectedErr != nil {
+		c.logger.Error("unexpected error", "op", h.name, "kind", ferr.Kind, "err", ferr.UnexpectedErr)
+	} else {
+		c.logger.Debug("request failed", "op", h.name, "kind", ferr.Kind, "status", ferr.Status)
+	}
+	e = &encoder{}
+	e.u32(uint32(ferr.Status))
+	return rlerror, e.data
+}
+
+func (c *conn) fid(id uint32) (*fid, *fserror.Error) {
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, errBadFid
+	}
+	return f, nil
+}
+
+func (c *conn) version(d *decoder, e *encoder) *fserror.Error {
+	msize, clientVersion := d.u32(), d.str()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	if msize < minMsize {
+		return errInvalid
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	// A new version starts a new session.
+	c.clunkAll()
+
+	e.u32(c.msize)
+	if strings.HasPrefix(clientVersion, version) {
+		e.str(version)
+	} else {
+		e.str("unknown")
+	}
+	return nil
+}
+
+func (c *conn) attach(d *decoder, e *encoder) *fserror.Error {
+	id, _, _, aname := d.u32(), d.u32(), d.str(), d.str()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	if _, ok := c.fids[id]; ok {
+		return errBadFid
+	}
+
+	// The attached name selects a subtree, like refs/heads/master.
+	var parts []string
+	if name := strings.Trim(path.Clean("/"+aname), "/"); name != "" {
+		parts = strings.Split(name, "/")
+	}
+	node, commit, ferr := c.server.lookup(parts)
+	if ferr != nil {
+		return ferr
+	}
+	f := &fid{node: node, path: parts, root: len(parts), commit: commit}
+	c.fids[id] = f
+	e.qid(f.qid())
+	return nil
+}
+
+func (c *conn) flush(d *decoder, e *encoder) *fserror.Error {
+	d.u16()
+	return d.done()
+}
+
+func (c *conn) walk(d *decoder, e *encoder) *fserror.Error {
+	id, newID, n := d.u32(), d.u32(), d.u16()
+	names := make([]string, 0, n)
+	for i := 0; i < int(n) && d.err == nil; i++ {
+		names = append(names, d.str())
+	}
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	if n > maxWalk {
+		return errInvalid
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+	if _, ok := c.fids[newID]; ok && newID != id {
+		return errBadFid
+	}
+
+	walked := &fid{node: f.node, path: f.path, root: f.root, commit: f.commit}
+	var qids []qid
+	for i, name := range names {
+		next, ferr := c.server.walk(walked, name)
+		if ferr != nil {
+			if i == 0 {
+				return ferr
+			}
+			break
+		}
+		walked = next
+		qids = append(qids, walked.qid())
+	}
+	if len(qids) == len(names) {
+		if newID == id {
+			f.close()
+		}
+		c.fids[newID] = walked
+	}
+
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return nil
+}
+
+// Tlopen's flags are Linux's open flags, whatever the server's OS.
+const (
+	linuxAccessMode = 03
+	linuxReadOnly   = 00
+	linuxTruncate   = 01000
+)
+
+func (c *conn) lopen(d *decoder, e *encoder) *fserror.Error {
+	id, flags := d.u32(), d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+	if flags&linuxAccessMode != linuxReadOnly || flags&linuxTruncate != 0 {
+		return errReadOnly
+	}
+	if f.open {
+		return errInvalid
+	}
+
+	switch n := f.node.(type) {
+	case fstree.DirNode:
+		entries, ferr := f.list(n)
+		if ferr != nil {
+			return ferr
+		}
+		f.entries = entries
+	case fstree.FileNode:
+		f.reader = fstree.NewFileReader(n.File())
+	}
+	f.open = true
+	e.qid(f.qid())
+	// An iounit of 0 lets the client use the largest reads that fit in a message.
+	e.u32(0)
+	return nil
+}
+
+func (c *conn) read(d *decoder, e *encoder) *fserror.Error {
+	id, offset, count := d.u32(), d.u64(), d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+	if _, ok := f.node.(fstree.DirNode); ok {
+		return fserror.Expected(fuse.Status(syscall.EISDIR))
+	}
+	if f.reader == nil {
+		return errBadFid
+	}
+	if max := c.msize - headerSize - 4; count > max {
+		count = max
+	}
+
+	if _, err := f.reader.Seek(int64(offset), io.SeekStart); err != nil {
+		return errInvalid
+	}
+	data := make([]byte, count)
+	n, err := io.ReadFull(f.reader, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fserror.Unexpected(err)
+	}
+	e.u32(uint32(n))
+	e.data = append(e.data, data[:n]...)
+	return nil
+}
+
+func (c *conn) readdir(d *decoder, e *encoder) *fserror.Error {
+	id, offset, count := d.u32(), d.u64(), d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+	if !f.open || f.entries == nil {
+		return errBadFid
+	}
+	if max := c.msize - headerSize - 4; count > max {
+		count = max
+	}
+
+	// An entry's offset is the offset of the one after it.
+	entries := &encoder{}
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		entry := f.entries[i]
+		if len(entries.data)+qidSize+8+1+2+len(entry.name) > int(count) {
+			break
+		}
+		entries.qid(entry.qid)
+		entries.u64(i + 1)
+		entries.u8(direntType(entry.qid))
+		entries.str(entry.name)
+	}
+	e.u32(uint32(len(entries.data)))
+	e.data = append(e.data, entries.data...)
+	return nil
+}
+
+func (c *conn) readlink(d *decoder, e *encoder) *fserror.Error {
+	id := d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+	fileNode, ok := f.node.(fstree.FileNode)
+	if !ok || fileNode.File().Mode != filemode.Symlink {
+		return errInvalid
+	}
+
+	reader, err := fileNode.File().Reader()
+	if err != nil {
+		return fserror.Unexpected(err)
+	}
+	defer reader.Close()
+	target, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fserror.Unexpected(err)
+	}
+	e.str(string(target))
+	return nil
+}
+
+// getattrBasic is the mask of the attributes in struct stat, which are the ones Rgetattr has.
+const getattrBasic = 0x7ff
+
+func (c *conn) getattr(d *decoder, e *encoder) *fserror.Error {
+	id, _ := d.u32(), d.u64()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+
+	var mode uint32
+	var size uint64
+	switch n := f.node.(type) {
+	case fstree.DirNode:
+		mode = syscall.S_IFDIR | 0555
+	case fstree.FileNode:
+		size = uint64(n.File().Size)
+		switch n.File().Mode {
+		case filemode.Symlink:
+			mode = syscall.S_IFLNK | 0777
+		case filemode.Executable:
+			mode = syscall.S_IFREG | 0555
+		default:
+			mode = syscall.S_IFREG | 0444
+		}
+	}
+	modTime := c.server.started
+	if f.commit != nil {
+		modTime = f.commit.Committer.When
+	}
+
+	e.u64(getattrBasic)
+	e.qid(f.qid())
+	e.u32(mode)
+	e.u32(uint32(os.Getuid()))
+	e.u32(uint32(os.Getgid()))
+	e.u64(1)                  // nlink
+	e.u64(0)                  // rdev
+	e.u64(size)               // size
+	e.u64(4096)               // blksize
+	e.u64((size + 511) / 512) // blocks
+	for i := 0; i < 4; i++ {
+		// atime, mtime, ctime and btime.
+		e.u64(uint64(modTime.Unix()))
+		e.u64(uint64(modTime.Nanosecond()))
+	}
+	e.u64(0) // gen
+	e.u64(0) // data_version
+	return nil
+}
+
+// v9fsMagic is the filesystem type Linux reports for 9P mounts.
+const v9fsMagic = 0x01021997
+
+func (c *conn) statfs(d *decoder, e *encoder) *fserror.Error {
+	id := d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	if _, ferr := c.fid(id); ferr != nil {
+		return ferr
+	}
+	e.u32(v9fsMagic)
+	e.u32(4096) // bsize
+	for i := 0; i < 6; i++ {
+		// blocks, bfree, bavail, files, ffree and fsid.
+		e.u64(0)
+	}
+	e.u32(255) // namelen
+	return nil
+}
+
+func (c *conn) fsync(d *decoder, e *encoder) *fserror.Error {
+	id := d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	_, ferr := c.fid(id)
+	return ferr
+}
+
+// lock grants every lock, since nothing can be changed.
+func (c *conn) lock(d *decoder, e *encoder) *fserror.Error {
+	id := d.u32()
+	d.u8()  // type
+	d.u32() // flags
+	d.u64() // start
+	d.u64() // length
+	d.u32() // proc_id
+	d.str() // client_id
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	if _, ferr := c.fid(id); ferr != nil {
+		return ferr
+	}
+	e.u8(0) // success
+	return nil
+}
+
+// getlock reports that nothing holds the lock, since lock doesn't keep track.
+func (c *conn) getlock(d *decoder, e *encoder) *fserror.Error {
+	id, _, start, length, procID, clientID := d.u32(), d.u8(), d.u64(), d.u64(), d.u32(), d.str()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	if _, ferr := c.fid(id); ferr != nil {
+		return ferr
+	}
+	e.u8(syscall.F_UNLCK)
+	e.u64(start)
+	e.u64(length)
+	e.u32(procID)
+	e.str(clientID)
+	return nil
+}
+
+func (c *conn) clunk(d *decoder, e *encoder) *fserror.Error {
+	id := d.u32()
+	if ferr := d.done(); ferr != nil {
+		return ferr
+	}
+	f, ferr := c.fid(id)
+	if ferr != nil {
+		return ferr
+	}
+	f.close()
+	delete(c.fids, id)
+	return nil
+}
+
+// remove fails, but clunks the fid like a successful remove.
+func (c *conn) remove(d *decoder, e *encoder) *fserror.Error {
+	if ferr := c.clunk(d, e); ferr != nil {
+		return ferr
+	}
+	return errReadOnly
+}
+
+// lookup finds the node at parts below the tree root, along with the commit it's part of, if any.
+func (s *Server) lookup(parts []string) (fstree.Node, *object.Commit, *fserror.Error) {
+	f := &fid{node: s.root}
+	if commitNode, ok := s.root.(fstree.CommitDirNode); ok {
+		f.commit = commitNode.Commit()
+	}
+	for _, part := range parts {
+		next, ferr := s.walk(f, part)
+		if ferr != nil {
+			return nil, nil, ferr
+		}
+		f = next
+	}
+	return f.node, f.commit, nil
+}
+
+// walk returns a new, unopened fid for name in f's directory.
+func (s *Server) walk(f *fid, name string) (*fid, *fserror.Error) {
+	if name == ".." {
+		if len(f.path) == f.root {
+			return &fid{node: f.node, path: f.path, root: f.root, commit: f.commit}, nil
+		}
+		parentPath := f.path[:len(f.path)-1]
+		node, commit, ferr := s.lookup(parentPath)
+		if ferr != nil {
+			return nil, ferr
+		}
+		return &fid{node: node, path: parentPath, root: f.root, commit: commit}, nil
+	}
+
+	dirNode, ok := f.node.(fstree.DirNode)
+	if !ok {
+		return nil, fserror.ErrNotDir
+	}
+	child, ferr := fstree.Child(dirNode, name)
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	next := &fid{node: child, path: append(f.path[:len(f.path):len(f.path)], name), root: f.root, commit: f.commit}
+	if commitNode, ok := child.(fstree.CommitDirNode); ok {
+		next.commit = commitNode.Commit()
+	}
+	return next, nil
+}
+
+// list returns the entries of f's directory, node, in name order.
+func (f *fid) list(node fstree.DirNode) ([]dirEntry, *fserror.Error) {
+	// ".." shows the directory's own qid; clients only use the type of the dot entries.
+	entries := []dirEntry{{name: ".", qid: f.qid()}, {name: "..", qid: f.qid()}}
+	children := fstree.ReadDir(node, "")
+	for {
+		child, ok, ferr := children.Next()
+		if ferr != nil {
+			return nil, ferr
+		}
+		if !ok {
+			return entries, nil
+		}
+		childPath := append(f.path[:len(f.path):len(f.path)], child.Name)
+		entries = append(entries, dirEntry{name: child.Name, qid: qidOf(child.Node, childPath)})
+	}
+}
+
+func (f *fid) qid() qid {
+	return qidOf(f.node, f.path)
+}
+
+func (f *fid) close() {
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
+
+// qidOf returns the qid of the node at nodePath.
+func qidOf(node fstree.Node, nodePath []string) qid {
+	q := qid{typ: qtDir, path: fstree.FileID(node, nodePath)}
+	if fileNode, ok := node.(fstree.FileNode); ok {
+		q.typ = qtFile
+		if fileNode.File().Mode == filemode.Symlink {
+			q.typ = qtSymlink
+		}
+	}
+	return q
+}
+
+// direntType returns the dirent type (DT_*) for a qid.
+func direntType(q qid) uint8 {
+	switch q.typ {
+	case qtDir:
+		return syscall.DT_DIR
+	case qtSymlink:
+		return syscall.DT_LNK
+	default:
+		return syscall.DT_REG
+	}
+}
@@ -0,0 +1,191 @@
+package overlay
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileNode is a file inside a commit view. Its upper copy, if any, hides lower, which is nil for
+// files that only exist in the upper directory.
+type fileNode struct {
+	o         *overlay
+	lower     fstree.FileNode
+	upperPath string
+
+	mu sync.Mutex
+	// file is the upper copy's contents when it last had stamp. It's reused while the copy is
+	// unchanged, so open files keep their readers between reads.
+	file  *object.File
+	stamp fileStamp
+}
+
+// fileStamp identifies a version of an upper file.
+type fileStamp struct {
+	size    int64
+	modTime int64
+	mode    os.FileMode
+}
+
+var _ fstree.WritableFileNode = (*fileNode)(nil)
+
+func (n *fileNode) File() *object.File {
+	info, err := os.Lstat(n.upperPath)
+	var stamp fileStamp
+	if err == nil {
+		stamp = fileStamp{size: info.Size(), modTime: info.ModTime().UnixNano(), mode: info.Mode()}
+	} else if n.lower != nil {
+		return n.lower.File()
+	} else {
+		// The file was removed from the upper directory behind our back; show it as empty.
+		info = nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.file == nil || n.stamp != stamp {
+		n.file = newDiskFile(n.upperPath, info)
+		n.stamp = stamp
+	}
+	return n.file
+}
+
+// copyUp copies the lower file to the upper directory, if it isn't there already. The overlay
+// mutex must be held.
+func (n *fileNode) copyUp() *fserror.Error {
+	if exists(n.upperPath) || n.lower == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(n.upperPath), 0755); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "create overlay directory for %s failed", n.upperPath))
+	}
+
+	file := n.lower.File()
+	reader, err := file.Reader()
+	if err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "open file %s failed", file.Hash))
+	}
+	defer reader.Close()
+
+	if file.Mode == filemode.Symlink {
+		target, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "read symlink %s failed", file.Hash))
+		}
+		if err := os.Symlink(string(target), n.upperPath); err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "copy up symlink %s failed", n.upperPath))
+		}
+		return nil
+	}
+	if err := copyFile(n.upperPath, reader, osFileMode(file.Mode)); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "copy up %s failed", n.upperPath))
+	}
+	return nil
+}
+
+func (n *fileNode) WriteAt(data []byte, off int64) (int, *fserror.Error) {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	if ferr := n.copyUp(); ferr != nil {
+		return 0, ferr
+	}
+	f, err := os.OpenFile(n.upperPath, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fserror.Unexpected(errors.Wrapf(err, "open overlay file %s failed", n.upperPath))
+	}
+	defer f.Close()
+	written, err := f.WriteAt(data, off)
+	if err != nil {
+		return written, fserror.Unexpected(errors.Wrapf(err, "write overlay file %s failed", n.upperPath))
+	}
+	return written, nil
+}
+
+func (n *fileNode) Truncate(size int64) *fserror.Error {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	if ferr := n.copyUp(); ferr != nil {
+		return ferr
+	}
+	if err := os.Truncate(n.upperPath, size); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "truncate overlay file %s failed", n.upperPath))
+	}
+	return nil
+}
+
+func (n *fileNode) SetMode(mode filemode.FileMode) *fserror.Error {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	if ferr := n.copyUp(); ferr != nil {
+		return ferr
+	}
+	if err := os.Chmod(n.upperPath, osFileMode(mode)); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "chmod overlay file %s failed", n.upperPath))
+	}
+	return nil
+}
+
+// newDiskFile returns a file whose contents are read from path when needed. info may be nil for
+// files that don't exist.
+func newDiskFile(path string, info os.FileInfo) *object.File {
+	obj := &diskObject{path: path}
+	mode := filemode.Regular
+	if info != nil {
+		obj.size = info.Size()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			mode = filemode.Symlink
+			obj.symlink = true
+		case info.Mode()&0111 != 0:
+			mode = filemode.Executable
+		}
+	}
+
+	return fstree.NewBlobFile(filepath.Base(path), mode, obj)
+}
+
+// diskObject is a blob stored in a file outside the repository. Its hash isn't computed, since
+// that would mean reading the whole file.
+type diskObject struct {
+	path    string
+	size    int64
+	symlink bool
+}
+
+var _ plumbing.EncodedObject = (*diskObject)(nil)
+
+func (o *diskObject) Hash() plumbing.Hash         { return plumbing.ZeroHash }
+func (o *diskObject) Type() plumbing.ObjectType   { return plumbing.BlobObject }
+func (o *diskObject) SetType(plumbing.ObjectType) {}
+func (o *diskObject) Size() int64                 { return o.size }
+func (o *diskObject) SetSize(int64)               {}
+func (o *diskObject) Writer() (io.WriteCloser, error) {
+	return nil, errors.New("overlay objects are read-only; change files through fileNode")
+}
+
+func (o *diskObject) Reader() (io.ReadCloser, error) {
+	if o.symlink {
+		target, err := os.Readlink(o.path)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader(target)), nil
+	}
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	return f, err
+}
@@ -0,0 +1,477 @@
+// Package overlay adds a copy-on-write layer over an fstree, like overlayfs. Directories showing a
+// commit accept changes, which are written to an upper directory on disk and never touch the
+// repository. The upper directory mirrors mount paths, so each reference gets its own scratch
+// space, like <upper>/refs/heads/master/__pycache__.
+//
+// Deleting a file that exists in the lower tree leaves a whiteout file named .wh.<name> in the
+// upper directory, and a directory recreated over a deleted one is marked opaque with a .wh..wh..opq
+// file, as in aufs.
+package overlay
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// metadataDirName is the virtual directory in commit views, which is never overlaid.
+	metadataDirName = ".gitviewfs"
+)
+
+// overlay is shared by all of the nodes in an overlaid tree. Its mutex serializes changes to the
+// upper directory, so copy-ups and whiteouts are consistent.
+type overlay struct {
+	mu sync.Mutex
+}
+
+// New returns lower with changes to its commit views stored under upperDir.
+func New(lower fstree.Node, upperDir string) (fstree.Node, error) {
+	upperDir, err := filepath.Abs(upperDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve overlay directory %s failed", upperDir)
+	}
+	if err := os.MkdirAll(upperDir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create overlay directory %s failed", upperDir)
+	}
+	return wrap(&overlay{}, lower, upperDir), nil
+}
+
+// wrap returns node as seen through the overlay, above any commit view.
+func wrap(o *overlay, node fstree.Node, upperPath string) fstree.Node {
+	switch n := node.(type) {
+	case fstree.WritableDirNode, fstree.WritableFileNode:
+		// Writable references keep their own changes.
+		return node
+	case fstree.CommitDirNode:
+		return &dirNode{o: o, lower: n, upperPath: upperPath, isRoot: true}
+	case fstree.DirNode:
+		return &passthroughDirNode{o: o, lower: n, upperPath: upperPath}
+	default:
+		return node
+	}
+}
+
+// passthroughDirNode is a read-only directory above the commit views, like refs/heads.
+type passthroughDirNode struct {
+	o         *overlay
+	lower     fstree.DirNode
+	upperPath string
+}
+
+func (n *passthroughDirNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	children, ferr := n.lower.Children()
+	if ferr != nil {
+		return nil, ferr
+	}
+	for name, child := range children {
+		children[name] = wrap(n.o, child, filepath.Join(n.upperPath, name))
+	}
+	return children, nil
+}
+
+// Lookup looks up children of lower directories without listing them, which also finds children
+// that aren't listed, like searches.
+func (n *passthroughDirNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	child, ferr := fstree.Child(n.lower, name)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return wrap(n.o, child, filepath.Join(n.upperPath, name)), nil
+}
+
+func (n *passthroughDirNode) ReadDir(after string) fstree.DirIterator {
+	return &passthroughIterator{dir: n, lower: fstree.ReadDir(n.lower, after)}
+}
+
+// passthroughIterator lists a passthroughDirNode's children as its lower directory lists them.
+type passthroughIterator struct {
+	dir   *passthroughDirNode
+	lower fstree.DirIterator
+}
+
+func (it *passthroughIterator) Next() (fstree.DirEntry, bool, *fserror.Error) {
+	entry, ok, ferr := it.lower.Next()
+	if ok {
+		entry.Node = wrap(it.dir.o, entry.Node, filepath.Join(it.dir.upperPath, entry.Name))
+	}
+	return entry, ok, ferr
+}
+
+// dirNode is a directory inside a commit view. lower is nil for directories that only exist in
+// the upper directory.
+type dirNode struct {
+	o         *overlay
+	lower     fstree.DirNode
+	upperPath string
+	// isRoot is set for the commit view itself.
+	isRoot bool
+}
+
+var (
+	_ fstree.WritableDirNode = (*dirNode)(nil)
+	_ fstree.LookupDirNode   = (*dirNode)(nil)
+)
+
+// readUpper lists the upper directory's files, and returns the names it whites out and whether it
+// hides the lower directory entirely.
+func (n *dirNode) readUpper() (infos []os.FileInfo, whiteouts map[string]bool, opaque bool, ferr *fserror.Error) {
+	all, err := ioutil.ReadDir(n.upperPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, false, fserror.Unexpected(errors.Wrapf(err, "list overlay directory %s failed", n.upperPath))
+	}
+	whiteouts = map[string]bool{}
+	for _, info := range all {
+		name := info.Name()
+		switch {
+		case name == opaqueMarker:
+			opaque = true
+		case strings.HasPrefix(name, whiteoutPrefix):
+			whiteouts[strings.TrimPrefix(name, whiteoutPrefix)] = true
+		case n.isRoot && name == metadataDirName:
+		default:
+			infos = append(infos, info)
+		}
+	}
+	return infos, whiteouts, opaque, nil
+}
+
+// child returns the overlaid child called name, given its upper file's info and lower node, either
+// of which may be nil.
+func (n *dirNode) child(name string, info os.FileInfo, lower fstree.Node) fstree.Node {
+	upperPath := filepath.Join(n.upperPath, name)
+	if info != nil {
+		if info.IsDir() {
+			lowerDir, _ := lower.(fstree.DirNode)
+			return &dirNode{o: n.o, lower: lowerDir, upperPath: upperPath}
+		}
+		lowerFile, _ := lower.(fstree.FileNode)
+		return &fileNode{o: n.o, lower: lowerFile, upperPath: upperPath}
+	}
+	switch l := lower.(type) {
+	case fstree.DirNode:
+		if n.isRoot && name == metadataDirName {
+			return lower
+		}
+		return &dirNode{o: n.o, lower: l, upperPath: upperPath}
+	case fstree.FileNode:
+		return &fileNode{o: n.o, lower: l, upperPath: upperPath}
+	}
+	return nil
+}
+
+func (n *dirNode) Children() (map[string]fstree.Node, *fserror.Error) {
+	infos, whiteouts, opaque, ferr := n.readUpper()
+	if ferr != nil {
+		return nil, ferr
+	}
+	lowerChildren := map[string]fstree.Node{}
+	if n.lower != nil && !opaque {
+		if lowerChildren, ferr = n.lower.Children(); ferr != nil {
+			return nil, ferr
+		}
+	}
+
+	children := map[string]fstree.Node{}
+	for name, lower := range lowerChildren {
+		if whiteouts[name] {
+			continue
+		}
+		if child := n.child(name, nil, lower); child != nil {
+			children[name] = child
+		}
+	}
+	for _, info := range infos {
+		name := info.Name()
+		var lower fstree.Node
+		if !whiteouts[name] {
+			lower = lowerChildren[name]
+		}
+		children[name] = n.child(name, info, lower)
+	}
+	return children, nil
+}
+
+// Lookup finds a child without listing either directory.
+func (n *dirNode) Lookup(name string) (fstree.Node, *fserror.Error) {
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return nil, fserror.ErrNotFound
+	}
+
+	var lower fstree.Node
+	if n.lower != nil && !exists(filepath.Join(n.upperPath, opaqueMarker)) &&
+		!exists(filepath.Join(n.upperPath, whiteoutPrefix+name)) {
+		var ferr *fserror.Error
+		if lower, ferr = fstree.Child(n.lower, name); ferr != nil && ferr.Kind != fserror.NotFound {
+			return nil, ferr
+		}
+	}
+
+	var info os.FileInfo
+	if !(n.isRoot && name == metadataDirName) {
+		var err error
+		info, err = os.Lstat(filepath.Join(n.upperPath, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fserror.Unexpected(errors.Wrapf(err, "look up overlay file %s failed", name))
+		}
+	}
+	if child := n.child(name, info, lower); child != nil {
+		return child, nil
+	}
+	return nil, fserror.ErrNotFound
+}
+
+// ensureUpper creates the directory's upper directory, if it doesn't exist yet.
+func (n *dirNode) ensureUpper() *fserror.Error {
+	if err := os.MkdirAll(n.upperPath, 0755); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "create overlay directory %s failed", n.upperPath))
+	}
+	return nil
+}
+
+// prepareNewName checks that name can be added to the directory, and clears any whiteout for it.
+// It returns whether a whiteout was cleared.
+func (n *dirNode) prepareNewName(name string) (bool, *fserror.Error) {
+	if strings.HasPrefix(name, whiteoutPrefix) || (n.isRoot && name == metadataDirName) {
+		return false, fserror.Expected(fuse.EPERM)
+	}
+	children, ferr := n.Children()
+	if ferr != nil {
+		return false, ferr
+	}
+	if _, ok := children[name]; ok {
+		return false, fserror.Expected(fuse.Status(syscall.EEXIST))
+	}
+	if ferr := n.ensureUpper(); ferr != nil {
+		return false, ferr
+	}
+
+	whiteout := filepath.Join(n.upperPath, whiteoutPrefix+name)
+	err := os.Remove(whiteout)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fserror.Unexpected(errors.Wrapf(err, "remove whiteout %s failed", whiteout))
+	}
+	return true, nil
+}
+
+func (n *dirNode) CreateFile(name string, mode filemode.FileMode) (fstree.WritableFileNode, *fserror.Error) {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	if _, ferr := n.prepareNewName(name); ferr != nil {
+		return nil, ferr
+	}
+	upperPath := filepath.Join(n.upperPath, name)
+	f, err := os.OpenFile(upperPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osFileMode(mode))
+	if err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "create overlay file %s failed", upperPath))
+	}
+	if err := f.Close(); err != nil {
+		return nil, fserror.Unexpected(errors.Wrapf(err, "create overlay file %s failed", upperPath))
+	}
+	return &fileNode{o: n.o, upperPath: upperPath}, nil
+}
+
+func (n *dirNode) CreateSymlink(name string, target string) *fserror.Error {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	if _, ferr := n.prepareNewName(name); ferr != nil {
+		return ferr
+	}
+	upperPath := filepath.Join(n.upperPath, name)
+	if err := os.Symlink(target, upperPath); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "create overlay symlink %s failed", upperPath))
+	}
+	return nil
+}
+
+func (n *dirNode) Mkdir(name string) *fserror.Error {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	clearedWhiteout, ferr := n.prepareNewName(name)
+	if ferr != nil {
+		return ferr
+	}
+	upperPath := filepath.Join(n.upperPath, name)
+	if err := os.Mkdir(upperPath, 0755); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "create overlay directory %s failed", upperPath))
+	}
+	if clearedWhiteout {
+		// The lower directory was deleted, so it mustn't show through the new one.
+		if err := ioutil.WriteFile(filepath.Join(upperPath, opaqueMarker), nil, 0644); err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "mark overlay directory %s opaque failed", upperPath))
+		}
+	}
+	return nil
+}
+
+func (n *dirNode) Remove(name string) *fserror.Error {
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	children, ferr := n.Children()
+	if ferr != nil {
+		return ferr
+	}
+	child, ok := children[name]
+	if !ok {
+		return fserror.Expected(fuse.ENOENT)
+	}
+	if n.isRoot && name == metadataDirName {
+		return fserror.Expected(fuse.EPERM)
+	}
+	if childDir, ok := child.(*dirNode); ok {
+		grandchildren, ferr := childDir.Children()
+		if ferr != nil {
+			return ferr
+		}
+		if len(grandchildren) > 0 {
+			return fserror.Expected(fuse.Status(syscall.ENOTEMPTY))
+		}
+	}
+	return n.removeChild(name, child)
+}
+
+// removeChild deletes a child's upper copy and hides its lower one.
+func (n *dirNode) removeChild(name string, child fstree.Node) *fserror.Error {
+	upperPath := filepath.Join(n.upperPath, name)
+	if err := os.RemoveAll(upperPath); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "remove overlay file %s failed", upperPath))
+	}
+
+	var inLower bool
+	switch c := child.(type) {
+	case *dirNode:
+		inLower = c.lower != nil
+	case *fileNode:
+		inLower = c.lower != nil
+	}
+	if !inLower {
+		return nil
+	}
+	if ferr := n.ensureUpper(); ferr != nil {
+		return ferr
+	}
+	whiteout := filepath.Join(n.upperPath, whiteoutPrefix+name)
+	if err := ioutil.WriteFile(whiteout, nil, 0644); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "create whiteout %s failed", whiteout))
+	}
+	return nil
+}
+
+// Rename moves a file, copying it up first if needed. Like overlayfs without redirects, it returns
+// EXDEV for directories that exist in the lower tree, so tools fall back to copying.
+func (n *dirNode) Rename(oldName string, newDir fstree.WritableDirNode, newName string) *fserror.Error {
+	target, ok := newDir.(*dirNode)
+	if !ok || target.o != n.o {
+		return fserror.Expected(fuse.EXDEV)
+	}
+	if strings.HasPrefix(newName, whiteoutPrefix) || (target.isRoot && newName == metadataDirName) {
+		return fserror.Expected(fuse.EPERM)
+	}
+
+	n.o.mu.Lock()
+	defer n.o.mu.Unlock()
+
+	children, ferr := n.Children()
+	if ferr != nil {
+		return ferr
+	}
+	child, ok := children[oldName]
+	if !ok {
+		return fserror.Expected(fuse.ENOENT)
+	}
+	switch c := child.(type) {
+	case *dirNode:
+		if c.lower != nil {
+			return fserror.Expected(fuse.EXDEV)
+		}
+	case *fileNode:
+		if ferr := c.copyUp(); ferr != nil {
+			return ferr
+		}
+	default:
+		return fserror.Expected(fuse.EPERM)
+	}
+
+	targetChildren, ferr := target.Children()
+	if ferr != nil {
+		return ferr
+	}
+	if existing, ok := targetChildren[newName]; ok {
+		_, childIsDir := child.(*dirNode)
+		existingDir, existingIsDir := existing.(*dirNode)
+		switch {
+		case childIsDir && !existingIsDir:
+			return fserror.Expected(fuse.ENOTDIR)
+		case !childIsDir && existingIsDir:
+			return fserror.Expected(fuse.EISDIR)
+		case existingIsDir:
+			grandchildren, ferr := existingDir.Children()
+			if ferr != nil {
+				return ferr
+			}
+			if len(grandchildren) > 0 {
+				return fserror.Expected(fuse.Status(syscall.ENOTEMPTY))
+			}
+		}
+		if ferr := target.removeChild(newName, existing); ferr != nil {
+			return ferr
+		}
+	}
+	if ferr := target.ensureUpper(); ferr != nil {
+		return ferr
+	}
+
+	oldPath, newPath := filepath.Join(n.upperPath, oldName), filepath.Join(target.upperPath, newName)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fserror.Unexpected(errors.Wrapf(err, "rename %s to %s failed", oldPath, newPath))
+	}
+	if f, ok := child.(*fileNode); ok && f.lower != nil {
+		whiteout := filepath.Join(n.upperPath, whiteoutPrefix+oldName)
+		if err := ioutil.WriteFile(whiteout, nil, 0644); err != nil {
+			return fserror.Unexpected(errors.Wrapf(err, "create whiteout %s failed", whiteout))
+		}
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// copyFile writes the contents of r to a new file at path.
+func copyFile(path string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func osFileMode(mode filemode.FileMode) os.FileMode {
+	if mode == filemode.Executable {
+		return 0755
+	}
+	return 0644
+}
@@ -0,0 +1,188 @@
+package overlay
+
+import (
+	"github.com/josh-newman/gitviewfs/gitviewfs/fserror"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree/fstreetest"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTestView returns a commit view over a small lower tree, with its upper directory.
+func newTestView(t *testing.T) (*dirNode, string) {
+	upperDir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower := fstreetest.Dir{
+		"a":          fstreetest.NewFile("a", filemode.Regular, "lower a\n"),
+		"b":          fstreetest.NewFile("b", filemode.Regular, "lower b\n"),
+		"dir":        fstreetest.Dir{"x": fstreetest.NewFile("x", filemode.Regular, "lower x\n")},
+		".gitviewfs": fstreetest.Dir{},
+	}
+	return &dirNode{o: &overlay{}, lower: lower, upperPath: upperDir, isRoot: true}, upperDir
+}
+
+// childNames returns the names dir lists, checking that looking each of them up finds the same
+// kind of node.
+func childNames(t *testing.T, dir *dirNode) []string {
+	children, ferr := dir.Children()
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	names := []string{}
+	for name, child := range children {
+		names = append(names, name)
+		looked, ferr := dir.Lookup(name)
+		if ferr != nil {
+			t.Errorf("look up %s: %v", name, ferr)
+		} else if reflect.TypeOf(looked) != reflect.TypeOf(child) {
+			t.Errorf("look up %s: got %T, listed %T", name, looked, child)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkNotFound(t *testing.T, dir *dirNode, name string) {
+	if _, ferr := dir.Lookup(name); ferr == nil || ferr.Kind != fserror.NotFound {
+		t.Errorf("look up %s: got %v, want not found", name, ferr)
+	}
+}
+
+func contents(t *testing.T, node fstree.Node) string {
+	got, err := node.(fstree.FileNode).File().Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRemoveWhitesOut(t *testing.T) {
+	root, upperDir := newTestView(t)
+	defer os.RemoveAll(upperDir)
+
+	if ferr := root.Remove("a"); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if !exists(filepath.Join(upperDir, ".wh.a")) {
+		t.Error("no whiteout for a")
+	}
+	if got, want := childNames(t, root), []string{".gitviewfs", "b", "dir"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	checkNotFound(t, root, "a")
+	checkNotFound(t, root, ".wh.a")
+
+	// A new file in its place clears the whiteout, and doesn't show the lower file.
+	if _, ferr := root.CreateFile("a", filemode.Regular); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if exists(filepath.Join(upperDir, ".wh.a")) {
+		t.Error("whiteout for a kept")
+	}
+	a, ferr := root.Lookup("a")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got := contents(t, a); got != "" {
+		t.Errorf("got %q, want the new file's empty contents", got)
+	}
+}
+
+func TestMkdirOverRemovedIsOpaque(t *testing.T) {
+	root, upperDir := newTestView(t)
+	defer os.RemoveAll(upperDir)
+
+	dir, ferr := root.Lookup("dir")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if ferr := dir.(*dirNode).Remove("x"); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if ferr := root.Remove("dir"); ferr != nil {
+		t.Fatal(ferr)
+	}
+	checkNotFound(t, root, "dir")
+
+	if ferr := root.Mkdir("dir"); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if !exists(filepath.Join(upperDir, "dir", opaqueMarker)) {
+		t.Error("new dir isn't opaque")
+	}
+	dir, ferr = root.Lookup("dir")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got := childNames(t, dir.(*dirNode)); len(got) != 0 {
+		t.Errorf("got %q, want the lower directory hidden", got)
+	}
+	checkNotFound(t, dir.(*dirNode), "x")
+}
+
+func TestMkdirNewIsNotOpaque(t *testing.T) {
+	root, upperDir := newTestView(t)
+	defer os.RemoveAll(upperDir)
+
+	if ferr := root.Mkdir("new"); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if exists(filepath.Join(upperDir, "new", opaqueMarker)) {
+		t.Error("new dir is opaque")
+	}
+	if got, want := childNames(t, root), []string{".gitviewfs", "a", "b", "dir", "new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWriteCopiesUp(t *testing.T) {
+	root, upperDir := newTestView(t)
+	defer os.RemoveAll(upperDir)
+
+	dir, ferr := root.Lookup("dir")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	x, ferr := dir.(*dirNode).Lookup("x")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	file := x.(*fileNode)
+	if _, ferr := file.WriteAt([]byte("upper"), 0); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if got := contents(t, file); got != "upper x\n" {
+		t.Errorf("got %q", got)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(upperDir, "dir", "x")); err != nil || string(got) != "upper x\n" {
+		t.Errorf("upper copy: got %q and error %v", got, err)
+	}
+
+	// The file's contents are reused until it changes.
+	if file.File() != file.File() {
+		t.Error("unchanged file's contents weren't reused")
+	}
+	before := file.File()
+	if ferr := file.Truncate(3); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if after := file.File(); after == before || contents(t, file) != "upp" {
+		t.Errorf("got %q after truncating", contents(t, file))
+	}
+
+	// The lower tree's metadata directory is never overlaid.
+	metadata, ferr := root.Lookup(".gitviewfs")
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if _, ok := metadata.(*dirNode); ok {
+		t.Error(".gitviewfs is overlaid")
+	}
+}
@@ -0,0 +1,475 @@
+// Package trigram keeps an index of the trigrams in blobs, for finding the files that may contain
+// text without reading every file.
+//
+// The index is keyed by blob hash, so it's shared by every reference and commit containing the
+// same files, and updating it for a reference that has moved only reads the blobs it hasn't seen.
+// It's stored in a file that updates append to, holding an exclusive flock while they write, which
+// readers wait for with a shared one.
+package trigram
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// DefaultPath returns where the index of the repository in gitDir is kept by default.
+func DefaultPath(gitDir string) string {
+	return filepath.Join(gitDir, "gitviewfs", "trigrams")
+}
+
+// Trigram is three consecutive bytes, packed into the low 24 bits.
+type Trigram uint32
+
+// Extract returns the distinct trigrams in data, in ascending order.
+func Extract(data []byte) []Trigram {
+	seen := map[Trigram]bool{}
+	var trigrams []Trigram
+	for i := 0; i+3 <= len(data); i++ {
+		t := Trigram(data[i])<<16 | Trigram(data[i+1])<<8 | Trigram(data[i+2])
+		if !seen[t] {
+			seen[t] = true
+			trigrams = append(trigrams, t)
+		}
+	}
+	sort.Slice(trigrams, func(i, j int) bool { return trigrams[i] < trigrams[j] })
+	return trigrams
+}
+
+// Blobs that look binary or have too many trigrams aren't indexed, since nearly every query would
+// match them anyway. They're recorded, so they aren't read again, and are always candidates.
+const (
+	// binaryCheckSize is how much of a blob is checked for NUL bytes to decide if it's binary.
+	binaryCheckSize = 8000
+	maxTrigrams     = 20000
+)
+
+// magic starts index files, and changes with their format.
+const magic = "gitviewfs trigram index 1\n"
+
+// Record flags.
+const (
+	recordIndexed   = 0
+	recordUnindexed = 1
+)
+
+// ErrCorrupt is the cause of errors reading index files with records that can't have been written
+// by an update, even one cut short. Reset discards the records so the index can be rebuilt.
+var ErrCorrupt = errors.New("trigram index is corrupt")
+
+// Index maps trigrams to the blobs containing them. It's safe to query concurrently, but not while
+// updating.
+type Index struct {
+	path string
+	// size is the length of the valid records in the file, which updates append after.
+	size int64
+	// fileSize and modTime are the file's when it was last read, for noticing updates by other
+	// processes.
+	fileSize int64
+	modTime  time.Time
+
+	blobs []plumbing.Hash
+	ids   map[plumbing.Hash]uint32
+	// postings holds the ids of the blobs containing each trigram, in ascending order.
+	postings map[Trigram][]uint32
+	// unindexed holds the ids of the blobs that weren't indexed.
+	unindexed []uint32
+}
+
+// Open reads the index stored at path, or returns an empty one that will be stored there if there's
+// no file. A record cut short, by an update that didn't finish, is ignored and later overwritten.
+func Open(path string) (*Index, error) {
+	ix := &Index{path: path, ids: map[plumbing.Hash]uint32{}, postings: map[Trigram][]uint32{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ix, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open trigram index failed")
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, errors.Wrap(err, "lock trigram index failed")
+	}
+	if err := ix.readNew(f); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// Reset empties the index stored at path, and returns it.
+func Reset(path string) (*Index, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return Open(path)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open trigram index failed")
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, errors.Wrap(err, "lock trigram index failed")
+	}
+	if err := f.Truncate(0); err != nil {
+		return nil, errors.Wrap(err, "truncate trigram index failed")
+	}
+	return &Index{path: path, ids: map[plumbing.Hash]uint32{}, postings: map[Trigram][]uint32{}}, nil
+}
+
+// Reopen returns the index stored at ix's path if another process has updated it since ix was
+// read, or ix. It's for long-lived readers, like mounts, which can't update ix while it's queried.
+func (ix *Index) Reopen() (*Index, error) {
+	info, err := os.Stat(ix.path)
+	if os.IsNotExist(err) {
+		return ix, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "stat trigram index failed")
+	}
+	if info.Size() == ix.fileSize && info.ModTime().Equal(ix.modTime) {
+		return ix, nil
+	}
+	return Open(ix.path)
+}
+
+// readNew reads the records of f, a locked index file, after those already read. An empty file is
+// an empty index.
+func (ix *Index) readNew(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat trigram index failed")
+	}
+	if info.Size() < ix.size {
+		// Another process reset the index, so the records read so far may not be in it any more.
+		*ix = Index{path: ix.path, ids: map[plumbing.Hash]uint32{}, postings: map[Trigram][]uint32{}}
+	}
+	ix.fileSize, ix.modTime = info.Size(), info.ModTime()
+	if info.Size() == 0 {
+		return nil
+	}
+	if _, err := f.Seek(ix.size, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek in trigram index failed")
+	}
+
+	reader := bufio.NewReader(f)
+	if ix.size == 0 {
+		header := make([]byte, len(magic))
+		if _, err := io.ReadFull(reader, header); err != nil || string(header) != magic {
+			return errors.Errorf("%s isn't a trigram index", ix.path)
+		}
+		ix.size = int64(len(magic))
+	}
+	for {
+		n, err := ix.readRecord(reader, info.Size()-ix.size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "read trigram index %s failed", ix.path)
+		}
+		ix.size += n
+	}
+}
+
+// readRecord reads a blob's record, at most remaining bytes long, adds it to the index, and returns
+// its length.
+func (ix *Index) readRecord(reader *bufio.Reader, remaining int64) (int64, error) {
+	hash, indexed, trigrams, n, err := readRecord(reader, remaining)
+	if err != nil {
+		return 0, err
+	}
+	ix.add(hash, indexed, trigrams)
+	return n, nil
+}
+
+// readRecord decodes a record written by appendRecord, at most remaining bytes long, and returns
+// its length. Records cut short return io.ErrUnexpectedEOF.
+func readRecord(reader *bufio.Reader, remaining int64) (hash plumbing.Hash, indexed bool, trigrams []Trigram, n int64, err error) {
+	if _, err := io.ReadFull(reader, hash[:]); err != nil {
+		return hash, false, nil, 0, err
+	}
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return hash, false, nil, 0, io.ErrUnexpectedEOF
+	}
+	if flags != recordIndexed && flags != recordUnindexed {
+		return hash, false, nil, 0, errors.Wrapf(ErrCorrupt, "invalid record flags %d for blob %s", flags, hash)
+	}
+	n = int64(len(hash) + 1)
+
+	count, err := readUvarint(reader, &n)
+	if err != nil {
+		return hash, false, nil, 0, err
+	}
+	// Each trigram takes at least a byte, so a count longer than the rest of the file is a record
+	// cut short, but updates never write more than maxTrigrams.
+	if count > maxTrigrams || (flags == recordUnindexed && count != 0) {
+		return hash, false, nil, 0, errors.Wrapf(ErrCorrupt, "invalid trigram count %d for blob %s", count, hash)
+	} else if int64(count) > remaining-n {
+		return hash, false, nil, 0, io.ErrUnexpectedEOF
+	}
+	trigrams = make([]Trigram, count)
+	var previous uint64
+	for i := range trigrams {
+		delta, err := readUvarint(reader, &n)
+		if err != nil {
+			return hash, false, nil, 0, err
+		}
+		previous += delta
+		trigrams[i] = Trigram(previous)
+	}
+	return hash, flags == recordIndexed, trigrams, n, nil
+}
+
+// appendRecord appends a blob's record to b: its hash, flags, and the number of trigrams followed
+// by the differences between them, which are ascending.
+func appendRecord(b []byte, hash plumbing.Hash, indexed bool, trigrams []Trigram) []byte {
+	flags := byte(recordIndexed)
+	if !indexed {
+		flags = recordUnindexed
+	}
+	b = append(append(b, hash[:]...), flags)
+	b = appendUvarint(b, uint64(len(trigrams)))
+	var previous Trigram
+	for _, t := range trigrams {
+		b = appendUvarint(b, uint64(t-previous))
+		previous = t
+	}
+	return b
+}
+
+func readUvarint(reader *bufio.Reader, n *int64) (uint64, error) {
+	v, err := binary.ReadUvarint(reader)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, err
+	}
+	*n += int64(uvarintLen(v))
+	return v, nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+func (ix *Index) add(hash plumbing.Hash, indexed bool, trigrams []Trigram) {
+	if _, ok := ix.ids[hash]; ok {
+		return
+	}
+	id := uint32(len(ix.blobs))
+	ix.blobs = append(ix.blobs, hash)
+	ix.ids[hash] = id
+	if !indexed {
+		ix.unindexed = append(ix.unindexed, id)
+		return
+	}
+	for _, t := range trigrams {
+		ix.postings[t] = append(ix.postings[t], id)
+	}
+}
+
+// Len returns the number of blobs in the index.
+func (ix *Index) Len() int {
+	return len(ix.blobs)
+}
+
+// Has reports whether the blob has been added to the index.
+func (ix *Index) Has(hash plumbing.Hash) bool {
+	_, ok := ix.ids[hash]
+	return ok
+}
+
+// Candidates returns a function reporting whether a blob may match q: it contains all of q's
+// trigrams, or it isn't in the index, or the index couldn't narrow q down.
+func (ix *Index) Candidates(q *Query) func(hash plumbing.Hash) bool {
+	if len(q.trigrams) == 0 {
+		return func(plumbing.Hash) bool { return true }
+	}
+	ids := ix.postings[q.trigrams[0]]
+	for _, t := range q.trigrams[1:] {
+		ids = intersect(ids, ix.postings[t])
+	}
+	candidates := map[uint32]bool{}
+	for _, id := range ids {
+		candidates[id] = true
+	}
+	for _, id := range ix.unindexed {
+		candidates[id] = true
+	}
+	return func(hash plumbing.Hash) bool {
+		id, ok := ix.ids[hash]
+		return !ok || candidates[id]
+	}
+}
+
+// intersect returns the ids in both of the ascending lists a and b.
+func intersect(a, b []uint32) []uint32 {
+	var both []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+// Update adds the regular files of trees that aren't already in the index, and stores them. It
+// returns the number of blobs added.
+func (ix *Index) Update(repo *git.Repository, trees []*object.Tree) (int, error) {
+	blobs, err := ix.missingBlobs(trees)
+	if err != nil {
+		return 0, err
+	}
+	if len(blobs) == 0 {
+		return 0, nil
+	}
+
+	records := make([][]byte, len(blobs))
+	errs := make([]error, len(blobs))
+	forEach(len(blobs), func(i int) {
+		records[i], errs[i] = indexBlob(repo, blobs[i])
+	})
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := ix.store(records); err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		if _, err := ix.readRecord(bufio.NewReader(bytes.NewReader(record)), int64(len(record))); err != nil {
+			return 0, errors.Wrap(err, "add record failed")
+		}
+	}
+	return len(blobs), nil
+}
+
+// missingBlobs returns the blobs of regular files in trees that aren't in the index. Trees shared by
+// several of the trees are only walked once.
+func (ix *Index) missingBlobs(trees []*object.Tree) ([]plumbing.Hash, error) {
+	var blobs []plumbing.Hash
+	seen := map[plumbing.Hash]bool{}
+	for _, tree := range trees {
+		if seen[tree.Hash] {
+			continue
+		}
+		seen[tree.Hash] = true
+		walker := object.NewTreeWalker(tree, true, seen)
+		for {
+			_, entry, err := walker.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				walker.Close()
+				return nil, errors.Wrapf(err, "walk tree %s failed", tree.Hash)
+			}
+			if entry.Mode == filemode.Dir {
+				seen[entry.Hash] = true
+			}
+			if entry.Mode != filemode.Regular && entry.Mode != filemode.Executable {
+				continue
+			}
+			if !seen[entry.Hash] && !ix.Has(entry.Hash) {
+				seen[entry.Hash] = true
+				blobs = append(blobs, entry.Hash)
+			}
+		}
+		walker.Close()
+	}
+	return blobs, nil
+}
+
+// indexBlob reads a blob and returns its record.
+func indexBlob(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	data, err := readBlob(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := true
+	var trigrams []Trigram
+	head := data
+	if len(head) > binaryCheckSize {
+		head = head[:binaryCheckSize]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		indexed = false
+	} else if trigrams = Extract(data); len(trigrams) > maxTrigrams {
+		indexed, trigrams = false, nil
+	}
+	return appendRecord(nil, hash, indexed, trigrams), nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// store appends records to the index's file, creating it if needed. Records another process
+// appended since the index was read are read first, and records of the blobs they have are skipped.
+func (ix *Index) store(records [][]byte) error {
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0755); err != nil {
+		return errors.Wrap(err, "create trigram index directory failed")
+	}
+	f, err := os.OpenFile(ix.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open trigram index failed")
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, "lock trigram index failed")
+	}
+	if err := ix.readNew(f); err != nil {
+		return err
+	}
+	if ix.size == 0 {
+		ix.size = int64(len(magic))
+		if _, err := f.WriteAt([]byte(magic), 0); err != nil {
+			return errors.Wrap(err, "write trigram index failed")
+		}
+	}
+	// Drop anything after the valid records, like a record cut short.
+	if err := f.Truncate(ix.size); err != nil {
+		return errors.Wrap(err, "truncate trigram index failed")
+	}
+	if _, err := f.Seek(ix.size, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek in trigram index failed")
+	}
+	writer := bufio.NewWriter(f)
+	for _, record := range records {
+		var hash plumbing.Hash
+		copy(hash[:], record)
+		if ix.Has(hash) {
+			continue
+		}
+		if _, err := writer.Write(record); err != nil {
+			return errors.Wrap(err, "write trigram index failed")
+		}
+		ix.size += int64(len(record))
+	}
+	if err := writer.Flush(); err != nil {
+		return errors.Wrap(err, "write trigram index failed")
+	}
+	return errors.Wrap(f.Close(), "write trigram index failed")
+}
@@ -0,0 +1,118 @@
+package trigram
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var (
+	hashA = plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	hashB = plumbing.NewHash("89abcdef0123456789abcdef0123456789abcdef")
+)
+
+func decode(record []byte, remaining int64) (plumbing.Hash, bool, []Trigram, int64, error) {
+	return readRecord(bufio.NewReader(bytes.NewReader(record)), remaining)
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		indexed  bool
+		trigrams []Trigram
+	}{
+		{name: "indexed", indexed: true, trigrams: Extract([]byte("hello, world"))},
+		{name: "extremes", indexed: true, trigrams: []Trigram{0, 1, 0x7f, 0x80, 0xffffff}},
+		{name: "no trigrams", indexed: true},
+		{name: "unindexed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := appendRecord([]byte("prefix"), hashA, test.indexed, test.trigrams)[len("prefix"):]
+			hash, indexed, trigrams, n, err := decode(record, int64(len(record)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash != hashA || indexed != test.indexed || len(trigrams) != len(test.trigrams) ||
+				(len(trigrams) > 0 && !reflect.DeepEqual(trigrams, test.trigrams)) {
+				t.Errorf("got %s, %v, %v, want %s, %v, %v", hash, indexed, trigrams, hashA, test.indexed, test.trigrams)
+			}
+			if n != int64(len(record)) {
+				t.Errorf("got length %d, want %d", n, len(record))
+			}
+
+			// A record cut short is the end of the index, not an error.
+			for i := 0; i < len(record); i++ {
+				if _, _, _, _, err := decode(record[:i], int64(i)); err != io.EOF && err != io.ErrUnexpectedEOF {
+					t.Errorf("%d of %d bytes: got %v", i, len(record), err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadRecordCorrupt(t *testing.T) {
+	record := func(flags byte, count uint64) []byte {
+		return appendUvarint(append(hashA[:len(hashA):len(hashA)], flags), count)
+	}
+	tests := []struct {
+		name   string
+		record []byte
+	}{
+		{name: "flags", record: record(2, 0)},
+		{name: "too many trigrams", record: record(recordIndexed, maxTrigrams+1)},
+		{name: "huge count", record: record(recordIndexed, 1<<62)},
+		{name: "unindexed with trigrams", record: record(recordUnindexed, 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// However much of the file is left, the count can't be right.
+			if _, _, _, _, err := decode(test.record, 1<<40); errors.Cause(err) != ErrCorrupt {
+				t.Errorf("got %v, want corrupt", err)
+			}
+		})
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trigram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trigrams")
+
+	valid := appendRecord([]byte(magic), hashA, true, Extract([]byte("abcd")))
+	cutShort := appendRecord(nil, hashB, true, Extract([]byte("efgh")))
+	if err := ioutil.WriteFile(path, append(valid, cutShort[:len(cutShort)-1]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ix.Has(hashA) || ix.Has(hashB) || ix.size != int64(len(valid)) {
+		t.Errorf("got %d blobs and size %d, want only the valid record", ix.Len(), ix.size)
+	}
+
+	corrupt := append(append([]byte{}, valid...), appendRecord(nil, hashB, false, Extract([]byte("efgh")))...)
+	if err := ioutil.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); errors.Cause(err) != ErrCorrupt {
+		t.Fatalf("got %v, want corrupt", err)
+	}
+	if ix, err = Reset(path); err != nil || ix.Len() != 0 {
+		t.Fatalf("reset: got %d blobs and error %v", ix.Len(), err)
+	}
+	if ix, err = Open(path); err != nil || ix.Len() != 0 {
+		t.Errorf("open after reset: got error %v", err)
+	}
+}
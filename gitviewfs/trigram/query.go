@@ -0,0 +1,139 @@
+package trigram
+
+import (
+	"bytes"
+	"regexp"
+	"regexp/syntax"
+)
+
+// Query is a search for text in files, along with the trigrams any match must contain.
+type Query struct {
+	re *regexp.Regexp
+	// trigrams are contained by every match. If there are none, the index can't narrow the search.
+	trigrams []Trigram
+}
+
+// QueryOptions configures a query.
+type QueryOptions struct {
+	// Regexp makes the pattern a regular expression, rather than literal text.
+	Regexp     bool
+	IgnoreCase bool
+}
+
+// Compile returns a query for pattern. ^ and $ match at the start and end of lines.
+func Compile(pattern string, opts QueryOptions) (*Query, error) {
+	if !opts.Regexp {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	flags := syntax.Perl
+	if opts.IgnoreCase {
+		flags |= syntax.FoldCase
+	}
+	parsed, err := syntax.Parse(pattern, flags)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.Simplify()
+
+	prefix := "(?m)"
+	if opts.IgnoreCase {
+		prefix = "(?mi)"
+	}
+	re, err := regexp.Compile(prefix + pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Query{re: re}
+	seen := map[Trigram]bool{}
+	for _, literal := range requiredLiterals(parsed) {
+		for _, t := range Extract([]byte(literal)) {
+			if !seen[t] {
+				seen[t] = true
+				q.trigrams = append(q.trigrams, t)
+			}
+		}
+	}
+	return q, nil
+}
+
+// requiredLiterals returns case-sensitive literal strings that every match of re contains. It
+// doesn't find every one: parts of re other than literals, concatenations, groups and repetitions
+// that must happen at least once are skipped.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals make longer ones, which have more trigrams.
+		var literals []string
+		var run []rune
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run = append(run, sub.Rune...)
+				continue
+			}
+			if len(run) > 0 {
+				literals = append(literals, string(run))
+				run = nil
+			}
+			literals = append(literals, requiredLiterals(sub)...)
+		}
+		if len(run) > 0 {
+			literals = append(literals, string(run))
+		}
+		return literals
+	}
+	return nil
+}
+
+// Trigrams returns the trigrams every match contains.
+func (q *Query) Trigrams() []Trigram {
+	return q.trigrams
+}
+
+// Match reports whether data contains a match.
+func (q *Query) Match(data []byte) bool {
+	return q.re.Match(data)
+}
+
+// Line is a line of a file containing a match.
+type Line struct {
+	// Number is the line's number, starting at 1.
+	Number int
+	Text   []byte
+}
+
+// Lines returns the lines of data that matches start on.
+func (q *Query) Lines(data []byte) []Line {
+	var lines []Line
+	number, lineStart := 1, 0
+	for _, match := range q.re.FindAllIndex(data, -1) {
+		if match[0] < lineStart {
+			// The match is on a line already found.
+			continue
+		}
+		number += bytes.Count(data[lineStart:match[0]], []byte("\n"))
+		start := bytes.LastIndexByte(data[:match[0]], '\n') + 1
+		end := bytes.IndexByte(data[match[0]:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += match[0]
+		}
+		lines = append(lines, Line{Number: number, Text: data[start:end]})
+
+		number++
+		lineStart = end + 1
+	}
+	return lines
+}
@@ -0,0 +1,73 @@
+package trigram
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"io/ioutil"
+	"runtime"
+	"sync"
+)
+
+// Search reads blobs, several at once, and returns the lines of each that q matches. Blobs without
+// matches are left out.
+func Search(repo *git.Repository, blobs []plumbing.Hash, q *Query) (map[plumbing.Hash][]Line, error) {
+	lines := make([][]Line, len(blobs))
+	errs := make([]error, len(blobs))
+	forEach(len(blobs), func(i int) {
+		lines[i], errs[i] = searchBlob(repo, blobs[i], q)
+	})
+
+	matches := map[plumbing.Hash][]Line{}
+	for i, hash := range blobs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if len(lines[i]) > 0 {
+			matches[hash] = lines[i]
+		}
+	}
+	return matches, nil
+}
+
+func searchBlob(repo *git.Repository, hash plumbing.Hash, q *Query) ([]Line, error) {
+	data, err := readBlob(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	return q.Lines(data), nil
+}
+
+func readBlob(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "find blob %s failed", hash)
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "open blob %s failed", hash)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	return data, errors.Wrapf(err, "read blob %s failed", hash)
+}
+
+// forEach calls f with each index below n, on as many goroutines as there are CPUs.
+func forEach(n int, f func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
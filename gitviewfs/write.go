@@ -0,0 +1,242 @@
+package gitviewfs
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/josh-newman/gitviewfs/gitviewfs/fstree"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"path"
+	"strings"
+	"time"
+)
+
+// writableFile is an open file in a writable reference.
+type writableFile struct {
+	*file
+	node fstree.WritableFileNode
+}
+
+func (f *writableFile) InnerFile() nodefs.File {
+	return f.file
+}
+
+func (f *writableFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, ferr := f.node.WriteAt(data, off)
+	if ferr != nil {
+		return uint32(n), f.status("Write", ferr)
+	}
+	return uint32(n), fuse.OK
+}
+
+func (f *writableFile) Truncate(size uint64) fuse.Status {
+	if ferr := f.node.Truncate(int64(size)); ferr != nil {
+		return f.status("Truncate", ferr)
+	}
+	return fuse.OK
+}
+
+func (f *writableFile) Chmod(perms uint32) fuse.Status {
+	if ferr := f.node.SetMode(computeGitFileMode(perms)); ferr != nil {
+		return f.status("Chmod", ferr)
+	}
+	return fuse.OK
+}
+
+func (f *writableFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	// Git doesn't store times, so there's nothing to change.
+	return fuse.OK
+}
+
+func (f *writableFile) Flush() fuse.Status {
+	return fuse.OK
+}
+
+func (f *writableFile) Fsync(flags int) fuse.Status {
+	syncer, ok := f.node.(fstree.Syncer)
+	if !ok {
+		return fuse.OK
+	}
+	if ferr := syncer.Sync(); ferr != nil {
+		return f.status("Fsync", ferr)
+	}
+	return fuse.OK
+}
+
+func (f *gitviewfs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	dirNode, base, status := f.findWritableParent(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	fileNode, ferr := dirNode.CreateFile(base, computeGitFileMode(mode))
+	if ferr != nil {
+		return nil, f.status("Create", name, ferr)
+	}
+
+	return newFile(fileNode, f.logger, f.metrics), fuse.OK
+}
+
+func (f *gitviewfs) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	dirNode, base, status := f.findWritableParent(linkName)
+	if status != fuse.OK {
+		return status
+	}
+
+	if ferr := dirNode.CreateSymlink(base, value); ferr != nil {
+		return f.status("Symlink", linkName, ferr)
+	}
+	return fuse.OK
+}
+
+func (f *gitviewfs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	dirNode, base, status := f.findWritableParent(name)
+	if status != fuse.OK {
+		return status
+	}
+
+	if ferr := dirNode.Mkdir(base); ferr != nil {
+		return f.status("Mkdir", name, ferr)
+	}
+	return fuse.OK
+}
+
+func (f *gitviewfs) Unlink(name string, context *fuse.Context) fuse.Status {
+	return f.remove(name, false)
+}
+
+func (f *gitviewfs) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return f.remove(name, true)
+}
+
+func (f *gitviewfs) remove(name string, dir bool) fuse.Status {
+	op := "Unlink"
+	if dir {
+		op = "Rmdir"
+	}
+	node, ferr := f.findNode(name)
+	if ferr != nil {
+		return f.status(op, name, ferr)
+	}
+	if _, isDir := node.(fstree.DirNode); isDir && !dir {
+		return fuse.EISDIR
+	} else if !isDir && dir {
+		return fuse.ENOTDIR
+	}
+
+	dirNode, base, status := f.findWritableParent(name)
+	if status != fuse.OK {
+		return status
+	}
+	if ferr := dirNode.Remove(base); ferr != nil {
+		return f.status(op, name, ferr)
+	}
+	return fuse.OK
+}
+
+func (f *gitviewfs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	oldDir, oldBase, status := f.findWritableParent(oldName)
+	if status != fuse.OK {
+		return status
+	}
+	newDir, newBase, status := f.findWritableParent(newName)
+	if status != fuse.OK {
+		return status
+	}
+
+	if ferr := oldDir.Rename(oldBase, newDir, newBase); ferr != nil {
+		return f.status("Rename", oldName, ferr)
+	}
+	return fuse.OK
+}
+
+func (f *gitviewfs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	fileNode, status := f.findWritableFile(name)
+	if status != fuse.OK {
+		return status
+	}
+	return newFile(fileNode, f.logger, f.metrics).Truncate(size)
+}
+
+func (f *gitviewfs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	node, ferr := f.findNode(name)
+	if ferr != nil {
+		return f.status("Chmod", name, ferr)
+	}
+	if _, ok := node.(fstree.WritableDirNode); ok {
+		// Git doesn't store directory permissions, so there's nothing to change.
+		return fuse.OK
+	}
+
+	fileNode, status := f.findWritableFile(name)
+	if status != fuse.OK {
+		return status
+	}
+	return newFile(fileNode, f.logger, f.metrics).Chmod(mode)
+}
+
+func (f *gitviewfs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	node, ferr := f.findNode(name)
+	if ferr != nil {
+		return f.status("Utimens", name, ferr)
+	}
+	switch node.(type) {
+	case fstree.WritableDirNode, fstree.WritableFileNode:
+		// Git doesn't store times, so there's nothing to change.
+		return fuse.OK
+	default:
+		return fuse.EROFS
+	}
+}
+
+func (f *gitviewfs) OnUnmount() {
+	syncer, ok := f.fstree.(fstree.Syncer)
+	if !ok {
+		return
+	}
+	if ferr := syncer.Sync(); ferr != nil {
+		reportError(f.logger, f.metrics, ferr, "op", "OnUnmount")
+	}
+}
+
+// findWritableParent returns the writable directory containing name, and name's base.
+func (f *gitviewfs) findWritableParent(name string) (fstree.WritableDirNode, string, fuse.Status) {
+	dir, base := path.Split(name)
+	node, ferr := f.findNode(strings.TrimSuffix(dir, "/"))
+	if ferr != nil {
+		return nil, "", f.status("lookup", name, ferr)
+	}
+
+	switch n := node.(type) {
+	case fstree.WritableDirNode:
+		return n, base, fuse.OK
+	case fstree.DirNode:
+		return nil, "", fuse.EROFS
+	default:
+		return nil, "", fuse.ENOTDIR
+	}
+}
+
+func (f *gitviewfs) findWritableFile(name string) (fstree.WritableFileNode, fuse.Status) {
+	node, ferr := f.findNode(name)
+	if ferr != nil {
+		return nil, f.status("lookup", name, ferr)
+	}
+
+	switch n := node.(type) {
+	case fstree.WritableFileNode:
+		return n, fuse.OK
+	case fstree.FileNode:
+		return nil, fuse.EROFS
+	default:
+		return nil, fuse.EISDIR
+	}
+}
+
+// computeGitFileMode returns the git file mode for a file created or changed with the given
+// permissions. Git only records whether files are executable.
+func computeGitFileMode(mode uint32) filemode.FileMode {
+	if mode&0111 != 0 {
+		return filemode.Executable
+	}
+	return filemode.Regular
+}